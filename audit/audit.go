@@ -0,0 +1,63 @@
+// Package audit keeps an append-only trail of authentication and administrative actions.
+package audit
+
+import "time"
+
+// actions
+const (
+	// a connection trying to become a session, refused ones included
+	ActionHandshake = "handshake"
+	// a call to the http or grpc gateway, only refused ones are recorded
+	ActionAPIAuth = "api_auth"
+	// a call to the admin api refused for bad credentials, accepted calls are recorded by what they do
+	ActionAdminAuth = "admin_auth"
+	ActionKick      = "kick"
+	ActionNotice    = "notice"
+	// a packet the router refused to forward
+	ActionDeny       = "deny"
+	ActionGroupJoin  = "group_join"
+	ActionGroupLeave = "group_leave"
+	// the configuration was re-read, Reason tells what changed or why it was refused
+	ActionReload = "reload"
+)
+
+const (
+	ResultSuccess = "success"
+	ResultFailure = "failure"
+)
+
+// ActorRouter is the actor of actions route takes on its own.
+const ActorRouter = "router"
+
+// Event is one line of the trail, fields that do not apply to the action are left empty.
+type Event struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	Result string    `json:"result,omitempty"`
+	Reason string    `json:"reason,omitempty"`
+	// name of the operator or backend key behind the action, ActorRouter for route itself
+	Actor string `json:"actor,omitempty"`
+
+	// the session and user acted upon, Subject and Role come from the auth token
+	SessionID string `json:"sid,omitempty"`
+	UId       uint32 `json:"uid,omitempty"`
+	Subject   string `json:"subject,omitempty"`
+	Role      string `json:"role,omitempty"`
+	Remote    string `json:"remote,omitempty"`
+	Kind      string `json:"kind,omitempty"`
+
+	Group  string `json:"group,omitempty"`
+	Target uint32 `json:"target,omitempty"`
+}
+
+// Sink receives events, Record must be safe for concurrent use and should not block for long.
+type Sink interface {
+	Record(Event)
+}
+
+type discard struct{}
+
+func (discard) Record(Event) {}
+
+// Discard drops every event.
+var Discard Sink = discard{}
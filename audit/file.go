@@ -0,0 +1,128 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultMaxSize    = 100 << 20
+	DefaultMaxBackups = 10
+)
+
+type FileOptions struct {
+	Path string
+	// the file is rotated once it would grow past MaxSize bytes, 0 means DefaultMaxSize
+	MaxSize int64
+	// rotated files kept as Path.1, the newest, to Path.MaxBackups. 0 means DefaultMaxBackups
+	MaxBackups int
+}
+
+// File writes events as json lines, it only ever appends to Path and rotates it by renaming.
+type File struct {
+	opts FileOptions
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	err    error
+	closed bool
+}
+
+func OpenFile(opts FileOptions) (*File, error) {
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = DefaultMaxSize
+	}
+	if opts.MaxBackups <= 0 {
+		opts.MaxBackups = DefaultMaxBackups
+	}
+	ret := &File{opts: opts}
+	if err := ret.open(); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (l *File) open() error {
+	f, err := os.OpenFile(l.opts.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.f = f
+	l.size = st.Size()
+	return nil
+}
+
+// rotate shifts Path.N to Path.N+1, dropping the oldest, and starts a new Path.
+func (l *File) rotate() error {
+	if err := l.f.Close(); err != nil {
+		return err
+	}
+	l.f = nil
+	os.Remove(fmt.Sprintf("%s.%d", l.opts.Path, l.opts.MaxBackups))
+	for i := l.opts.MaxBackups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", l.opts.Path, i), fmt.Sprintf("%s.%d", l.opts.Path, i+1))
+	}
+	if err := os.Rename(l.opts.Path, l.opts.Path+".1"); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+// Record appends e, a failed write is kept for Err and retried with the next event.
+func (l *File) Record(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return
+	}
+	if l.f == nil {
+		if l.err = l.open(); l.err != nil {
+			return
+		}
+	}
+	if l.size > 0 && l.size+int64(len(line)) > l.opts.MaxSize {
+		if l.err = l.rotate(); l.err != nil {
+			return
+		}
+	}
+	n, err := l.f.Write(line)
+	l.size += int64(n)
+	l.err = err
+}
+
+// Err returns the error of the last write, nil when it succeeded.
+func (l *File) Err() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.err
+}
+
+func (l *File) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.closed = true
+	if l.f == nil {
+		return nil
+	}
+	err := l.f.Close()
+	l.f = nil
+	return err
+}
@@ -0,0 +1,66 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func readEvents(t *testing.T, path string) []Event {
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var ret []Event
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var e Event
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			t.Fatalf("%q: %v", sc.Text(), err)
+		}
+		ret = append(ret, e)
+	}
+	return ret
+}
+
+func TestFileRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	at := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	line, _ := json.Marshal(Event{Time: at, Action: ActionKick, UId: 7})
+	l, err := OpenFile(FileOptions{Path: path, MaxSize: int64(len(line)+1) * 2, MaxBackups: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 7; i++ {
+		l.Record(Event{Time: at, Action: ActionKick, UId: uint32(i)})
+	}
+	if err := l.Err(); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	l.Record(Event{Action: ActionKick, UId: 99})
+
+	// two events per file, the oldest ones are gone
+	cur, old1, old2 := readEvents(t, path), readEvents(t, path+".1"), readEvents(t, path+".2")
+	if len(cur) != 1 || cur[0].UId != 6 || len(old1) != 2 || old1[0].UId != 4 || len(old2) != 2 || old2[0].UId != 2 {
+		t.Fatalf("unexpected files %+v %+v %+v", cur, old1, old2)
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Fatal("more backups than MaxBackups kept")
+	}
+
+	// reopening appends
+	l, err = OpenFile(FileOptions{Path: path, MaxSize: 1 << 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Record(Event{Action: ActionNotice})
+	l.Close()
+	if cur = readEvents(t, path); len(cur) != 2 || cur[1].Action != ActionNotice || cur[1].Time.IsZero() {
+		t.Fatalf("not appended %+v", cur)
+	}
+}
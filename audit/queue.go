@@ -0,0 +1,104 @@
+package audit
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Queue hands events to a sink from its own goroutine, so Record never waits for a slow sink.
+// beyond size waiting events further ones are only counted, the count is recorded once the
+// sink caught up, as one event per action.
+type Queue struct {
+	sink Sink
+	ch   chan Event
+
+	mu      sync.Mutex
+	dropped map[string]int
+
+	die  chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+func NewQueue(sink Sink, size int) *Queue {
+	ret := &Queue{
+		sink:    sink,
+		ch:      make(chan Event, size),
+		dropped: make(map[string]int),
+		die:     make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go ret.work()
+	return ret
+}
+
+func (q *Queue) Record(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	select {
+	case <-q.die:
+		return
+	default:
+	}
+	select {
+	case q.ch <- e:
+	default:
+		q.mu.Lock()
+		q.dropped[e.Action]++
+		q.mu.Unlock()
+	}
+}
+
+func (q *Queue) work() {
+	defer close(q.done)
+	for {
+		select {
+		case e := <-q.ch:
+			q.sink.Record(e)
+			if len(q.ch) == 0 {
+				q.recordDropped()
+			}
+		case <-q.die:
+			for {
+				select {
+				case e := <-q.ch:
+					q.sink.Record(e)
+				default:
+					q.recordDropped()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (q *Queue) recordDropped() {
+	q.mu.Lock()
+	if len(q.dropped) == 0 {
+		q.mu.Unlock()
+		return
+	}
+	dropped := q.dropped
+	q.dropped = make(map[string]int)
+	q.mu.Unlock()
+
+	now := time.Now()
+	for action, n := range dropped {
+		q.sink.Record(Event{
+			Time:   now,
+			Action: action,
+			Reason: fmt.Sprintf("%d events not recorded, the audit queue was full", n),
+		})
+	}
+}
+
+// Close records what is queued and returns, the sink is left open. later events are dropped.
+func (q *Queue) Close() error {
+	q.once.Do(func() {
+		close(q.die)
+	})
+	<-q.done
+	return nil
+}
@@ -0,0 +1,43 @@
+package audit
+
+import (
+	"strings"
+	"sync"
+	"testing"
+)
+
+// blockedSink holds every Record until released.
+type blockedSink struct {
+	release chan struct{}
+	mu      sync.Mutex
+	events  []Event
+}
+
+func (s *blockedSink) Record(e Event) {
+	<-s.release
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, e)
+}
+
+func TestQueueDrops(t *testing.T) {
+	sink := &blockedSink{release: make(chan struct{})}
+	q := NewQueue(sink, 4)
+	// a stuck sink never holds up the caller
+	for i := 0; i < 100; i++ {
+		q.Record(Event{Action: ActionHandshake, UId: uint32(i)})
+	}
+	close(sink.release)
+	q.Close()
+	q.Record(Event{Action: ActionHandshake})
+
+	// the worker holds at most one event besides the queued ones, the rest is counted
+	kept := len(sink.events) - 1
+	if kept < 4 || kept > 5 {
+		t.Fatalf("%d events recorded", len(sink.events))
+	}
+	last := sink.events[len(sink.events)-1]
+	if last.Action != ActionHandshake || !strings.HasPrefix(last.Reason, "9") || !strings.Contains(last.Reason, "not recorded") {
+		t.Fatalf("no count of dropped events: %+v", last)
+	}
+}
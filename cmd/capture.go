@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+
+	"route/msg"
+	"route/server"
+
+	"github.com/urfave/cli/v2"
+)
+
+// bodies longer than this are cut in decoded output
+const maxBodyPreview = 64
+
+var captureCommand = &cli.Command{
+	Name:  "capture",
+	Usage: "inspect and replay packet captures recorded with --capture",
+	Subcommands: []*cli.Command{
+		{
+			Name:      "decode",
+			Usage:     "print the packets of a capture",
+			ArgsUsage: "FILE",
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "session", Usage: "only packets of this session id"},
+				&cli.IntFlag{Name: "msgid", Usage: "decode route bodies as the protobuf message with this MSGID"},
+			},
+			Action: decodeCapture,
+		},
+		{
+			Name:      "replay",
+			Usage:     "send the packets of a captured session to a server again, with their original timing",
+			ArgsUsage: "FILE",
+			Flags: []cli.Flag{
+				&cli.StringFlag{Name: "server", Usage: "address of the server, as in --listen", Required: true},
+				&cli.StringFlag{Name: "token", Usage: "auth token of the replaying client"},
+				&cli.StringFlag{Name: "session", Usage: "session to replay, required when the capture has several"},
+				&cli.StringFlag{Name: "direction", Usage: "packets to send: in for captures taken by a server, out for ones taken by a client", Value: "in"},
+				&cli.Float64Flag{Name: "speed", Usage: "replay speed factor, 0 sends without waiting", Value: 1},
+				&cli.DurationFlag{Name: "wait", Usage: "time to wait for answers after the last packet", Value: time.Second},
+				&cli.BoolFlag{Name: "insecure", Usage: "skip verification of the server certificate"},
+			},
+			Action: replayCapture,
+		},
+	},
+}
+
+func openCapture(c *cli.Context) (*server.CaptureReader, io.Closer, error) {
+	if c.Args().Len() != 1 {
+		return nil, nil, errors.New("one capture file is required")
+	}
+	f, err := os.Open(c.Args().First())
+	if err != nil {
+		return nil, nil, err
+	}
+	cr, err := server.NewCaptureReader(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return cr, f, nil
+}
+
+// describeBody prints a route body as the message of msgid when it is set, else as text or hex.
+func describeBody(body []byte, msgid int) string {
+	if msgid != 0 {
+		m := msg.NewMessageByID(int32(msgid))
+		if m == nil {
+			return fmt.Sprintf("unknown msgid %d", msgid)
+		}
+		if err := proto.Unmarshal(body, m); err != nil {
+			return fmt.Sprintf("not a %s: %v", m.ProtoReflect().Descriptor().Name(), err)
+		}
+		b, _ := protojson.Marshal(m)
+		return fmt.Sprintf("%s %s", m.ProtoReflect().Descriptor().Name(), b)
+	}
+	cut := body
+	if len(cut) > maxBodyPreview {
+		cut = cut[:maxBodyPreview]
+	}
+	preview := ""
+	if utf8.Valid(cut) {
+		preview = strconv.Quote(string(cut))
+	} else {
+		preview = hex.EncodeToString(cut)
+	}
+	if len(cut) < len(body) {
+		preview += "..."
+	}
+	return preview
+}
+
+func describeRecord(r *server.CaptureRecord, msgid int) string {
+	line := fmt.Sprintf("%s %s %-3s %s", r.Time.Format(time.RFC3339Nano), r.SessionID, r.Dir, server.DescribePacket(r.Packet))
+	switch p := r.Packet.(type) {
+	case *server.RoutePacket:
+		if len(p.Body) > 0 {
+			line += " " + describeBody(p.Body, msgid)
+		}
+	case *server.HVPacket:
+		if p.GetFlag() == server.HVPacketFlagMessage || p.GetFlag() == server.HVPacketFlagEcho {
+			line += " " + describeBody(p.GetBody(), 0)
+		}
+	}
+	return line
+}
+
+func decodeCapture(c *cli.Context) error {
+	cr, f, err := openCapture(c)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	for {
+		r, err := cr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if s := c.String("session"); s != "" && r.SessionID != s {
+			continue
+		}
+		fmt.Fprintln(c.App.Writer, describeRecord(r, c.Int("msgid")))
+	}
+}
+
+// replayable leaves out the traffic the replaying client makes on its own.
+func replayable(p server.Packet) bool {
+	if hv, ok := p.(*server.HVPacket); ok {
+		return hv.GetFlag() == server.HVPacketFlagMessage || hv.GetFlag() == server.HVPacketFlagEcho
+	}
+	return true
+}
+
+func replayCapture(c *cli.Context) error {
+	var dir server.CaptureDirection
+	switch c.String("direction") {
+	case "in":
+		dir = server.CaptureIn
+	case "out":
+		dir = server.CaptureOut
+	default:
+		return fmt.Errorf("invalid direction %q, want in or out", c.String("direction"))
+	}
+	cr, f, err := openCapture(c)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	session := c.String("session")
+	var records []*server.CaptureRecord
+	sessions := map[string]bool{}
+	for {
+		r, err := cr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if r.Dir != dir || (session != "" && r.SessionID != session) || !replayable(r.Packet) {
+			continue
+		}
+		sessions[r.SessionID] = true
+		records = append(records, r)
+	}
+	if len(sessions) > 1 {
+		return fmt.Errorf("the capture has %d sessions, pick one with --session", len(sessions))
+	}
+	if len(records) == 0 {
+		return errors.New("nothing to replay")
+	}
+
+	out := c.App.Writer
+	client := server.NewTcpClient(server.TcpClientOptions{
+		RemoteAddress:        c.String("server"),
+		Token:                c.String("token"),
+		ReconnectDelaySecond: -1,
+		TLSConfig:            &tls.Config{InsecureSkipVerify: c.Bool("insecure")},
+		OnSessionPacket: func(s server.Session, p server.Packet) {
+			fmt.Fprintln(out, describeRecord(&server.CaptureRecord{Time: time.Now(), SessionID: s.SessionID(), Dir: server.CaptureIn, Packet: p}, 0))
+		},
+	})
+	if err := client.Connect(); err != nil {
+		return err
+	}
+	defer client.Close()
+
+	speed := c.Float64("speed")
+	start := records[0].Time
+	began := time.Now()
+	for _, r := range records {
+		if speed > 0 {
+			at := began.Add(time.Duration(float64(r.Time.Sub(start)) / speed))
+			time.Sleep(time.Until(at))
+		}
+		fmt.Fprintln(out, describeRecord(&server.CaptureRecord{Time: time.Now(), SessionID: client.SessionID(), Dir: server.CaptureOut, Packet: r.Packet}, 0))
+		if err := client.Send(r.Packet); err != nil {
+			return err
+		}
+	}
+	time.Sleep(c.Duration("wait"))
+	return nil
+}
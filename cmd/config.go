@@ -0,0 +1,568 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"route/audit"
+	"route/handle"
+	"route/server"
+
+	"github.com/urfave/cli/v2"
+)
+
+// Config is what the route command runs with. it is read from the --config yaml file,
+// then flags and their ROUTE_* environment variables override single settings.
+type Config struct {
+	Listeners []ListenerConfig `yaml:"listeners"`
+	// certificate of tls listeners without one of their own
+	TLS      TLSFiles       `yaml:"tls"`
+	Auth     AuthConfig     `yaml:"auth"`
+	Timeouts TimeoutsConfig `yaml:"timeouts"`
+	Limits   LimitsConfig   `yaml:"limits"`
+	Log      LogConfig      `yaml:"log"`
+	Admin    AdminConfig    `yaml:"admin"`
+	Audit    AuditConfig    `yaml:"audit"`
+	// file recording the packets of every session, empty disables it
+	Capture string `yaml:"capture"`
+}
+
+type TLSFiles struct {
+	Cert string `yaml:"cert"`
+	Key  string `yaml:"key"`
+}
+
+type ListenerConfig struct {
+	// tcp://, tls://, ws://, wss://, http://, https://, grpc://, grpcs://, udp:// or unix:// address
+	Addr string   `yaml:"addr"`
+	TLS  TLSFiles `yaml:"tls"`
+	// permissions of a unix socket file, in octal
+	UnixMode      string              `yaml:"unix_mode"`
+	ProxyProtocol ProxyProtocolConfig `yaml:"proxy_protocol"`
+	// token keys and api keys of this listener, replacing the top level auth
+	Auth *AuthConfig `yaml:"auth"`
+	// limits of this listener, replacing the top level limits as a whole
+	Limits *LimitsConfig `yaml:"limits"`
+}
+
+type ProxyProtocolConfig struct {
+	// ips or cidrs of the balancers allowed to send a header
+	Trusted  []string `yaml:"trusted"`
+	Required bool     `yaml:"required"`
+}
+
+type AuthConfig struct {
+	// rsa keys of client tokens, both are generated when neither file exists
+	PublicKey  string `yaml:"public_key"`
+	PrivateKey string `yaml:"private_key"`
+	// keys of backends using the http and grpc gateways, by name
+	APIKeys map[string]string `yaml:"api_keys"`
+	// token roles allowed to broadcast and look up presence on the gateways, like api keys
+	TrustedRoles []string `yaml:"trusted_roles"`
+}
+
+type TimeoutsConfig struct {
+	// sessions silent for longer are closed
+	Heartbeat time.Duration `yaml:"heartbeat"`
+	// time a new connection has to complete the handshake, 0 means Heartbeat
+	Handshake time.Duration `yaml:"handshake"`
+}
+
+type RateConfig struct {
+	Rate  float64 `yaml:"rate"`
+	Burst float64 `yaml:"burst"`
+}
+
+func (r RateConfig) limit() server.RateLimit {
+	return server.RateLimit{Rate: r.Rate, Burst: r.Burst}
+}
+
+type LimitsConfig struct {
+	MaxConns      int        `yaml:"max_conns"`
+	MaxHandshakes int        `yaml:"max_handshakes"`
+	AcceptRate    RateConfig `yaml:"accept_rate"`
+	Allow         []string   `yaml:"allow"`
+	Deny          []string   `yaml:"deny"`
+	PerIP         struct {
+		ConnRate RateConfig `yaml:"conn_rate"`
+		MaxConns int        `yaml:"max_conns"`
+	} `yaml:"per_ip"`
+	MaxBodyLen uint32 `yaml:"max_body_len"`
+	// open http polling sessions, 0 means server.DefaultMaxPollSessions and -1 unlimited
+	MaxPollSessions int              `yaml:"max_poll_sessions"`
+	SendQueue       SendQueueConfig  `yaml:"send_queue"`
+	Users           UserLimitsConfig `yaml:"users"`
+}
+
+type SendQueueConfig struct {
+	Size int `yaml:"size"`
+	// block, drop-newest, drop-oldest or disconnect
+	Overflow     string        `yaml:"overflow"`
+	BlockTimeout time.Duration `yaml:"block_timeout"`
+}
+
+type UserRateConfig struct {
+	Messages RateConfig `yaml:"messages"`
+	Bytes    RateConfig `yaml:"bytes"`
+}
+
+type UserLimitsConfig struct {
+	Default UserRateConfig `yaml:"default"`
+	// overrides by user role
+	Roles map[string]UserRateConfig `yaml:"roles"`
+	// reject or disconnect
+	Action string `yaml:"action"`
+}
+
+type LogConfig struct {
+	// debug, info, warn or error
+	Level string `yaml:"level"`
+	// text or json
+	Format string `yaml:"format"`
+}
+
+type AdminConfig struct {
+	// address of the admin api and /metrics, empty disables them
+	Listen string `yaml:"listen"`
+	// keys of operators, by name
+	Keys map[string]string `yaml:"keys"`
+}
+
+type AuditConfig struct {
+	// json lines trail of handshakes and administrative actions, empty disables it
+	File       string `yaml:"file"`
+	MaxSizeMB  int64  `yaml:"max_size_mb"`
+	MaxBackups int    `yaml:"max_backups"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Listeners: []ListenerConfig{{Addr: ":8080"}},
+		Auth: AuthConfig{
+			PublicKey:  "public.pem",
+			PrivateKey: "private.pem",
+		},
+		Timeouts: TimeoutsConfig{Heartbeat: time.Duration(server.DefaultTimeoutSec) * time.Second},
+		Limits: LimitsConfig{
+			SendQueue: SendQueueConfig{Overflow: server.OverflowBlock.String()},
+			Users:     UserLimitsConfig{Action: "reject"},
+		},
+		Log: LogConfig{Level: "info", Format: "text"},
+		Audit: AuditConfig{
+			MaxSizeMB:  audit.DefaultMaxSize >> 20,
+			MaxBackups: audit.DefaultMaxBackups,
+		},
+	}
+}
+
+// LoadConfig reads path over the defaults, unknown keys are errors. an empty path gives the defaults.
+func LoadConfig(path string) (*Config, error) {
+	cfg := defaultConfig()
+	if path == "" {
+		return cfg, nil
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(raw))
+	dec.KnownFields(true)
+	if err := dec.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// configFlags override the config file, each one also reads ROUTE_ and its name in capitals.
+var configFlags = []cli.Flag{
+	&cli.StringFlag{Name: "config", Usage: "yaml configuration file, see config.example.yaml"},
+	&cli.StringSliceFlag{Name: "listen", Usage: "address to serve, repeatable, replaces the listeners of the config file. tcp://, tls://, ws://, wss://, http://, https://, grpc://, grpcs://, udp:// and unix:// are supported"},
+	&cli.StringFlag{Name: "tls-cert", Usage: "certificate file of tls://, wss://, https:// and grpcs:// listeners"},
+	&cli.StringFlag{Name: "tls-key", Usage: "key file of tls://, wss://, https:// and grpcs:// listeners"},
+	&cli.StringFlag{Name: "public-key", Usage: "rsa public key verifying client tokens"},
+	&cli.StringFlag{Name: "private-key", Usage: "rsa private key, generated along with the public key when neither exists"},
+	&cli.StringSliceFlag{Name: "api-key", Usage: "name=key of a backend allowed to use the http and grpc gateways, repeatable"},
+	&cli.DurationFlag{Name: "heartbeat", Usage: "sessions silent for longer are closed"},
+	&cli.DurationFlag{Name: "handshake-timeout", Usage: "time a new connection has to complete the handshake"},
+	&cli.IntFlag{Name: "max-conns", Usage: "live connections over all listeners of one address, 0 means unlimited"},
+	&cli.StringFlag{Name: "admin-listen", Usage: "address of the admin api and prometheus /metrics, keep it private. disabled when empty"},
+	&cli.StringSliceFlag{Name: "admin-key", Usage: "name=key of an operator allowed to use the admin api, repeatable"},
+	&cli.StringFlag{Name: "unix-mode", Usage: "permissions of unix socket files, in octal"},
+	&cli.StringFlag{Name: "log-level", Usage: "debug, info, warn or error"},
+	&cli.StringFlag{Name: "log-format", Usage: "text or json"},
+	&cli.StringFlag{Name: "capture", Usage: "record the packets of every session to this file, see the capture command"},
+	&cli.StringFlag{Name: "audit-file", Usage: "append handshakes, kicks, refusals and group changes to this json lines file"},
+	&cli.Int64Flag{Name: "audit-max-size", Usage: "megabytes the audit file grows to before it is rotated"},
+	&cli.IntFlag{Name: "audit-max-backups", Usage: "rotated audit files kept"},
+}
+
+func init() {
+	for _, f := range configFlags {
+		env := "ROUTE_" + envName(f.Names()[0])
+		switch f := f.(type) {
+		case *cli.StringFlag:
+			f.EnvVars = []string{env}
+		case *cli.StringSliceFlag:
+			f.EnvVars = []string{env}
+		case *cli.DurationFlag:
+			f.EnvVars = []string{env}
+		case *cli.IntFlag:
+			f.EnvVars = []string{env}
+		case *cli.Int64Flag:
+			f.EnvVars = []string{env}
+		}
+	}
+}
+
+func envName(flag string) string {
+	return strings.ToUpper(strings.ReplaceAll(flag, "-", "_"))
+}
+
+// parseKeys reads name=key flag values.
+func parseKeys(flag string, values []string) (map[string]string, error) {
+	ret := make(map[string]string, len(values))
+	for _, kv := range values {
+		name, key, ok := strings.Cut(kv, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid %s %q, want name=key", flag, kv)
+		}
+		ret[name] = key
+	}
+	return ret, nil
+}
+
+// configFromContext loads the config file at path and applies the flags and environment set on c.
+func configFromContext(c *cli.Context, path string) (*Config, error) {
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	if c.IsSet("listen") {
+		cfg.setListeners(c.StringSlice("listen"))
+	}
+	if c.IsSet("unix-mode") {
+		for i := range cfg.Listeners {
+			cfg.Listeners[i].UnixMode = c.String("unix-mode")
+		}
+	}
+	setString := func(flag string, to *string) {
+		if c.IsSet(flag) {
+			*to = c.String(flag)
+		}
+	}
+	setString("tls-cert", &cfg.TLS.Cert)
+	setString("tls-key", &cfg.TLS.Key)
+	setString("public-key", &cfg.Auth.PublicKey)
+	setString("private-key", &cfg.Auth.PrivateKey)
+	setString("admin-listen", &cfg.Admin.Listen)
+	setString("log-level", &cfg.Log.Level)
+	setString("log-format", &cfg.Log.Format)
+	setString("capture", &cfg.Capture)
+	setString("audit-file", &cfg.Audit.File)
+	if c.IsSet("api-key") {
+		if cfg.Auth.APIKeys, err = parseKeys("api-key", c.StringSlice("api-key")); err != nil {
+			return nil, err
+		}
+	}
+	if c.IsSet("admin-key") {
+		if cfg.Admin.Keys, err = parseKeys("admin-key", c.StringSlice("admin-key")); err != nil {
+			return nil, err
+		}
+	}
+	if c.IsSet("heartbeat") {
+		cfg.Timeouts.Heartbeat = c.Duration("heartbeat")
+	}
+	if c.IsSet("handshake-timeout") {
+		cfg.Timeouts.Handshake = c.Duration("handshake-timeout")
+	}
+	if c.IsSet("max-conns") {
+		cfg.Limits.MaxConns = c.Int("max-conns")
+	}
+	if c.IsSet("audit-max-size") {
+		cfg.Audit.MaxSizeMB = c.Int64("audit-max-size")
+	}
+	if c.IsSet("audit-max-backups") {
+		cfg.Audit.MaxBackups = c.Int("audit-max-backups")
+	}
+	return cfg, nil
+}
+
+// setListeners replaces the listeners with plain ones serving addrs.
+func (cfg *Config) setListeners(addrs []string) {
+	cfg.Listeners = make([]ListenerConfig, 0, len(addrs))
+	for _, addr := range addrs {
+		cfg.Listeners = append(cfg.Listeners, ListenerConfig{Addr: addr})
+	}
+}
+
+// parseOverflow reads a send queue overflow policy, empty is block.
+func parseOverflow(name string) (server.OverflowPolicy, error) {
+	if name == "" {
+		return server.OverflowBlock, nil
+	}
+	for p := server.OverflowBlock; p <= server.OverflowDisconnect; p++ {
+		if p.String() == name {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid send queue overflow %q, want block, drop-newest, drop-oldest or disconnect", name)
+}
+
+// parseLimitAction reads a users limit action, empty is reject.
+func parseLimitAction(name string) (handle.LimitAction, error) {
+	switch name {
+	case "", "reject":
+		return handle.LimitReject, nil
+	case "disconnect":
+		return handle.LimitDisconnect, nil
+	}
+	return 0, fmt.Errorf("invalid users limit action %q, want reject or disconnect", name)
+}
+
+func (l *ListenerConfig) unixMode() (os.FileMode, error) {
+	if l.UnixMode == "" {
+		return 0660, nil
+	}
+	mode, err := strconv.ParseUint(l.UnixMode, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("listener %s: invalid unix_mode %q", l.Addr, l.UnixMode)
+	}
+	return os.FileMode(mode), nil
+}
+
+// tlsFiles returns the certificate of the listener, the default one when it has none.
+func (cfg *Config) tlsFiles(l *ListenerConfig) TLSFiles {
+	if l.TLS.Cert != "" {
+		return l.TLS
+	}
+	return cfg.TLS
+}
+
+// listenerLimits returns the limits of the listener, the top level ones when it has none or l is nil.
+func (cfg *Config) listenerLimits(l *ListenerConfig) *LimitsConfig {
+	if l != nil && l.Limits != nil {
+		return l.Limits
+	}
+	return &cfg.Limits
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// Validate reports every problem of the config at once.
+func (cfg *Config) Validate() error {
+	var errs []error
+	if len(cfg.Listeners) == 0 {
+		errs = append(errs, errors.New("no listeners"))
+	}
+	for i := range cfg.Listeners {
+		l := &cfg.Listeners[i]
+		needTLS, err := server.CheckListenAddr(l.Addr)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if files := cfg.tlsFiles(l); needTLS && (files.Cert == "" || files.Key == "") {
+			errs = append(errs, fmt.Errorf("listener %s: requires a tls cert and key", l.Addr))
+		}
+		if _, err := l.unixMode(); err != nil {
+			errs = append(errs, err)
+		}
+		if _, err := server.ParseIPNetList(l.ProxyProtocol.Trusted); err != nil {
+			errs = append(errs, fmt.Errorf("listener %s: proxy_protocol: %w", l.Addr, err))
+		}
+		if (len(l.ProxyProtocol.Trusted) > 0 || l.ProxyProtocol.Required) && !server.ProxyProtocolSupported(l.Addr) {
+			errs = append(errs, fmt.Errorf("listener %s: proxy_protocol is only supported on tcp, tls and unix listeners", l.Addr))
+		}
+		if l.Auth != nil {
+			for _, err := range l.Auth.validate() {
+				errs = append(errs, fmt.Errorf("listener %s: %w", l.Addr, err))
+			}
+		}
+		if l.Limits != nil {
+			for _, err := range l.Limits.validate() {
+				errs = append(errs, fmt.Errorf("listener %s: %w", l.Addr, err))
+			}
+		}
+	}
+	errs = append(errs, cfg.Auth.validate()...)
+	if hb := cfg.Timeouts.Heartbeat; hb != 0 && hb < time.Duration(server.DefaultMinTimeoutSec)*time.Second {
+		errs = append(errs, fmt.Errorf("timeouts: heartbeat %v is below the minimum of %ds", hb, server.DefaultMinTimeoutSec))
+	}
+	if cfg.Timeouts.Handshake < 0 {
+		errs = append(errs, errors.New("timeouts: negative handshake timeout"))
+	}
+	errs = append(errs, cfg.Limits.validate()...)
+	if _, err := parseLogLevel(cfg.Log.Level); err != nil {
+		errs = append(errs, fmt.Errorf("log: %w", err))
+	}
+	if _, err := newLogger(slog.LevelInfo, cfg.Log.Format); err != nil {
+		errs = append(errs, fmt.Errorf("log: %w", err))
+	}
+	if cfg.Admin.Listen != "" && len(cfg.Admin.Keys) == 0 {
+		errs = append(errs, errors.New("admin: listen is set without keys, every call would be refused"))
+	}
+	for name, key := range cfg.Admin.Keys {
+		if key == "" {
+			errs = append(errs, fmt.Errorf("admin: key %s is empty", name))
+		}
+	}
+	if cfg.Audit.MaxSizeMB < 0 || cfg.Audit.MaxBackups < 0 {
+		errs = append(errs, errors.New("audit: negative rotation limits"))
+	}
+	return errors.Join(errs...)
+}
+
+func (a *AuthConfig) validate() []error {
+	var errs []error
+	if a.PublicKey == "" || a.PrivateKey == "" {
+		errs = append(errs, errors.New("auth: public_key and private_key are required"))
+	} else if fileExists(a.PublicKey) != fileExists(a.PrivateKey) {
+		// a lone key would be overwritten or fail at start, both are generated only when neither exists
+		errs = append(errs, fmt.Errorf("auth: only one of %s and %s exists", a.PublicKey, a.PrivateKey))
+	}
+	for name, key := range a.APIKeys {
+		if key == "" {
+			errs = append(errs, fmt.Errorf("auth: api key %s is empty", name))
+		}
+	}
+	return errs
+}
+
+func (limits *LimitsConfig) validate() []error {
+	var errs []error
+	if _, err := server.ParseIPNetList(limits.Allow); err != nil {
+		errs = append(errs, fmt.Errorf("limits: allow: %w", err))
+	}
+	if _, err := server.ParseIPNetList(limits.Deny); err != nil {
+		errs = append(errs, fmt.Errorf("limits: deny: %w", err))
+	}
+	if limits.MaxBodyLen > server.MaxPacketBodyLen {
+		errs = append(errs, fmt.Errorf("limits: max_body_len is above %d", server.MaxPacketBodyLen))
+	}
+	if _, err := parseOverflow(limits.SendQueue.Overflow); err != nil {
+		errs = append(errs, fmt.Errorf("limits: %w", err))
+	}
+	if _, err := parseLimitAction(limits.Users.Action); err != nil {
+		errs = append(errs, fmt.Errorf("limits: %w", err))
+	}
+	return errs
+}
+
+// serverOptions returns the settings of listener l, the top level ones when l is nil.
+// handlers and auth are left to StartServer.
+func (cfg *Config) serverOptions(l *ListenerConfig) server.TcpServerOptions {
+	limits := cfg.listenerLimits(l)
+	overflow, _ := parseOverflow(limits.SendQueue.Overflow)
+	return server.TcpServerOptions{
+		HeatbeatInterval: cfg.Timeouts.Heartbeat,
+		HandshakeTimeout: cfg.Timeouts.Handshake,
+		MaxBodyLen:       limits.MaxBodyLen,
+		MaxPollSessions:  limits.MaxPollSessions,
+		SendQueue: server.SendQueueOptions{
+			Size:         limits.SendQueue.Size,
+			Overflow:     overflow,
+			BlockTimeout: limits.SendQueue.BlockTimeout,
+		},
+		IPLimit: server.IPLimitOptions{
+			ConnRate: limits.PerIP.ConnRate.limit(),
+			MaxConns: limits.PerIP.MaxConns,
+		},
+		Admission: server.AdmissionOptions{
+			MaxConns:      limits.MaxConns,
+			MaxHandshakes: limits.MaxHandshakes,
+			AcceptRate:    limits.AcceptRate.limit(),
+			Allow:         limits.Allow,
+			Deny:          limits.Deny,
+		},
+	}
+}
+
+// rateLimits returns the per user limits, nil when none is set.
+func (limits *LimitsConfig) rateLimits() *handle.RateLimitOptions {
+	users := limits.Users
+	if users.Default == (UserRateConfig{}) && len(users.Roles) == 0 {
+		return nil
+	}
+	toLimits := func(u UserRateConfig) handle.UserRateLimits {
+		return handle.UserRateLimits{Messages: u.Messages.limit(), Bytes: u.Bytes.limit()}
+	}
+	action, _ := parseLimitAction(users.Action)
+	ret := &handle.RateLimitOptions{Default: toLimits(users.Default), Action: action}
+	if len(users.Roles) > 0 {
+		ret.Roles = make(map[string]handle.UserRateLimits, len(users.Roles))
+		for role, u := range users.Roles {
+			ret.Roles[role] = toLimits(u)
+		}
+	}
+	return ret
+}
+
+func (cfg *Config) auditOptions() audit.FileOptions {
+	return audit.FileOptions{
+		Path:       cfg.Audit.File,
+		MaxSize:    cfg.Audit.MaxSizeMB << 20,
+		MaxBackups: cfg.Audit.MaxBackups,
+	}
+}
+
+var configCommand = &cli.Command{
+	Name:  "config",
+	Usage: "work with configuration files",
+	Subcommands: []*cli.Command{
+		{
+			Name:      "check",
+			Usage:     "validate the configuration the server would start with, from --config, flags and the environment",
+			ArgsUsage: "[FILE]",
+			Action: func(c *cli.Context) error {
+				if c.Args().Len() > 1 {
+					return errors.New("at most one config file")
+				}
+				path := c.String("config")
+				if c.Args().Len() == 1 {
+					path = c.Args().First()
+				}
+				cfg, err := configFromContext(c, path)
+				if err != nil {
+					return err
+				}
+				if err := cfg.Validate(); err != nil {
+					// a failed check must fail scripts running it
+					return cli.Exit(err, 1)
+				}
+				fmt.Fprintf(c.App.Writer, "config ok, %d listeners\n", len(cfg.Listeners))
+				return nil
+			},
+		},
+	},
+}
+
+func parseLogLevel(level string) (slog.Level, error) {
+	var lv slog.Level
+	if err := lv.UnmarshalText([]byte(level)); err != nil {
+		return 0, fmt.Errorf("invalid log-level %q, want debug, info, warn or error", level)
+	}
+	return lv, nil
+}
+
+// newLogger builds the logger of the process in the log-format, level may be a *slog.LevelVar changed later.
+func newLogger(level slog.Leveler, format string) (*slog.Logger, error) {
+	hopts := &slog.HandlerOptions{Level: level}
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(os.Stderr, hopts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, hopts)), nil
+	}
+	return nil, fmt.Errorf("invalid log-format %q, want text or json", format)
+}
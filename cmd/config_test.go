@@ -0,0 +1,82 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"route/server"
+	"route/utils"
+)
+
+func TestConfig(t *testing.T) {
+	cfg, err := LoadConfig("../config.example.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the example points at key files that need not exist
+	dir := t.TempDir()
+	cfg.Auth.PublicKey, cfg.Auth.PrivateKey = filepath.Join(dir, "public.pem"), filepath.Join(dir, "private.pem")
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	opts := cfg.serverOptions(nil)
+	if opts.HeatbeatInterval != 30*time.Second || opts.SendQueue.Overflow != server.OverflowBlock || opts.IPLimit.MaxConns != 50 {
+		t.Fatalf("unexpected server options %+v", opts)
+	}
+	if limits := cfg.Limits.rateLimits(); limits == nil || limits.Roles["service"].Messages.Rate != 0 || limits.Default.Messages.Rate != 100 {
+		t.Fatalf("unexpected rate limits %+v", limits)
+	}
+	// a listener with limits of its own has none of the top level ones
+	partner := &cfg.Listeners[len(cfg.Listeners)-1]
+	opts = cfg.serverOptions(partner)
+	if opts.Admission.MaxConns != 1000 || opts.IPLimit.MaxConns != 10 || len(opts.Admission.Deny) != 0 || opts.SendQueue.Overflow != server.OverflowBlock {
+		t.Fatalf("unexpected listener options %+v", opts)
+	}
+	if limits := partner.Limits.rateLimits(); limits.Default.Messages.Rate != 10 || len(limits.Roles) != 0 {
+		t.Fatalf("unexpected listener rate limits %+v", limits)
+	}
+
+	path := filepath.Join(dir, "route.yaml")
+	os.WriteFile(path, []byte("listeners:\n  - addr: wss://:1\n  - addr: tcp://:2\n    auth: {public_key: a.pem}\n    limits: {deny: [bad]}\nlog: {format: xml}\ntimeouts: {heartbeat: 1s}\n"), 0600)
+	cfg, err = LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Auth.PublicKey = filepath.Join(dir, "public.pem")
+	cfg.Auth.PrivateKey = path
+	err = cfg.Validate()
+	for _, want := range []string{"requires a tls cert", "log-format", "heartbeat", "only one of", "listener tcp://:2: auth: public_key and private_key", "listener tcp://:2: limits: deny"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Fatalf("%q not reported in %v", want, err)
+		}
+	}
+
+	os.WriteFile(path, []byte("listener: []\n"), 0600)
+	if _, err := LoadConfig(path); err == nil {
+		t.Fatal("unknown key accepted")
+	}
+}
+
+func TestAuthKey(t *testing.T) {
+	dir := t.TempDir()
+	private, public := filepath.Join(dir, "private.pem"), filepath.Join(dir, "public.pem")
+	if _, pu, err := LoadAuthKey(private, public); err != nil || pu.N.BitLen() < MinRSAKeyBits {
+		t.Fatalf("generated key %v", err)
+	}
+	if st, err := os.Stat(private); err != nil || st.Mode().Perm() != 0600 {
+		t.Fatalf("private key mode %v %v", st.Mode(), err)
+	}
+
+	rawpr, rawpu, err := utils.GenerateRsaPem(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(private, rawpr, 0600)
+	os.WriteFile(public, rawpu, 0644)
+	if _, _, err := LoadAuthKey(private, public); err == nil || !strings.Contains(err.Error(), "too short") {
+		t.Fatalf("short key accepted: %v", err)
+	}
+}
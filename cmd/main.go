@@ -3,13 +3,18 @@ package main
 import (
 	"bytes"
 	"crypto/rsa"
+	"crypto/tls"
 	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
 	"os"
 	"runtime"
 	"syscall"
 
-	"route/auth"
+	"route/audit"
 	"route/handle"
+	"route/metrics"
 	"route/server"
 	"route/utils"
 
@@ -18,29 +23,54 @@ import (
 	"github.com/urfave/cli/v2"
 )
 
-const PrivateKeyFile = "private.pem"
-const PublicKeyFile = "public.pem"
+// MinRSAKeyBits is the smallest token key accepted, generated keys have this size.
+const MinRSAKeyBits = 2048
 
-func ReadRSAKey() ([]byte, []byte, error) {
-	privateRaw, err := os.ReadFile(PrivateKeyFile)
-	if err != nil {
-		privateKey, publicKey, err := utils.GenerateRsaPem(512)
+// ReadRSAKey reads the pem keys, both are generated first when neither file exists.
+func ReadRSAKey(privateFile, publicFile string) ([]byte, []byte, error) {
+	return readRSAKey(privateFile, publicFile, true)
+}
+
+func readRSAKey(privateFile, publicFile string, generate bool) ([]byte, []byte, error) {
+	privateRaw, err := os.ReadFile(privateFile)
+	if os.IsNotExist(err) && generate {
+		if _, err := os.Stat(publicFile); err == nil {
+			return nil, nil, fmt.Errorf("%s is missing while %s exists", privateFile, publicFile)
+		}
+		privateKey, publicKey, err := utils.GenerateRsaPem(MinRSAKeyBits)
 		if err != nil {
 			return nil, nil, err
 		}
 		privateRaw = []byte(privateKey)
-		os.WriteFile(PrivateKeyFile, []byte(privateKey), 0644)
-		os.WriteFile(PublicKeyFile, []byte(publicKey), 0644)
+		if err := os.WriteFile(privateFile, []byte(privateKey), 0600); err != nil {
+			return nil, nil, err
+		}
+		if err := os.WriteFile(publicFile, []byte(publicKey), 0644); err != nil {
+			return nil, nil, err
+		}
+	} else if err != nil {
+		return nil, nil, err
 	}
-	publicRaw, err := os.ReadFile(PublicKeyFile)
+	publicRaw, err := os.ReadFile(publicFile)
 	if err != nil {
 		return nil, nil, err
 	}
 	return privateRaw, publicRaw, nil
 }
 
-func LoadAuthKey() (*rsa.PrivateKey, *rsa.PublicKey, error) {
-	rawpr, rawpu, err := ReadRSAKey()
+// LoadAuthKey reads the token keys, refusing keys shorter than MinRSAKeyBits.
+func LoadAuthKey(privateFile, publicFile string) (*rsa.PrivateKey, *rsa.PublicKey, error) {
+	return loadAuthKey(privateFile, publicFile, true)
+}
+
+// ReloadAuthKey is LoadAuthKey for a running server, missing files are an error instead of
+// new keys that would refuse every token issued until then.
+func ReloadAuthKey(privateFile, publicFile string) (*rsa.PrivateKey, *rsa.PublicKey, error) {
+	return loadAuthKey(privateFile, publicFile, false)
+}
+
+func loadAuthKey(privateFile, publicFile string, generate bool) (*rsa.PrivateKey, *rsa.PublicKey, error) {
+	rawpr, rawpu, err := readRSAKey(privateFile, publicFile, generate)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -52,53 +82,172 @@ func LoadAuthKey() (*rsa.PrivateKey, *rsa.PublicKey, error) {
 	if err != nil {
 		return nil, nil, err
 	}
+	if bits := pu.N.BitLen(); bits < MinRSAKeyBits {
+		return nil, nil, fmt.Errorf("%s: %d bit key is too short, at least %d bits are required", publicFile, bits, MinRSAKeyBits)
+	}
+	if bits := pr.N.BitLen(); bits < MinRSAKeyBits {
+		return nil, nil, fmt.Errorf("%s: %d bit key is too short, at least %d bits are required", privateFile, bits, MinRSAKeyBits)
+	}
 	return pr, pu, nil
 }
 
-func WaitShutdown() os.Signal {
+// WaitShutdown returns the signal stopping the process, calling reload for every SIGHUP until then.
+func WaitShutdown(reload func()) os.Signal {
 	signals := make(chan os.Signal, 1)
-	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT)
-	return <-signals
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGQUIT, syscall.SIGHUP)
+	for sig := range signals {
+		if sig != syscall.SIGHUP {
+			return sig
+		}
+		reload()
+	}
+	return nil
 }
 
-func StartServer(listenAt string) {
-	var err error
-	_, publicKey, err := LoadAuthKey()
+// StartServer serves every listener of cfg until a signal stops the process, see startInstance.
+func StartServer(cfg *Config, load func() (*Config, error)) error {
+	inst, stop, err := startInstance(cfg, load)
 	if err != nil {
-		panic(err)
+		return err
 	}
+	defer stop()
+	WaitShutdown(func() {
+		inst.reload(ActorSignal)
+	})
+	return nil
+}
 
-	h, err := handle.NewRouter()
+// startInstance serves every listener of cfg, all sessions are handled by one router.
+// listeners with auth or limits of their own use them instead of the top level ones.
+// cfg must have passed Validate. load reads the configuration again on SIGHUP and POST /reload
+// of the admin api, see instance.reload. stop closes what was started, on error nothing is left running.
+func startInstance(cfg *Config, load func() (*Config, error)) (inst *instance, stop func(), err error) {
+	var closers []func()
+	stop = func() {
+		for i := len(closers) - 1; i >= 0; i-- {
+			closers[i]()
+		}
+	}
+	defer func() {
+		if err != nil {
+			stop()
+		}
+	}()
+
+	level, _ := parseLogLevel(cfg.Log.Level)
+	inst = &instance{load: load, cfg: cfg, logLevel: new(slog.LevelVar)}
+	inst.logLevel.Set(level)
+	logger, err := newLogger(inst.logLevel, cfg.Log.Format)
 	if err != nil {
-		panic(err)
+		return nil, nil, err
 	}
+	slog.SetDefault(logger)
+	inst.logger = logger
 
-	svropt := server.TcpServerOptions{
-		AuthFunc: func(b []byte) (*server.UserInfo, error) {
-			info, err := auth.VerifyToken(publicKey, string(b))
-			if err != nil {
-				return nil, err
-			}
-			return &server.UserInfo{
-				UId: info.UId,
-			}, nil
-		},
-		ListenAddr:      listenAt,
-		OnSessionPacket: h.OnSessionMessage,
-		OnSessionStatus: h.OnSessionStatus,
+	_, publicKey, err := LoadAuthKey(cfg.Auth.PrivateKey, cfg.Auth.PublicKey)
+	if err != nil {
+		return nil, nil, err
 	}
+	inst.publicKey.Store(publicKey)
 
-	svr, err := server.NewTcpServer(svropt)
+	h, err := handle.NewRouter()
 	if err != nil {
-		panic(err)
+		return nil, nil, err
 	}
+	h.Logger = logger
+	if limits := cfg.Limits.rateLimits(); limits != nil {
+		h.SetRateLimits(limits)
+	}
+	if cfg.Audit.File != "" {
+		trail, err := audit.OpenFile(cfg.auditOptions())
+		if err != nil {
+			return nil, nil, err
+		}
+		closers = append(closers, func() { trail.Close() })
+		h.Audit = trail
+	}
+	inst.router = h
+
+	inst.gateway = handle.NewGateway(h, gatewayOptions(&inst.publicKey, &cfg.Auth))
+	inst.grpc = handle.NewGrpcService(h, gatewayOptions(&inst.publicKey, &cfg.Auth))
+
+	var capture *server.Capture
+	if cfg.Capture != "" {
+		if capture, err = server.CreateCapture(cfg.Capture); err != nil {
+			return nil, nil, err
+		}
+		closers = append(closers, func() { capture.Close() })
+		logger.Warn("capturing packets of every session", "file", cfg.Capture)
+	}
+
+	for i := range cfg.Listeners {
+		l := &cfg.Listeners[i]
+		run, err := inst.newListener(l)
+		if err != nil {
+			return nil, nil, err
+		}
+		verify := verifier(run.publicKey)
+		svropt := cfg.serverOptions(l)
+		svropt.AuthFunc = func(b []byte) (*server.UserInfo, error) {
+			return verify(string(b))
+		}
+		svropt.ListenAddr = l.Addr
+		if needTLS, _ := server.CheckListenAddr(l.Addr); needTLS {
+			files := cfg.tlsFiles(l)
+			cert, err := tls.LoadX509KeyPair(files.Cert, files.Key)
+			if err != nil {
+				return nil, nil, fmt.Errorf("listener %s: %w", l.Addr, err)
+			}
+			svropt.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		}
+		mode, _ := l.unixMode()
+		svropt.Unix = server.UnixSocketOptions{Mode: mode}
+		svropt.ProxyProtocol = server.ProxyProtocolOptions{
+			TrustedSources: l.ProxyProtocol.Trusted,
+			Required:       l.ProxyProtocol.Required,
+		}
+		svropt.HTTPHandler = run.gateway
+		svropt.GrpcService = run.grpc
+		svropt.OnSessionPacket = h.OnSessionMessage
+		svropt.OnSessionStatus = h.OnSessionStatus
+		svropt.OnSessionError = h.OnSessionError
+		if l.Limits != nil {
+			svropt.OnSessionStatus = h.OnSessionStatusLimited(l.Limits.rateLimits())
+		}
+		svropt.PoolBuffers = true
+		svropt.Logger = logger
+		svropt.Capture = capture
+		svropt.Audit = h.Audit
 
-	defer svr.Stop()
+		svr, err := server.NewTcpServer(svropt)
+		if err != nil {
+			return nil, nil, fmt.Errorf("listener %s: %w", l.Addr, err)
+		}
+		closers = append(closers, func() { svr.Stop() })
 
-	fmt.Println("server started,listening on ", listenAt)
-	svr.Start()
+		logger.Info("server started", "listen", l.Addr)
+		svr.Start()
+		run.listener = svr
+		inst.listeners = append(inst.listeners, run)
+	}
 
-	WaitShutdown()
+	if cfg.Admin.Listen != "" {
+		ln, err := net.Listen("tcp", cfg.Admin.Listen)
+		if err != nil {
+			return nil, nil, err
+		}
+		inst.admin = handle.NewAdmin(h, inst.adminOptions(cfg))
+		// metrics are scraped without the admin keys, the listener is meant to be private
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics.Handler())
+		mux.Handle("/", inst.admin)
+		adminSvr := &http.Server{Handler: mux}
+		closers = append(closers, func() { adminSvr.Close() })
+
+		logger.Info("admin api started", "listen", cfg.Admin.Listen)
+		go adminSvr.Serve(ln)
+	}
+	return inst, stop, nil
 }
 
 var (
@@ -122,12 +271,28 @@ func longVersion() string {
 }
 
 func RealMain(c *cli.Context) error {
-	listenAt := ":8080"
-	if c.Args().Len() == 2 {
-		listenAt = c.Args().Get(1)
+	if c.Args().Len() > 1 {
+		return fmt.Errorf("at most one listen address argument, got %d", c.Args().Len())
 	}
-	StartServer(listenAt)
-	return nil
+	load := func() (*Config, error) {
+		cfg, err := configFromContext(c, c.String("config"))
+		if err != nil {
+			return nil, err
+		}
+		// a lone argument is the listen address, as before config files
+		if c.Args().Len() == 1 {
+			cfg.setListeners([]string{c.Args().First()})
+		}
+		return cfg, nil
+	}
+	cfg, err := load()
+	if err != nil {
+		return err
+	}
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	return StartServer(cfg, load)
 }
 
 func main() {
@@ -138,6 +303,8 @@ func main() {
 	app.Version = Version
 	app.Name = Name
 	app.Action = RealMain
+	app.Flags = configFlags
+	app.Commands = []*cli.Command{captureCommand, configCommand}
 	err := app.Run(os.Args)
 	if err != nil {
 		fmt.Println(err)
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self signed certificate and its key into dir.
+func writeTestCert(t *testing.T, dir string) TLSFiles {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawKey, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := TLSFiles{Cert: filepath.Join(dir, "server.crt"), Key: filepath.Join(dir, "server.key")}
+	os.WriteFile(files.Cert, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	os.WriteFile(files.Key, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: rawKey}), 0600)
+	return files
+}
+
+func TestStartExample(t *testing.T) {
+	cfg, err := LoadConfig("../config.example.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the example as shipped, with its files and ports moved somewhere the test may use
+	dir := t.TempDir()
+	port := regexp.MustCompile(`://:\d+`)
+	for i := range cfg.Listeners {
+		l := &cfg.Listeners[i]
+		if strings.HasPrefix(l.Addr, "unix://") {
+			l.Addr = "unix://" + filepath.Join(dir, "route.sock")
+		}
+		l.Addr = port.ReplaceAllString(l.Addr, "://127.0.0.1:0")
+		if l.TLS.Cert != "" {
+			l.TLS = writeTestCert(t, dir)
+		}
+		if l.Auth != nil {
+			l.Auth.PublicKey, l.Auth.PrivateKey = filepath.Join(dir, "l-public.pem"), filepath.Join(dir, "l-private.pem")
+		}
+	}
+	cfg.TLS = writeTestCert(t, dir)
+	cfg.Auth.PublicKey, cfg.Auth.PrivateKey = filepath.Join(dir, "public.pem"), filepath.Join(dir, "private.pem")
+	cfg.Admin.Listen = "127.0.0.1:0"
+	cfg.Audit.File = filepath.Join(dir, "audit.log")
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	inst, stop, err := startInstance(cfg, func() (*Config, error) { return cfg, nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stop()
+	if len(inst.listeners) != len(cfg.Listeners) {
+		t.Fatalf("%d of %d listeners started", len(inst.listeners), len(cfg.Listeners))
+	}
+
+	// what the server would refuse at start is refused by the check
+	cfg.Listeners = append(cfg.Listeners, ListenerConfig{Addr: "grpc://127.0.0.1:0"})
+	cfg.Listeners[len(cfg.Listeners)-1].ProxyProtocol.Trusted = []string{"10.0.0.0/8"}
+	if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "proxy_protocol") {
+		t.Fatalf("proxy protocol on grpc accepted: %v", err)
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"route/audit"
+	"route/auth"
+	"route/handle"
+	"route/server"
+)
+
+// ActorSignal is the audit actor of reloads asked for by SIGHUP.
+const ActorSignal = "signal"
+
+// listener is what a reload changes on a running server.
+type listener interface {
+	SetAdmission(server.AdmissionOptions) error
+	SetIPLimit(server.IPLimitOptions)
+}
+
+// instance is the running server, reload swaps its settings without closing sessions.
+type instance struct {
+	// reads the configuration again, with the flags and environment of the command line
+	load func() (*Config, error)
+
+	mu  sync.Mutex
+	cfg *Config
+
+	logLevel  *slog.LevelVar
+	logger    *slog.Logger
+	publicKey atomic.Pointer[rsa.PublicKey]
+	router    *handle.Router
+	gateway   *handle.Gateway
+	grpc      *handle.GrpcService
+	admin     *handle.Admin
+	listeners []*runningListener
+}
+
+// runningListener is a started listener with the token key and gateways of its sessions,
+// those of the instance unless it has auth of its own.
+type runningListener struct {
+	listener
+	publicKey *atomic.Pointer[rsa.PublicKey]
+	gateway   *handle.Gateway
+	grpc      *handle.GrpcService
+}
+
+// ReloadReport tells the settings a reload applied and the changed ones still waiting for a restart,
+// by their path in the config file.
+type ReloadReport struct {
+	Changed []string `json:"changed"`
+	Restart []string `json:"restart"`
+}
+
+// verifier checks tokens with the key currently in publicKey.
+func verifier(publicKey *atomic.Pointer[rsa.PublicKey]) func(string) (*server.UserInfo, error) {
+	return func(token string) (*server.UserInfo, error) {
+		info, err := auth.VerifyToken(publicKey.Load(), token)
+		if err != nil {
+			return nil, err
+		}
+		return &server.UserInfo{
+			UId:   info.UId,
+			URole: info.URole,
+			UName: info.UName,
+		}, nil
+	}
+}
+
+func gatewayOptions(publicKey *atomic.Pointer[rsa.PublicKey], a *AuthConfig) handle.GatewayOptions {
+	return handle.GatewayOptions{
+		TokenAuth:    verifier(publicKey),
+		APIKeys:      a.APIKeys,
+		TrustedRoles: a.TrustedRoles,
+	}
+}
+
+// newListener returns the auth of sessions of l, the listener itself is set once started.
+func (i *instance) newListener(l *ListenerConfig) (*runningListener, error) {
+	if l.Auth == nil {
+		return &runningListener{publicKey: &i.publicKey, gateway: i.gateway, grpc: i.grpc}, nil
+	}
+	_, publicKey, err := LoadAuthKey(l.Auth.PrivateKey, l.Auth.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("listener %s: %w", l.Addr, err)
+	}
+	ret := &runningListener{publicKey: new(atomic.Pointer[rsa.PublicKey])}
+	ret.publicKey.Store(publicKey)
+	ret.gateway = handle.NewGateway(i.router, gatewayOptions(ret.publicKey, l.Auth))
+	ret.grpc = handle.NewGrpcService(i.router, gatewayOptions(ret.publicKey, l.Auth))
+	return ret, nil
+}
+
+func (i *instance) adminOptions(cfg *Config) handle.AdminOptions {
+	return handle.AdminOptions{
+		Keys: cfg.Admin.Keys,
+		Reload: func(operator string) (any, error) {
+			return i.reload(operator)
+		},
+	}
+}
+
+// reload re-reads the configuration and applies what can change on a running server:
+// auth keys, api and admin keys, trusted roles, limits other than send_queue, max_body_len and max_poll_sessions, and the log level.
+// the auth and limits of a listener wait for a restart like the rest of it, only its key files are read again.
+// sessions stay connected, tokens are only verified at handshake. nothing is applied when the
+// configuration is invalid or a key file is missing, keys are only generated at start.
+func (i *instance) reload(actor string) (*ReloadReport, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	ret, err := i.apply()
+	e := audit.Event{Time: time.Now(), Action: audit.ActionReload, Actor: actor, Result: audit.ResultSuccess}
+	if err != nil {
+		e.Result, e.Reason = audit.ResultFailure, err.Error()
+		i.logger.Error("config reload failed", "actor", actor, "err", err)
+	} else {
+		e.Reason = fmt.Sprintf("changed [%s] restart [%s]", strings.Join(ret.Changed, " "), strings.Join(ret.Restart, " "))
+		i.logger.Info("config reloaded", "actor", actor, "changed", ret.Changed, "restart", ret.Restart)
+	}
+	i.router.Audit.Record(e)
+	return ret, err
+}
+
+func (i *instance) apply() (*ReloadReport, error) {
+	cfg, err := i.load()
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	old := i.cfg
+	ret := &ReloadReport{Changed: []string{}, Restart: []string{}}
+
+	// the rest is only read at start, the running values are kept so they are reported until then.
+	// the auth and limits of a listener are part of it
+	restart := []struct {
+		name         string
+		running, now any
+	}{
+		{"listeners", &old.Listeners, &cfg.Listeners},
+		{"tls", &old.TLS, &cfg.TLS},
+		{"timeouts", &old.Timeouts, &cfg.Timeouts},
+		{"limits.max_body_len", &old.Limits.MaxBodyLen, &cfg.Limits.MaxBodyLen},
+		{"limits.max_poll_sessions", &old.Limits.MaxPollSessions, &cfg.Limits.MaxPollSessions},
+		{"limits.send_queue", &old.Limits.SendQueue, &cfg.Limits.SendQueue},
+		{"log.format", &old.Log.Format, &cfg.Log.Format},
+		{"admin.listen", &old.Admin.Listen, &cfg.Admin.Listen},
+		{"audit", &old.Audit, &cfg.Audit},
+		{"capture", &old.Capture, &cfg.Capture},
+	}
+	for _, r := range restart {
+		if !reflect.DeepEqual(r.running, r.now) {
+			ret.Restart = append(ret.Restart, r.name)
+			reflect.ValueOf(r.now).Elem().Set(reflect.ValueOf(r.running).Elem())
+		}
+	}
+
+	// files are read again even when their paths are the same, keys are rotated in place
+	type keyUpdate struct {
+		name string
+		to   *atomic.Pointer[rsa.PublicKey]
+		key  *rsa.PublicKey
+	}
+	_, publicKey, err := ReloadAuthKey(cfg.Auth.PrivateKey, cfg.Auth.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	keys := []keyUpdate{{"auth.public_key", &i.publicKey, publicKey}}
+	for j, run := range i.listeners {
+		if l := &cfg.Listeners[j]; l.Auth != nil {
+			_, publicKey, err := ReloadAuthKey(l.Auth.PrivateKey, l.Auth.PublicKey)
+			if err != nil {
+				return nil, fmt.Errorf("listener %s: %w", l.Addr, err)
+			}
+			keys = append(keys, keyUpdate{fmt.Sprintf("listeners[%d].auth.public_key", j), run.publicKey, publicKey})
+		}
+	}
+	oldOpts, opts := old.serverOptions(nil), cfg.serverOptions(nil)
+	if err := opts.Admission.Validate(); err != nil {
+		return nil, err
+	}
+
+	// nothing is changed above, everything below is checked already
+	for _, k := range keys {
+		if !k.key.Equal(k.to.Load()) {
+			k.to.Store(k.key)
+			ret.Changed = append(ret.Changed, k.name)
+		}
+	}
+	gateway := []struct {
+		name    string
+		changed bool
+	}{
+		{"auth.api_keys", !reflect.DeepEqual(old.Auth.APIKeys, cfg.Auth.APIKeys)},
+		{"auth.trusted_roles", !slices.Equal(old.Auth.TrustedRoles, cfg.Auth.TrustedRoles)},
+	}
+	for _, g := range gateway {
+		if g.changed {
+			i.gateway.SetOptions(gatewayOptions(&i.publicKey, &cfg.Auth))
+			i.grpc.SetOptions(gatewayOptions(&i.publicKey, &cfg.Auth))
+			ret.Changed = append(ret.Changed, g.name)
+		}
+	}
+	// without an admin listener the keys are of no use until a restart starts one
+	if !reflect.DeepEqual(old.Admin.Keys, cfg.Admin.Keys) && i.admin != nil {
+		i.admin.SetOptions(i.adminOptions(cfg))
+		ret.Changed = append(ret.Changed, "admin.keys")
+	}
+	if !reflect.DeepEqual(old.Limits.Users, cfg.Limits.Users) {
+		i.router.SetRateLimits(cfg.Limits.rateLimits())
+		ret.Changed = append(ret.Changed, "limits.users")
+	}
+	admission := []struct {
+		name    string
+		changed bool
+	}{
+		{"limits.max_conns", old.Limits.MaxConns != cfg.Limits.MaxConns},
+		{"limits.max_handshakes", old.Limits.MaxHandshakes != cfg.Limits.MaxHandshakes},
+		{"limits.accept_rate", old.Limits.AcceptRate != cfg.Limits.AcceptRate},
+		{"limits.allow", !reflect.DeepEqual(old.Limits.Allow, cfg.Limits.Allow)},
+		{"limits.deny", !reflect.DeepEqual(old.Limits.Deny, cfg.Limits.Deny)},
+	}
+	admissionChanged := false
+	for _, a := range admission {
+		if a.changed {
+			ret.Changed = append(ret.Changed, a.name)
+			admissionChanged = true
+		}
+	}
+	ipLimitChanged := oldOpts.IPLimit != opts.IPLimit
+	if ipLimitChanged {
+		ret.Changed = append(ret.Changed, "limits.per_ip")
+	}
+	// listeners with limits of their own keep them
+	for j, l := range i.listeners {
+		if cfg.Listeners[j].Limits != nil {
+			continue
+		}
+		if admissionChanged {
+			// refuses only what Validate did
+			l.SetAdmission(opts.Admission)
+		}
+		if ipLimitChanged {
+			l.SetIPLimit(opts.IPLimit)
+		}
+	}
+	if old.Log.Level != cfg.Log.Level {
+		level, _ := parseLogLevel(cfg.Log.Level)
+		i.logLevel.Set(level)
+		ret.Changed = append(ret.Changed, "log.level")
+	}
+	i.cfg = cfg
+	return ret, nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"route/handle"
+	"route/server"
+	"route/utils"
+)
+
+type fakeListener struct {
+	admission server.AdmissionOptions
+	ipLimit   server.IPLimitOptions
+}
+
+func (l *fakeListener) SetAdmission(opts server.AdmissionOptions) error {
+	l.admission = opts
+	return nil
+}
+
+func (l *fakeListener) SetIPLimit(opts server.IPLimitOptions) {
+	l.ipLimit = opts
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "route.yaml")
+	write := func(body string) {
+		body += "auth: {public_key: " + filepath.Join(dir, "public.pem") + ", private_key: " + filepath.Join(dir, "private.pem") + "}\n"
+		if err := os.WriteFile(path, []byte(body), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the second listener has its own key and limits, top level changes leave it alone
+	own := "{addr: tcp://:3, auth: {public_key: " + filepath.Join(dir, "own-public.pem") + ", private_key: " + filepath.Join(dir, "own-private.pem") + "}, limits: {max_conns: 5}}"
+	write("listeners: [{addr: tcp://:1}, " + own + "]\n")
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, publicKey, err := LoadAuthKey(cfg.Auth.PrivateKey, cfg.Auth.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := handle.NewRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	inst := &instance{
+		load:     func() (*Config, error) { return LoadConfig(path) },
+		cfg:      cfg,
+		logLevel: new(slog.LevelVar),
+		logger:   slog.Default(),
+		router:   h,
+	}
+	inst.publicKey.Store(publicKey)
+	inst.gateway = handle.NewGateway(h, gatewayOptions(&inst.publicKey, &cfg.Auth))
+	inst.grpc = handle.NewGrpcService(h, gatewayOptions(&inst.publicKey, &cfg.Auth))
+	l, ownl := &fakeListener{}, &fakeListener{}
+	for j, fake := range []*fakeListener{l, ownl} {
+		run, err := inst.newListener(&cfg.Listeners[j])
+		if err != nil {
+			t.Fatal(err)
+		}
+		run.listener = fake
+		inst.listeners = append(inst.listeners, run)
+	}
+	if inst.listeners[0].publicKey != &inst.publicKey || inst.listeners[1].publicKey.Load().Equal(publicKey) {
+		t.Fatalf("listener keys not set apart")
+	}
+
+	write("listeners: [{addr: tcp://:2}, " + own + "]\nlog: {level: debug}\nlimits: {deny: [10.0.0.0/8], per_ip: {max_conns: 3}}\n")
+	report, err := inst.reload("ops")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &ReloadReport{Changed: []string{"limits.deny", "limits.per_ip", "log.level"}, Restart: []string{"listeners"}}
+	if !reflect.DeepEqual(report, want) {
+		t.Fatalf("report %+v", report)
+	}
+	if inst.logLevel.Level() != slog.LevelDebug || len(l.admission.Deny) != 1 || l.ipLimit.MaxConns != 3 {
+		t.Fatalf("not applied %v %+v %+v", inst.logLevel.Level(), l.admission, l.ipLimit)
+	}
+	if len(ownl.admission.Deny) != 0 || ownl.ipLimit.MaxConns != 0 {
+		t.Fatalf("top level limits applied to a listener with its own %+v %+v", ownl.admission, ownl.ipLimit)
+	}
+
+	// a restart is still needed for the listeners, an invalid file changes nothing
+	write("listeners: [{addr: tcp://:2}, " + own + "]\nlog: {level: loud}\n")
+	if _, err := inst.reload("ops"); err == nil || inst.logLevel.Level() != slog.LevelDebug {
+		t.Fatalf("invalid config applied: %v", err)
+	}
+	// a missing key file fails the reload instead of switching to new keys, with nothing applied
+	ownKey := inst.listeners[1].publicKey.Load()
+	os.Remove(filepath.Join(dir, "own-public.pem"))
+	os.Remove(filepath.Join(dir, "own-private.pem"))
+	write("listeners: [{addr: tcp://:2}, " + own + "]\nlog: {level: info}\nlimits: {deny: [10.0.0.0/8], per_ip: {max_conns: 3}}\n")
+	if _, err := inst.reload("ops"); err == nil || inst.logLevel.Level() != slog.LevelDebug || inst.listeners[1].publicKey.Load() != ownKey {
+		t.Fatalf("reload without key files applied: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "own-private.pem")); !os.IsNotExist(err) {
+		t.Fatal("reload generated a key")
+	}
+	// the key of the listener is rotated in place
+	private, public, err := utils.GenerateRsaPem(MinRSAKeyBits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.WriteFile(filepath.Join(dir, "own-private.pem"), []byte(private), 0600)
+	os.WriteFile(filepath.Join(dir, "own-public.pem"), []byte(public), 0644)
+	write("listeners: [{addr: tcp://:2}, " + own + "]\nlog: {level: debug}\nlimits: {deny: [10.0.0.0/8], per_ip: {max_conns: 3}}\n")
+	if report, err = inst.reload("ops"); err != nil || !reflect.DeepEqual(report.Changed, []string{"listeners[1].auth.public_key"}) || !reflect.DeepEqual(report.Restart, []string{"listeners"}) {
+		t.Fatalf("report %+v %v", report, err)
+	}
+}
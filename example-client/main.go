@@ -18,12 +18,12 @@ const PublicKeyFile = "public.pem"
 func ReadRSAKey() ([]byte, []byte, error) {
 	privateRaw, err := os.ReadFile(PrivateKeyFile)
 	if err != nil {
-		privateKey, publicKey, err := utils.GenerateRsaPem(512)
+		privateKey, publicKey, err := utils.GenerateRsaPem(2048)
 		if err != nil {
 			return nil, nil, err
 		}
 		privateRaw = []byte(privateKey)
-		os.WriteFile(PrivateKeyFile, []byte(privateKey), 0644)
+		os.WriteFile(PrivateKeyFile, []byte(privateKey), 0600)
 		os.WriteFile(PublicKeyFile, []byte(publicKey), 0644)
 	}
 	publicRaw, err := os.ReadFile(PublicKeyFile)
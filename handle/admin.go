@@ -0,0 +1,327 @@
+package handle
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"route/audit"
+	"route/server"
+)
+
+type AdminOptions struct {
+	// "Authorization: Bearer" keys of operators, by name. no keys refuses every request,
+	// client jwts and gateway keys are never accepted
+	Keys map[string]string
+	// re-reads the configuration for POST /reload and tells what changed, nil disables it
+	Reload func(operator string) (any, error)
+}
+
+// Admin is the operator api, meant for its own listener away from clients:
+//
+//	GET  /sessions?uid=          connected sessions, of one user when uid is set
+//	GET  /sessions/{id}          one session in detail
+//	POST /sessions/{id}/kick     close the session
+//	POST /users/{uid}/kick       close every session of the user
+//	POST /notice                 send the body to every session as an HVPacketFlagMessage
+//	GET  /groups                 groups and their members
+//	GET  /groups/{name}
+//	POST /reload                 re-read the configuration, see AdminOptions.Reload
+type Admin struct {
+	router *Router
+	opts   atomic.Pointer[AdminOptions]
+}
+
+func NewAdmin(r *Router, opts AdminOptions) *Admin {
+	ret := &Admin{router: r}
+	ret.SetOptions(opts)
+	return ret
+}
+
+// SetOptions replaces the operator keys, requests in flight keep the old ones.
+func (a *Admin) SetOptions(opts AdminOptions) {
+	a.opts.Store(&opts)
+}
+
+type SessionInfo struct {
+	ID          string    `json:"id"`
+	UId         uint32    `json:"uid"`
+	RemoteAddr  string    `json:"remote_addr"`
+	Type        string    `json:"type"`
+	ConnectedAt time.Time `json:"connected_at"`
+	BytesIn     int64     `json:"bytes_in"`
+	BytesOut    int64     `json:"bytes_out"`
+	PacketsIn   int64     `json:"packets_in"`
+	PacketsOut  int64     `json:"packets_out"`
+	QueueLen    int       `json:"queue_len"`
+	Dropped     uint64    `json:"dropped"`
+	RTTMillis   float64   `json:"rtt_ms"`
+}
+
+type SessionDetail struct {
+	SessionInfo
+	LocalAddr       string   `json:"local_addr"`
+	ProtocolVersion uint8    `json:"protocol_version"`
+	Capabilities    string   `json:"capabilities"`
+	Compression     string   `json:"compression"`
+	Groups          []string `json:"groups"`
+}
+
+type GroupMember struct {
+	UId       uint32 `json:"uid"`
+	SessionID string `json:"session_id"`
+}
+
+type GroupInfo struct {
+	Name    string        `json:"name"`
+	Members []GroupMember `json:"members"`
+}
+
+// sessions of the server package have these besides server.Session
+type statsSession interface {
+	Stats() server.SessionStats
+}
+
+type protocolSession interface {
+	ProtocolVersion() uint8
+	Capabilities() server.Capability
+	Compression() server.CompressAlgo
+	LocalAddr() net.Addr
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+func sessionInfo(s server.Session) SessionInfo {
+	ret := SessionInfo{
+		ID:         s.SessionID(),
+		UId:        s.UserID(),
+		RemoteAddr: addrString(s.RemoteAddr()),
+		Type:       s.SessionType(),
+	}
+	if ss, ok := s.(statsSession); ok {
+		st := ss.Stats()
+		ret.ConnectedAt = st.ConnectedAt
+		ret.BytesIn = st.BytesIn
+		ret.BytesOut = st.BytesOut
+		ret.PacketsIn = st.PacketsIn
+		ret.PacketsOut = st.PacketsOut
+		ret.QueueLen = st.QueueLen
+		ret.Dropped = st.Dropped
+		ret.RTTMillis = float64(st.RTT) / float64(time.Millisecond)
+	}
+	return ret
+}
+
+func (a *Admin) sessionDetail(s server.Session) SessionDetail {
+	ret := SessionDetail{
+		SessionInfo: sessionInfo(s),
+		Groups:      a.router.SessionGroups(s),
+	}
+	sort.Strings(ret.Groups)
+	if ps, ok := s.(protocolSession); ok {
+		ret.LocalAddr = addrString(ps.LocalAddr())
+		ret.ProtocolVersion = ps.ProtocolVersion()
+		ret.Capabilities = ps.Capabilities().String()
+		ret.Compression = ps.Compression().String()
+	}
+	return ret
+}
+
+// authenticate returns the name of the operator key of the request, empty when there is none.
+func (a *Admin) authenticate(r *http.Request) string {
+	key, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || key == "" {
+		return ""
+	}
+	for name, v := range a.opts.Load().Keys {
+		if subtle.ConstantTimeCompare([]byte(key), []byte(v)) == 1 {
+			return name
+		}
+	}
+	return ""
+}
+
+func (a *Admin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	operator := a.authenticate(r)
+	if operator == "" {
+		a.router.auditRefused(audit.ActionAdminAuth, r.RemoteAddr, r.Method+" "+r.URL.Path)
+		writeJSON(w, http.StatusUnauthorized, errorReply{errUnauthorized.Error()})
+		return
+	}
+	parts, err := splitPath(r)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && parts[0] == "sessions":
+		a.get(w, r, a.listSessions)
+	case len(parts) == 2 && parts[0] == "sessions":
+		a.get(w, r, func(r *http.Request) (int, any) {
+			s := a.router.GetSession(parts[1])
+			if s == nil {
+				return http.StatusNotFound, errorReply{"session not found"}
+			}
+			return http.StatusOK, a.sessionDetail(s)
+		})
+	case len(parts) == 3 && parts[0] == "sessions" && parts[2] == "kick":
+		a.post(w, r, func(r *http.Request) (int, any) {
+			s := a.router.GetSession(parts[1])
+			if s == nil {
+				return http.StatusNotFound, errorReply{"session not found"}
+			}
+			a.router.Kick(s, operator, "admin")
+			return http.StatusOK, kickReply{Kicked: 1}
+		})
+	case len(parts) == 3 && parts[0] == "users" && parts[2] == "kick":
+		a.post(w, r, func(r *http.Request) (int, any) {
+			uid, err := strconv.ParseUint(parts[1], 10, 32)
+			if err != nil {
+				return http.StatusBadRequest, errorReply{"invalid uid"}
+			}
+			n := 0
+			for _, s := range a.router.Sessions() {
+				if s.UserID() == uint32(uid) {
+					a.router.Kick(s, operator, "admin")
+					n++
+				}
+			}
+			return http.StatusOK, kickReply{Kicked: n}
+		})
+	case len(parts) == 1 && parts[0] == "notice":
+		a.post(w, r, func(r *http.Request) (int, any) {
+			return a.notice(r, operator)
+		})
+	case len(parts) == 1 && parts[0] == "groups":
+		a.get(w, r, func(r *http.Request) (int, any) {
+			names := a.router.GroupNames()
+			sort.Strings(names)
+			ret := make([]GroupInfo, 0, len(names))
+			for _, name := range names {
+				ret = append(ret, a.groupInfo(name))
+			}
+			return http.StatusOK, ret
+		})
+	case len(parts) == 2 && parts[0] == "groups":
+		a.get(w, r, func(r *http.Request) (int, any) {
+			if a.router.GroupMembers(parts[1]) == nil {
+				return http.StatusNotFound, errorReply{"group not found"}
+			}
+			return http.StatusOK, a.groupInfo(parts[1])
+		})
+	case len(parts) == 1 && parts[0] == "reload":
+		a.post(w, r, func(r *http.Request) (int, any) {
+			reload := a.opts.Load().Reload
+			if reload == nil {
+				return http.StatusNotImplemented, errorReply{"reload not supported"}
+			}
+			ret, err := reload(operator)
+			if err != nil {
+				return http.StatusUnprocessableEntity, errorReply{err.Error()}
+			}
+			return http.StatusOK, ret
+		})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+type errorReply struct {
+	Error string `json:"error"`
+}
+
+type kickReply struct {
+	Kicked int `json:"kicked"`
+}
+
+type noticeReply struct {
+	Sent   int `json:"sent"`
+	Failed int `json:"failed"`
+}
+
+func (a *Admin) get(w http.ResponseWriter, r *http.Request, f func(*http.Request) (int, any)) {
+	if r.Method != http.MethodGet {
+		writeJSON(w, http.StatusMethodNotAllowed, errorReply{"method not allowed"})
+		return
+	}
+	code, v := f(r)
+	writeJSON(w, code, v)
+}
+
+func (a *Admin) post(w http.ResponseWriter, r *http.Request, f func(*http.Request) (int, any)) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, errorReply{"method not allowed"})
+		return
+	}
+	code, v := f(r)
+	writeJSON(w, code, v)
+}
+
+func (a *Admin) listSessions(r *http.Request) (int, any) {
+	var uid uint64
+	filter := r.URL.Query().Get("uid")
+	if filter != "" {
+		var err error
+		if uid, err = strconv.ParseUint(filter, 10, 32); err != nil {
+			return http.StatusBadRequest, errorReply{"invalid uid"}
+		}
+	}
+	ret := []SessionInfo{}
+	for _, s := range a.router.Sessions() {
+		if filter == "" || s.UserID() == uint32(uid) {
+			ret = append(ret, sessionInfo(s))
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		if !ret[i].ConnectedAt.Equal(ret[j].ConnectedAt) {
+			return ret[i].ConnectedAt.Before(ret[j].ConnectedAt)
+		}
+		return ret[i].ID < ret[j].ID
+	})
+	return http.StatusOK, ret
+}
+
+func (a *Admin) notice(r *http.Request, operator string) (int, any) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, server.MaxPacketBodyLen+1))
+	if err != nil {
+		return http.StatusBadRequest, errorReply{err.Error()}
+	}
+	if len(body) > server.MaxPacketBodyLen {
+		return http.StatusRequestEntityTooLarge, errorReply{server.ErrBodyTooLarge.Error()}
+	}
+	p := server.NewHVPacket()
+	p.SetFlag(server.HVPacketFlagMessage)
+	p.SetBody(body)
+
+	var ret noticeReply
+	for _, s := range a.router.Sessions() {
+		if err := s.Send(p); err != nil {
+			ret.Failed++
+		} else {
+			ret.Sent++
+		}
+	}
+	a.router.Audit.Record(audit.Event{Time: time.Now(), Action: audit.ActionNotice, Actor: operator, Reason: fmt.Sprintf("sent to %d sessions", ret.Sent)})
+	return http.StatusOK, ret
+}
+
+func (a *Admin) groupInfo(name string) GroupInfo {
+	ret := GroupInfo{Name: name, Members: []GroupMember{}}
+	for _, s := range a.router.GroupMembers(name) {
+		ret.Members = append(ret.Members, GroupMember{UId: s.UserID(), SessionID: s.SessionID()})
+	}
+	return ret
+}
@@ -0,0 +1,219 @@
+package handle
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"route/audit"
+	"route/metrics"
+	"route/server"
+)
+
+type memoryTrail struct {
+	mu     sync.Mutex
+	events []audit.Event
+}
+
+func (m *memoryTrail) Record(e audit.Event) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.events = append(m.events, e)
+}
+
+// find returns the first event of the action, with the result when it is set.
+func (m *memoryTrail) find(action, result string) *audit.Event {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, e := range m.events {
+		if e.Action == action && (result == "" || e.Result == result) {
+			return &m.events[i]
+		}
+	}
+	return nil
+}
+
+func TestAdmin(t *testing.T) {
+	r, err := NewRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	trail := &memoryTrail{}
+	r.Audit = trail
+	svr, err := server.NewTcpServer(server.TcpServerOptions{
+		Audit:      trail,
+		ListenAddr: "127.0.0.1:0",
+		AuthFunc: func(b []byte) (*server.UserInfo, error) {
+			uid, err := strconv.ParseUint(string(b), 10, 32)
+			return &server.UserInfo{UId: uint32(uid)}, err
+		},
+		OnSessionPacket: r.OnSessionMessage,
+		OnSessionStatus: r.OnSessionStatus,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	svr.Start()
+	defer svr.Stop()
+
+	notices := make(chan string, 1)
+	cli := server.NewTcpClient(server.TcpClientOptions{
+		RemoteAddress:        svr.Address().String(),
+		Token:                "7",
+		ReconnectDelaySecond: -1,
+		OnSessionPacket: func(s server.Session, p server.Packet) {
+			if hv, ok := p.(*server.HVPacket); ok && hv.GetFlag() == server.HVPacketFlagMessage {
+				notices <- string(hv.GetBody())
+			}
+		},
+	})
+	if err := cli.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	handler := NewAdmin(r, AdminOptions{Keys: map[string]string{"ops": "root"}})
+	admin := httptest.NewServer(handler)
+	defer admin.Close()
+	call := func(method, path, key, body string, v any) int {
+		req, _ := http.NewRequest(method, admin.URL+path, strings.NewReader(body))
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if v != nil {
+			json.NewDecoder(resp.Body).Decode(v)
+		}
+		return resp.StatusCode
+	}
+
+	// the server pings on connect, the session shows a round trip once the pong is back
+	var list []SessionInfo
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		list = nil
+		if code := call(http.MethodGet, "/sessions?uid=7", "root", "", &list); code != http.StatusOK {
+			t.Fatalf("list: %d", code)
+		}
+		if len(list) == 1 && list[0].RTTMillis > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("sessions %+v", list)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s := list[0]; s.UId != 7 || s.Type != "tcp" || s.PacketsIn == 0 || s.BytesOut == 0 || s.ConnectedAt.IsZero() {
+		t.Fatalf("session %+v", s)
+	}
+
+	var exposition strings.Builder
+	metrics.Default.WriteTo(&exposition)
+	for _, series := range []string{
+		`route_connections_active{kind="tcp"} `,
+		`route_handshakes_total{result="success",reason=""} `,
+		`route_packets_total{direction="in",type="hv"} `,
+		`route_rtt_seconds_count `,
+	} {
+		if !strings.Contains(exposition.String(), series) {
+			t.Fatalf("no %s in metrics", series)
+		}
+	}
+
+	r.JoinGroup("room", r.GetSession(list[0].ID))
+	var detail SessionDetail
+	if code := call(http.MethodGet, "/sessions/"+list[0].ID, "root", "", &detail); code != http.StatusOK {
+		t.Fatalf("detail: %d", code)
+	}
+	if len(detail.Groups) != 1 || detail.Groups[0] != "room" || !strings.Contains(detail.Capabilities, "ping") {
+		t.Fatalf("detail %+v", detail)
+	}
+	var groups []GroupInfo
+	call(http.MethodGet, "/groups", "root", "", &groups)
+	if len(groups) != 1 || len(groups[0].Members) != 1 || groups[0].Members[0].SessionID != list[0].ID {
+		t.Fatalf("groups %+v", groups)
+	}
+
+	var sent noticeReply
+	if code := call(http.MethodPost, "/notice", "root", "maintenance at noon", &sent); code != http.StatusOK || sent.Sent != 1 {
+		t.Fatalf("notice: %d %+v", code, sent)
+	}
+	select {
+	case n := <-notices:
+		if n != "maintenance at noon" {
+			t.Fatalf("notice %q", n)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("notice never arrived")
+	}
+
+	if code := call(http.MethodGet, "/sessions", "", "", nil); code != http.StatusUnauthorized {
+		t.Fatalf("no key: %d", code)
+	}
+	if code := call(http.MethodGet, "/sessions", "wrong", "", nil); code != http.StatusUnauthorized {
+		t.Fatalf("bad key: %d", code)
+	}
+
+	var kicked kickReply
+	if code := call(http.MethodPost, "/users/7/kick", "root", "", &kicked); code != http.StatusOK || kicked.Kicked != 1 {
+		t.Fatalf("kick: %d %+v", code, kicked)
+	}
+	deadline = time.Now().Add(2 * time.Second)
+	for len(r.Sessions()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("kicked session still connected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if e := trail.find(audit.ActionHandshake, audit.ResultSuccess); e == nil || e.UId != 7 || e.SessionID != list[0].ID || e.Remote == "" {
+		t.Fatalf("handshake %+v", e)
+	}
+	if e := trail.find(audit.ActionAdminAuth, audit.ResultFailure); e == nil || e.Reason != "GET /sessions" {
+		t.Fatalf("admin auth %+v", e)
+	}
+	if e := trail.find(audit.ActionGroupJoin, ""); e == nil || e.Group != "room" || e.UId != 7 {
+		t.Fatalf("group join %+v", e)
+	}
+	if e := trail.find(audit.ActionNotice, ""); e == nil || e.Actor != "ops" {
+		t.Fatalf("notice %+v", e)
+	}
+	if e := trail.find(audit.ActionKick, ""); e == nil || e.Actor != "ops" || e.UId != 7 {
+		t.Fatalf("kick %+v", e)
+	}
+	// the kicked session left its groups
+	deadline = time.Now().Add(2 * time.Second)
+	for trail.find(audit.ActionGroupLeave, "") == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("group leave never recorded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if code := call(http.MethodPost, "/reload", "root", "", nil); code != http.StatusNotImplemented {
+		t.Fatalf("reload without Reload: %d", code)
+	}
+	// keys are replaced in place
+	handler.SetOptions(AdminOptions{
+		Keys: map[string]string{"ops2": "root2"},
+		Reload: func(operator string) (any, error) {
+			return map[string]string{"by": operator}, nil
+		},
+	})
+	if code := call(http.MethodGet, "/sessions", "root", "", nil); code != http.StatusUnauthorized {
+		t.Fatalf("replaced key accepted: %d", code)
+	}
+	var reloaded map[string]string
+	if code := call(http.MethodPost, "/reload", "root2", "", &reloaded); code != http.StatusOK || reloaded["by"] != "ops2" {
+		t.Fatalf("reload: %d %+v", code, reloaded)
+	}
+}
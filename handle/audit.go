@@ -0,0 +1,36 @@
+package handle
+
+import (
+	"time"
+
+	"route/audit"
+	"route/server"
+)
+
+// auditSession records action on s, e carries the fields specific to the action.
+func (r *Router) auditSession(action string, s server.Session, e audit.Event) {
+	e.Time = time.Now()
+	e.Action = action
+	e.SessionID = s.SessionID()
+	e.UId = s.UserID()
+	e.Kind = s.SessionType()
+	e.Remote = addrString(s.RemoteAddr())
+	r.Audit.Record(e)
+}
+
+// Kick closes s on behalf of actor, an operator key name or audit.ActorRouter.
+func (r *Router) Kick(s server.Session, actor, reason string) {
+	r.auditSession(audit.ActionKick, s, audit.Event{Actor: actor, Reason: reason})
+	s.Close()
+}
+
+// auditRefused records an api call turned away for bad credentials.
+func (r *Router) auditRefused(action, remote, reason string) {
+	r.Audit.Record(audit.Event{
+		Time:   time.Now(),
+		Action: action,
+		Result: audit.ResultFailure,
+		Reason: reason,
+		Remote: remote,
+	})
+}
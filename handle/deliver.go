@@ -0,0 +1,115 @@
+package handle
+
+import (
+	"time"
+
+	"route/audit"
+	"route/server"
+)
+
+const (
+	DeliverySent    = "sent"
+	DeliveryOffline = "offline"
+	DeliveryFailed  = "failed"
+	// refused by the forwarding rules, like a packet of a session would be
+	DeliveryDenied = "denied"
+)
+
+// Delivery is the outcome of sending to one user. sent means the packet is queued
+// on the user's session, not that the client has read it.
+type Delivery struct {
+	UId    uint32 `json:"uid"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+func deliver(uid uint32, s server.Session, p *server.RoutePacket) Delivery {
+	ret := Delivery{UId: uid, Status: DeliverySent}
+	if s == nil {
+		ret.Status = DeliveryOffline
+	} else if err := s.Send(p); err != nil {
+		ret.Status = DeliveryFailed
+		ret.Error = err.Error()
+	}
+	metricDeliveries.With(ret.Status).Inc()
+	return ret
+}
+
+// SendToUser sends p to the session of uid.
+func (r *Router) SendToUser(uid uint32, p *server.RoutePacket) Delivery {
+	return deliver(uid, r.GetUserSession(uid), p)
+}
+
+// Broadcast sends p to every member of the group, the result is nil when the group does not exist.
+func (r *Router) Broadcast(group string, p *server.RoutePacket) []Delivery {
+	members := r.GroupMembers(group)
+	if members == nil {
+		return nil
+	}
+	ret := make([]Delivery, 0, len(members))
+	for _, s := range members {
+		ret = append(ret, deliver(s.UserID(), s, p))
+	}
+	return ret
+}
+
+// apiCaller is who sends through the gateway or the grpc service, uid 0 for api keys.
+type apiCaller struct {
+	uid     uint32
+	role    string
+	trusted bool
+	remote  string
+	kind    string
+}
+
+func (c apiCaller) UserID() uint32 {
+	return c.uid
+}
+
+// allowAPI charges m to the rate limits of the router like a message of a session: the bucket
+// of the user of a token, or of the remote host for api keys.
+func (r *Router) allowAPI(c apiCaller, m *server.RoutePacket) bool {
+	key := limiterKey{uid: c.uid}
+	if c.uid == 0 {
+		key.host = c.remote
+	}
+	_, ok := r.takeTokens(key, c.role, m)
+	return ok
+}
+
+// deliverFrom is deliver for a message of c, checked against forwardEnable first.
+func (r *Router) deliverFrom(c apiCaller, uid uint32, s server.Session, p *server.RoutePacket) Delivery {
+	if s != nil && !r.forwardEnable(c, s, p) {
+		r.Audit.Record(audit.Event{
+			Time:   time.Now(),
+			Action: audit.ActionDeny,
+			Actor:  audit.ActorRouter,
+			UId:    c.uid,
+			Role:   c.role,
+			Remote: c.remote,
+			Kind:   c.kind,
+			Target: uid,
+		})
+		metricDeliveries.With(DeliveryDenied).Inc()
+		return Delivery{UId: uid, Status: DeliveryDenied}
+	}
+	return deliver(uid, s, p)
+}
+
+// sendFrom is SendToUser for a message of c.
+func (r *Router) sendFrom(c apiCaller, uid uint32, p *server.RoutePacket) Delivery {
+	return r.deliverFrom(c, uid, r.GetUserSession(uid), p)
+}
+
+// broadcastFrom is Broadcast for a message of c.
+func (r *Router) broadcastFrom(c apiCaller, group string, p *server.RoutePacket) []Delivery {
+	members := r.GroupMembers(group)
+	if members == nil {
+		return nil
+	}
+	ret := make([]Delivery, 0, len(members))
+	for _, s := range members {
+		ret = append(ret, r.deliverFrom(c, s.UserID(), s, p))
+	}
+	return ret
+}
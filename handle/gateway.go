@@ -0,0 +1,243 @@
+package handle
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"route/audit"
+	"route/server"
+	"route/server/marshal"
+)
+
+type GatewayOptions struct {
+	// verifies "Authorization: Bearer" tokens, the same jwts clients connect with.
+	// messages carry the uid of the token as their source
+	TokenAuth func(token string) (*server.UserInfo, error)
+	// "X-API-Key" keys of backends, by name. their messages carry uid 0, as from route itself
+	APIKeys map[string]string
+	// roles of token holders also allowed to broadcast to groups and to look up presence, which
+	// tells the sessions and addresses of other users. api key holders always are, other tokens
+	// may only message single users
+	TrustedRoles []string
+	// request bodies are refused beyond it, 0 means server.MaxPacketBodyLen
+	MaxBodyLen int64
+}
+
+// Gateway lets backends without a connection push messages into route over http:
+//
+//	POST /users/{uid}/messages
+//	POST /groups/{name}/broadcast     api keys and TrustedRoles only
+//
+// the body is sent as is, unless its Content-Type has a marshaler (json) that normalizes it.
+// ?type=request sends it as a request instead of an async message.
+// the reply lists the delivery status of every target. messages pass the rate limits and
+// forwarding rules of the router like the ones of sessions, over the limits the reply is 429.
+type Gateway struct {
+	router *Router
+	opts   atomic.Pointer[GatewayOptions]
+}
+
+func NewGateway(r *Router, opts GatewayOptions) *Gateway {
+	ret := &Gateway{router: r}
+	ret.SetOptions(opts)
+	return ret
+}
+
+// SetOptions replaces the credentials and limits of the gateway, requests in flight keep the old ones.
+func (g *Gateway) SetOptions(opts GatewayOptions) {
+	opts = opts.withDefaults()
+	g.opts.Store(&opts)
+}
+
+func (opts GatewayOptions) withDefaults() GatewayOptions {
+	if opts.MaxBodyLen <= 0 || opts.MaxBodyLen > server.MaxPacketBodyLen {
+		opts.MaxBodyLen = server.MaxPacketBodyLen
+	}
+	return opts
+}
+
+var (
+	errUnauthorized = errors.New("unauthorized")
+	errForbidden    = errors.New("forbidden to the role of the token")
+	errRateLimited  = errors.New("rate limited")
+)
+
+// reasonUntrusted is the audit reason of token holders refused for their role.
+const reasonUntrusted = "untrusted role"
+
+type gatewayReply struct {
+	Results []Delivery `json:"results,omitempty"`
+	Error   string     `json:"error,omitempty"`
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeReply(w http.ResponseWriter, code int, reply gatewayReply) {
+	writeJSON(w, code, reply)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeReply(w, code, gatewayReply{Error: err.Error()})
+}
+
+// authenticate returns the caller of a request from its headers or grpc metadata, trusted
+// for an api key or a token of TrustedRoles.
+func (opts *GatewayOptions) authenticate(header func(key string) string) (apiCaller, error) {
+	if key := header("X-API-Key"); key != "" {
+		for _, v := range opts.APIKeys {
+			if subtle.ConstantTimeCompare([]byte(key), []byte(v)) == 1 {
+				return apiCaller{trusted: true}, nil
+			}
+		}
+		return apiCaller{}, errUnauthorized
+	}
+	token, ok := strings.CutPrefix(header("Authorization"), "Bearer ")
+	if !ok || opts.TokenAuth == nil {
+		return apiCaller{}, errUnauthorized
+	}
+	info, err := opts.TokenAuth(token)
+	if err != nil || info == nil {
+		return apiCaller{}, errUnauthorized
+	}
+	return apiCaller{uid: info.UId, role: info.URole, trusted: slices.Contains(opts.TrustedRoles, info.URole)}, nil
+}
+
+// credentialKind names what a refused caller presented, for the audit trail.
+func credentialKind(header func(key string) string) string {
+	if header("X-API-Key") != "" {
+		return "bad api key"
+	}
+	if header("Authorization") != "" {
+		return "bad token"
+	}
+	return "no credentials"
+}
+
+// setTraceparent continues the trace of the caller in the packets it sends, a malformed header is ignored.
+func setTraceparent(p *server.RoutePacket, header func(string) string) {
+	if tc, err := server.ParseTraceparent(header("traceparent")); err == nil {
+		p.SetTrace(tc)
+	}
+}
+
+// splitPath returns the unescaped segments of the request path.
+func splitPath(r *http.Request) ([]string, error) {
+	parts := strings.Split(strings.Trim(r.URL.EscapedPath(), "/"), "/")
+	for i, p := range parts {
+		v, err := url.PathUnescape(p)
+		if err != nil {
+			return nil, err
+		}
+		parts[i] = v
+	}
+	return parts, nil
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts, err := splitPath(r)
+	if err != nil || len(parts) != 3 || parts[1] == "" {
+		http.NotFound(w, r)
+		return
+	}
+	route := parts[0] + "/" + parts[2]
+	if route != "users/messages" && route != "groups/broadcast" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	opts := g.opts.Load()
+	from, err := opts.authenticate(r.Header.Get)
+	if err != nil {
+		g.router.auditRefused(audit.ActionAPIAuth, r.RemoteAddr, credentialKind(r.Header.Get))
+		writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+	from.remote, from.kind = hostOf(r.RemoteAddr), "gateway"
+	if route == "groups/broadcast" && !from.trusted {
+		g.router.auditRefused(audit.ActionAPIAuth, r.RemoteAddr, reasonUntrusted)
+		writeError(w, http.StatusForbidden, errForbidden)
+		return
+	}
+
+	p, err := readPacket(r, opts.MaxBodyLen)
+	if err != nil {
+		code := http.StatusBadRequest
+		if errors.Is(err, server.ErrBodyTooLarge) {
+			code = http.StatusRequestEntityTooLarge
+		}
+		writeError(w, code, err)
+		return
+	}
+	p.SetUid(from.uid)
+	setTraceparent(p, r.Header.Get)
+	if !g.router.allowAPI(from, p) {
+		writeError(w, http.StatusTooManyRequests, errRateLimited)
+		return
+	}
+
+	switch route {
+	case "users/messages":
+		uid, err := strconv.ParseUint(parts[1], 10, 32)
+		if err != nil || uid == 0 {
+			writeError(w, http.StatusBadRequest, errors.New("invalid uid"))
+			return
+		}
+		writeReply(w, http.StatusOK, gatewayReply{Results: []Delivery{g.router.sendFrom(from, uint32(uid), p)}})
+	case "groups/broadcast":
+		results := g.router.broadcastFrom(from, parts[1], p)
+		if results == nil {
+			writeError(w, http.StatusNotFound, errors.New("group not found"))
+			return
+		}
+		writeReply(w, http.StatusOK, gatewayReply{Results: results})
+	}
+}
+
+func readPacket(r *http.Request, maxBodyLen int64) (*server.RoutePacket, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBodyLen+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > maxBodyLen {
+		return nil, server.ErrBodyTooLarge
+	}
+
+	m := marshal.ForContentType(r.Header.Get("Content-Type"))
+	if _, raw := m.(marshal.BytesMarshaler); !raw {
+		var v any
+		if err := m.Unmarshal(body, &v); err != nil {
+			return nil, err
+		}
+		if body, err = m.Marshal(v); err != nil {
+			return nil, err
+		}
+	}
+
+	p := server.NewRoutePacket()
+	switch r.URL.Query().Get("type") {
+	case "", "async":
+		p.SetMsgtype(server.RouteTypAsync)
+	case "request":
+		p.SetMsgtype(server.RouteTypRequest)
+	default:
+		return nil, errors.New("invalid type")
+	}
+	p.Body = body
+	return p, nil
+}
@@ -0,0 +1,290 @@
+package handle
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"route/msg"
+	"route/server"
+)
+
+func TestGateway(t *testing.T) {
+	r, err := NewRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// user 9 is a backend service, trusted with broadcasts and presence
+	tokenAuth := func(token string) (*server.UserInfo, error) {
+		uid, err := strconv.ParseUint(token, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		if uid == 9 {
+			return &server.UserInfo{UId: 9, URole: "service"}, nil
+		}
+		return &server.UserInfo{UId: uint32(uid)}, nil
+	}
+	svr, err := server.NewTcpServer(server.TcpServerOptions{
+		ListenAddr:      "ws://127.0.0.1:0/route",
+		AuthFunc:        func(b []byte) (*server.UserInfo, error) { return tokenAuth(string(b)) },
+		OnSessionPacket: r.OnSessionMessage,
+		OnSessionStatus: r.OnSessionStatus,
+		HTTPHandler: NewGateway(r, GatewayOptions{
+			TokenAuth:    tokenAuth,
+			APIKeys:      map[string]string{"backend": "secret"},
+			TrustedRoles: []string{"service"},
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	svr.Start()
+	defer svr.Stop()
+	base := "http://" + svr.Address().String()
+
+	received := make(chan *server.RoutePacket, 4)
+	cli := server.NewTcpClient(server.TcpClientOptions{
+		RemoteAddress:        "ws://" + svr.Address().String() + "/route",
+		Token:                "7",
+		ReconnectDelaySecond: -1,
+		OnSessionPacket: func(s server.Session, p server.Packet) {
+			if rp, ok := p.(*server.RoutePacket); ok {
+				received <- rp
+			}
+		},
+	})
+	if err := cli.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for r.GetUserSession(7) == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("user 7 never came online")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	r.JoinGroup("room", r.GetUserSession(7))
+
+	post := func(path, contentType, body string, header ...string) (int, gatewayReply) {
+		req, _ := http.NewRequest(http.MethodPost, base+path, strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var reply gatewayReply
+		json.NewDecoder(resp.Body).Decode(&reply)
+		return resp.StatusCode, reply
+	}
+	expect := func(from uint32, body string) {
+		select {
+		case p := <-received:
+			if p.GetUid() != from || string(p.Body) != body {
+				t.Fatalf("got uid %d body %q, want uid %d body %q", p.GetUid(), p.Body, from, body)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%q never arrived", body)
+		}
+	}
+
+	code, reply := post("/users/7/messages", "application/json", `{ "a" : 1 }`, "X-API-Key", "secret")
+	if code != http.StatusOK || len(reply.Results) != 1 || reply.Results[0].Status != DeliverySent {
+		t.Fatalf("send: %d %+v", code, reply)
+	}
+	expect(0, `{"a":1}`)
+
+	code, reply = post("/groups/room/broadcast", "application/octet-stream", "hello", "Authorization", "Bearer 9")
+	if code != http.StatusOK || len(reply.Results) != 1 || reply.Results[0] != (Delivery{UId: 7, Status: DeliverySent}) {
+		t.Fatalf("broadcast: %d %+v", code, reply)
+	}
+	expect(9, "hello")
+	if code, _ = post("/groups/room/broadcast", "text/plain", "x", "Authorization", "Bearer 8"); code != http.StatusForbidden {
+		t.Fatalf("untrusted broadcast: %d", code)
+	}
+	if code, reply = post("/users/7/messages", "text/plain", "from 8", "Authorization", "Bearer 8"); code != http.StatusOK {
+		t.Fatalf("send from an untrusted token: %d %+v", code, reply)
+	}
+	expect(8, "from 8")
+
+	// the trace of the caller reaches the client in the extended head
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	post("/users/7/messages", "text/plain", "traced", "X-API-Key", "secret", "traceparent", traceparent)
+	select {
+	case p := <-received:
+		if p.GetTrace().String() != traceparent {
+			t.Fatalf("trace %v", p.GetTrace())
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("traced message never arrived")
+	}
+
+	if code, reply = post("/users/8/messages", "text/plain", "x", "X-API-Key", "secret"); reply.Results[0].Status != DeliveryOffline {
+		t.Fatalf("offline user: %d %+v", code, reply)
+	}
+	if code, _ = post("/groups/nobody/broadcast", "text/plain", "x", "X-API-Key", "secret"); code != http.StatusNotFound {
+		t.Fatalf("unknown group: %d", code)
+	}
+	if code, _ = post("/users/7/messages", "text/plain", "x", "X-API-Key", "wrong"); code != http.StatusUnauthorized {
+		t.Fatalf("bad key: %d", code)
+	}
+	if code, _ = post("/users/7/messages", "application/json", "{", "X-API-Key", "secret"); code != http.StatusBadRequest {
+		t.Fatalf("bad json: %d", code)
+	}
+	// messages of the gateway count against the rate limits of their sender, like the ones of sessions
+	r.SetRateLimits(&RateLimitOptions{Default: UserRateLimits{Messages: server.RateLimit{Rate: 0.001, Burst: 1}}})
+	if code, _ = post("/users/7/messages", "text/plain", "once", "Authorization", "Bearer 8"); code != http.StatusOK {
+		t.Fatalf("send within the limits: %d", code)
+	}
+	expect(8, "once")
+	if code, _ = post("/users/7/messages", "text/plain", "twice", "Authorization", "Bearer 8"); code != http.StatusTooManyRequests {
+		t.Fatalf("send beyond the limits: %d", code)
+	}
+	if code, _ = post("/users/7/messages", "text/plain", "other", "X-API-Key", "secret"); code != http.StatusOK {
+		t.Fatalf("api key limited with user 8: %d", code)
+	}
+}
+
+func TestGrpcService(t *testing.T) {
+	r, err := NewRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// user 9 is a backend service, trusted with broadcasts and presence
+	tokenAuth := func(token string) (*server.UserInfo, error) {
+		uid, err := strconv.ParseUint(token, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		if uid == 9 {
+			return &server.UserInfo{UId: 9, URole: "service"}, nil
+		}
+		return &server.UserInfo{UId: uint32(uid)}, nil
+	}
+	svr, err := server.NewTcpServer(server.TcpServerOptions{
+		ListenAddr:      "grpc://127.0.0.1:0",
+		AuthFunc:        func(b []byte) (*server.UserInfo, error) { return tokenAuth(string(b)) },
+		OnSessionPacket: r.OnSessionMessage,
+		OnSessionStatus: r.OnSessionStatus,
+		GrpcService: NewGrpcService(r, GatewayOptions{
+			TokenAuth:    tokenAuth,
+			APIKeys:      map[string]string{"backend": "secret"},
+			TrustedRoles: []string{"service"},
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	svr.Start()
+	defer svr.Stop()
+
+	// user 7 holds a session over a grpc stream
+	received := make(chan *server.RoutePacket, 4)
+	cli := server.NewTcpClient(server.TcpClientOptions{
+		RemoteAddress:        "grpc://" + svr.Address().String(),
+		Token:                "7",
+		ReconnectDelaySecond: -1,
+		OnSessionPacket: func(s server.Session, p server.Packet) {
+			if rp, ok := p.(*server.RoutePacket); ok {
+				received <- rp
+			}
+		},
+	})
+	if err := cli.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for r.GetUserSession(7) == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("user 7 never came online")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	r.JoinGroup("room", r.GetUserSession(7))
+
+	cc, err := grpc.NewClient(svr.Address().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cc.Close()
+	route := msg.NewRouteClient(cc)
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "x-api-key", "secret")
+
+	resp, err := route.SendToUser(ctx, &msg.SendToUserRequest{Uid: 7, Body: []byte("hi")})
+	if err != nil || len(resp.Results) != 1 || resp.Results[0].Status != DeliverySent {
+		t.Fatalf("send: %v %v", resp, err)
+	}
+	select {
+	case p := <-received:
+		if p.GetUid() != 0 || string(p.Body) != "hi" {
+			t.Fatalf("got uid %d body %q", p.GetUid(), p.Body)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("message never arrived")
+	}
+
+	bearer := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer 9")
+	resp, err = route.Broadcast(bearer, &msg.BroadcastRequest{Group: "room", Body: []byte("all")})
+	if err != nil || len(resp.Results) != 1 || resp.Results[0].Uid != 7 {
+		t.Fatalf("broadcast: %v %v", resp, err)
+	}
+	if p := <-received; p.GetUid() != 9 || string(p.Body) != "all" {
+		t.Fatalf("got uid %d body %q", p.GetUid(), p.Body)
+	}
+
+	presence, err := route.Presence(ctx, &msg.PresenceRequest{Uids: []uint32{8}, Group: "room"})
+	if err != nil || len(presence.Users) != 2 {
+		t.Fatalf("presence: %v %v", presence, err)
+	}
+	if u := presence.Users[0]; u.Uid != 8 || u.Online {
+		t.Fatalf("user 8: %v", u)
+	}
+	if u := presence.Users[1]; u.Uid != 7 || !u.Online || u.Kind != "grpc" {
+		t.Fatalf("user 7: %v", u)
+	}
+
+	// ordinary tokens may not see who is online nor reach whole groups
+	untrusted := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer 8")
+	if _, err := route.Presence(untrusted, &msg.PresenceRequest{Uids: []uint32{7}}); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("untrusted presence: %v", err)
+	}
+	if _, err := route.Broadcast(untrusted, &msg.BroadcastRequest{Group: "room"}); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("untrusted broadcast: %v", err)
+	}
+	if _, err := route.Presence(bearer, &msg.PresenceRequest{Uids: []uint32{7}}); err != nil {
+		t.Fatalf("trusted presence: %v", err)
+	}
+
+	if _, err := route.SendToUser(context.Background(), &msg.SendToUserRequest{Uid: 7}); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("no credentials: %v", err)
+	}
+	// calls count against the rate limits of their sender, like the messages of sessions
+	r.SetRateLimits(&RateLimitOptions{Default: UserRateLimits{Messages: server.RateLimit{Rate: 0.001, Burst: 1}}})
+	if _, err := route.SendToUser(untrusted, &msg.SendToUserRequest{Uid: 7, Body: []byte("once")}); err != nil {
+		t.Fatalf("send within the limits: %v", err)
+	}
+	if p := <-received; p.GetUid() != 8 || string(p.Body) != "once" {
+		t.Fatalf("got uid %d body %q", p.GetUid(), p.Body)
+	}
+	if _, err := route.SendToUser(untrusted, &msg.SendToUserRequest{Uid: 7, Body: []byte("twice")}); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("send beyond the limits: %v", err)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"route/server"
 
 	"github.com/emirpasic/gods/maps/treemap"
+	"github.com/emirpasic/gods/utils"
 )
 
 type Group struct {
@@ -15,7 +16,7 @@ type Group struct {
 
 func NewGroup() *Group {
 	return &Group{
-		imp: treemap.NewWithIntComparator(),
+		imp: treemap.NewWith(utils.UInt64Comparator),
 	}
 }
 
@@ -3,6 +3,7 @@ package handle
 import (
 	"sync"
 
+	"route/audit"
 	"route/server"
 )
 
@@ -22,6 +23,15 @@ func (m *Groups) GetGroup(name string) *Group {
 	return nil
 }
 
+func (m *Groups) Names() []string {
+	var ret []string
+	m.groups.Range(func(k, v any) bool {
+		ret = append(ret, k.(string))
+		return true
+	})
+	return ret
+}
+
 func (m *Groups) RemoveFromGroup(name string, uid uint64, s server.Session) {
 	if v, has := m.groups.Load(name); has {
 		v.(*Group).RemoveIfSame(uid, s)
@@ -32,3 +42,78 @@ func (m *Groups) AddTo(name string, uid uint64, s server.Session) {
 	g := m.MustGetGroup(name)
 	g.Add(uid, s)
 }
+
+type groupsKeyT struct{}
+
+var groupsKey = groupsKeyT{}
+
+// sessionGroups are the groups a session joined, left together when it goes offline.
+type sessionGroups struct {
+	mu    sync.Mutex
+	names map[string]struct{}
+}
+
+func getSessionGroups(s server.Session) *sessionGroups {
+	if v, ok := s.GetUserData(groupsKey); ok {
+		return v.(*sessionGroups)
+	}
+	sg := &sessionGroups{names: make(map[string]struct{})}
+	s.SetUserData(groupsKey, sg)
+	return sg
+}
+
+// JoinGroup adds s to the group, as the member for its user.
+func (r *Router) JoinGroup(name string, s server.Session) {
+	sg := getSessionGroups(s)
+	sg.mu.Lock()
+	defer sg.mu.Unlock()
+	sg.names[name] = struct{}{}
+	r.groups.AddTo(name, uint64(s.UserID()), s)
+	r.auditSession(audit.ActionGroupJoin, s, audit.Event{Group: name})
+}
+
+func (r *Router) LeaveGroup(name string, s server.Session) {
+	sg := getSessionGroups(s)
+	sg.mu.Lock()
+	defer sg.mu.Unlock()
+	delete(sg.names, name)
+	r.groups.RemoveFromGroup(name, uint64(s.UserID()), s)
+	r.auditSession(audit.ActionGroupLeave, s, audit.Event{Group: name})
+}
+
+func (r *Router) leaveAllGroups(s server.Session) {
+	sg := getSessionGroups(s)
+	sg.mu.Lock()
+	defer sg.mu.Unlock()
+	for name := range sg.names {
+		r.groups.RemoveFromGroup(name, uint64(s.UserID()), s)
+		r.auditSession(audit.ActionGroupLeave, s, audit.Event{Group: name, Reason: "disconnected"})
+	}
+	sg.names = make(map[string]struct{})
+}
+
+// GroupMembers returns the sessions in the group, nil when it does not exist.
+func (r *Router) GroupMembers(name string) []server.Session {
+	g := r.groups.GetGroup(name)
+	if g == nil {
+		return nil
+	}
+	return g.GetAll()
+}
+
+// GroupNames returns the groups anyone ever joined.
+func (r *Router) GroupNames() []string {
+	return r.groups.Names()
+}
+
+// SessionGroups returns the groups s is in.
+func (r *Router) SessionGroups(s server.Session) []string {
+	sg := getSessionGroups(s)
+	sg.mu.Lock()
+	defer sg.mu.Unlock()
+	ret := make([]string, 0, len(sg.names))
+	for name := range sg.names {
+		ret = append(ret, name)
+	}
+	return ret
+}
@@ -0,0 +1,154 @@
+package handle
+
+import (
+	"context"
+	"sync/atomic"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"route/audit"
+	"route/msg"
+	"route/server"
+)
+
+// GrpcService serves the unary calls of msg.Route, authenticated like the http Gateway
+// with "authorization: Bearer" or "x-api-key" metadata. Broadcast and Presence take an
+// api key or a token of GatewayOptions.TrustedRoles. messages pass the rate limits and
+// forwarding rules of the router like the ones of sessions. Stream is served by the grpc
+// listener itself, its sessions reach the router like any other.
+type GrpcService struct {
+	msg.UnimplementedRouteServer
+	router *Router
+	opts   atomic.Pointer[GatewayOptions]
+}
+
+func NewGrpcService(r *Router, opts GatewayOptions) *GrpcService {
+	ret := &GrpcService{router: r}
+	ret.SetOptions(opts)
+	return ret
+}
+
+// SetOptions replaces the credentials and limits of the service, calls in flight keep the old ones.
+func (g *GrpcService) SetOptions(opts GatewayOptions) {
+	opts = opts.withDefaults()
+	g.opts.Store(&opts)
+}
+
+// incomingHeader reads the metadata of the call like http headers.
+func incomingHeader(ctx context.Context) func(string) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	return func(key string) string {
+		if v := md.Get(key); len(v) > 0 {
+			return v[0]
+		}
+		return ""
+	}
+}
+
+// authenticate returns the caller, trustedOnly refuses tokens outside GatewayOptions.TrustedRoles.
+func (g *GrpcService) authenticate(ctx context.Context, trustedOnly bool) (apiCaller, error) {
+	var remote string
+	if p, ok := peer.FromContext(ctx); ok {
+		remote = addrString(p.Addr)
+	}
+	from, err := g.opts.Load().authenticate(incomingHeader(ctx))
+	if err != nil {
+		g.router.auditRefused(audit.ActionAPIAuth, remote, credentialKind(incomingHeader(ctx)))
+		return from, status.Error(codes.Unauthenticated, err.Error())
+	}
+	if trustedOnly && !from.trusted {
+		g.router.auditRefused(audit.ActionAPIAuth, remote, reasonUntrusted)
+		return from, status.Error(codes.PermissionDenied, errForbidden.Error())
+	}
+	from.remote, from.kind = hostOf(remote), "grpc"
+	return from, nil
+}
+
+// newPacket checks the call and the message of its caller, before it is sent like the packet of a session.
+func (g *GrpcService) newPacket(ctx context.Context, trustedOnly bool, msgtype uint32, body []byte) (apiCaller, *server.RoutePacket, error) {
+	from, err := g.authenticate(ctx, trustedOnly)
+	if err != nil {
+		return from, nil, err
+	}
+	if msgtype > uint32(server.RouteTypRequest) {
+		return from, nil, status.Error(codes.InvalidArgument, "invalid msgtype")
+	}
+	if int64(len(body)) > g.opts.Load().MaxBodyLen {
+		return from, nil, status.Error(codes.InvalidArgument, server.ErrBodyTooLarge.Error())
+	}
+	p := server.NewRoutePacket()
+	p.SetMsgtype(byte(msgtype))
+	p.SetUid(from.uid)
+	p.Body = body
+	setTraceparent(p, incomingHeader(ctx))
+	if !g.router.allowAPI(from, p) {
+		return from, nil, status.Error(codes.ResourceExhausted, errRateLimited.Error())
+	}
+	return from, p, nil
+}
+
+func toDeliveries(results []Delivery) []*msg.Delivery {
+	ret := make([]*msg.Delivery, 0, len(results))
+	for _, d := range results {
+		ret = append(ret, &msg.Delivery{Uid: d.UId, Status: d.Status, Error: d.Error})
+	}
+	return ret
+}
+
+func (g *GrpcService) SendToUser(ctx context.Context, req *msg.SendToUserRequest) (*msg.SendResponse, error) {
+	if req.GetUid() == 0 {
+		return nil, status.Error(codes.InvalidArgument, "invalid uid")
+	}
+	from, p, err := g.newPacket(ctx, false, req.GetMsgtype(), req.GetBody())
+	if err != nil {
+		return nil, err
+	}
+	d := g.router.sendFrom(from, req.GetUid(), p)
+	return &msg.SendResponse{Results: toDeliveries([]Delivery{d})}, nil
+}
+
+func (g *GrpcService) Broadcast(ctx context.Context, req *msg.BroadcastRequest) (*msg.SendResponse, error) {
+	from, p, err := g.newPacket(ctx, true, req.GetMsgtype(), req.GetBody())
+	if err != nil {
+		return nil, err
+	}
+	results := g.router.broadcastFrom(from, req.GetGroup(), p)
+	if results == nil {
+		return nil, status.Error(codes.NotFound, "group not found")
+	}
+	return &msg.SendResponse{Results: toDeliveries(results)}, nil
+}
+
+func (g *GrpcService) Presence(ctx context.Context, req *msg.PresenceRequest) (*msg.PresenceResponse, error) {
+	if _, err := g.authenticate(ctx, true); err != nil {
+		return nil, err
+	}
+	uids := req.GetUids()
+	if req.GetGroup() != "" {
+		members := g.router.GroupMembers(req.GetGroup())
+		if members == nil {
+			return nil, status.Error(codes.NotFound, "group not found")
+		}
+		for _, s := range members {
+			uids = append(uids, s.UserID())
+		}
+	}
+
+	ret := &msg.PresenceResponse{}
+	for _, uid := range uids {
+		p := &msg.UserPresence{Uid: uid}
+		if s := g.router.GetUserSession(uid); s != nil {
+			p.Online = true
+			p.SessionId = s.SessionID()
+			p.Kind = s.SessionType()
+			if addr := s.RemoteAddr(); addr != nil {
+				p.RemoteAddr = addr.String()
+			}
+		}
+		ret.Users = append(ret.Users, p)
+	}
+	return ret, nil
+}
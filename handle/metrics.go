@@ -0,0 +1,27 @@
+package handle
+
+import (
+	"time"
+
+	"route/metrics"
+)
+
+var (
+	metricForwards = metrics.NewCounterVec("route_forward_total",
+		"route packets from sessions by outcome: forwarded, offline target, send failed, rate limited or handled by route itself",
+		"result")
+	metricForwardLatency = metrics.NewHistogram("route_forward_latency_seconds",
+		"time from a route packet read to it being queued on the target session",
+		metrics.ExponentialBuckets(0.00001, 4, 10))
+	metricDeliveries = metrics.NewCounterVec("route_deliveries_total",
+		"packets sent by the gateways and broadcasts, by delivery status", "status")
+	metricUsersOnline = metrics.NewGauge("route_users_online",
+		"users with a session on the router")
+)
+
+func observeForward(result string, start time.Time) {
+	metricForwards.With(result).Inc()
+	if result == "ok" {
+		metricForwardLatency.Observe(time.Since(start).Seconds())
+	}
+}
@@ -0,0 +1,171 @@
+package handle
+
+import (
+	"net"
+	"time"
+
+	"route/server"
+)
+
+// LimitAction is what happens to a session exceeding its rate limits.
+type LimitAction int
+
+const (
+	// drop the message, reply an error packet and count it against the session
+	LimitReject LimitAction = iota
+	// close the session at once
+	LimitDisconnect
+)
+
+const ErrCodeRateLimited int32 = 429
+
+type UserRateLimits struct {
+	// messages per second
+	Messages server.RateLimit
+	// body bytes per second
+	Bytes server.RateLimit
+}
+
+type RateLimitOptions struct {
+	Default UserRateLimits
+	// overrides by user role
+	Roles  map[string]UserRateLimits
+	Action LimitAction
+}
+
+func (o *RateLimitOptions) limitsOf(role string) UserRateLimits {
+	if l, has := o.Roles[role]; has {
+		return l
+	}
+	return o.Default
+}
+
+type userLimiter struct {
+	msgs  *server.TokenBucket
+	bytes *server.TokenBucket
+}
+
+// SetRateLimits replaces the per user limits, buckets restart full.
+func (r *Router) SetRateLimits(opts *RateLimitOptions) {
+	r.rateLimits.Store(opts)
+	r.limiters.Range(func(key, value any) bool {
+		r.limiters.Delete(key)
+		return true
+	})
+}
+
+type rateLimitsKeyT struct{}
+
+var rateLimitsKey = rateLimitsKeyT{}
+
+// limiterKey tells apart the buckets of a user under different limits, nil limits are the ones of the router.
+// anonymous sessions, uid 0, share the bucket of their remote host, or have one of their own without it.
+type limiterKey struct {
+	limits *RateLimitOptions
+	uid    uint32
+	host   string
+	sid    string
+}
+
+func sessionLimiterKey(s server.Session) limiterKey {
+	ret := limiterKey{uid: s.UserID()}
+	if ret.uid == 0 {
+		if ret.host = remoteHost(s); ret.host == "" {
+			ret.sid = s.SessionID()
+		}
+	}
+	if v, ok := s.GetUserData(rateLimitsKey); ok {
+		ret.limits = v.(*RateLimitOptions)
+	}
+	return ret
+}
+
+// OnSessionStatusLimited is OnSessionStatus for a listener with limits of its own, applied to its sessions
+// instead of the ones of SetRateLimits. nil opts leaves them unlimited.
+func (r *Router) OnSessionStatusLimited(opts *RateLimitOptions) server.FuncOnSessionStatus {
+	if opts == nil {
+		opts = &RateLimitOptions{}
+	}
+	return func(s server.Session, enable bool) {
+		if enable {
+			s.SetUserData(rateLimitsKey, opts)
+		}
+		r.OnSessionStatus(s, enable)
+	}
+}
+
+func remoteHost(s server.Session) string {
+	return hostOf(addrString(s.RemoteAddr()))
+}
+
+// hostOf returns the host of a "host:port" address, empty for anything else.
+func hostOf(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
+// sweepLimiters forgets buckets that are full again, at most once a minute. buckets outlive
+// the sessions using them, a user reconnecting gets the one it left with.
+func (r *Router) sweepLimiters(now time.Time) {
+	at := r.limitersSweepAt.Load()
+	if now.UnixNano() < at || !r.limitersSweepAt.CompareAndSwap(at, now.Add(time.Minute).UnixNano()) {
+		return
+	}
+	r.limiters.Range(func(key, value any) bool {
+		l := value.(*userLimiter)
+		if l.msgs.Full(now) && l.bytes.Full(now) {
+			r.limiters.Delete(key)
+		}
+		return true
+	})
+}
+
+func sessionRole(s server.Session) string {
+	if u, ok := s.(interface{ UserRole() string }); ok {
+		return u.UserRole()
+	}
+	return ""
+}
+
+// takeTokens charges m to the bucket of key, created with the limits of role. it returns the
+// limits applied and whether m is within them.
+func (r *Router) takeTokens(key limiterKey, role string, m *server.RoutePacket) (*RateLimitOptions, bool) {
+	opts := key.limits
+	if opts == nil {
+		opts = r.rateLimits.Load()
+	}
+	if opts == nil {
+		return nil, true
+	}
+
+	now := time.Now()
+	r.sweepLimiters(now)
+	v, has := r.limiters.Load(key)
+	if !has {
+		limits := opts.limitsOf(role)
+		v, _ = r.limiters.LoadOrStore(key, &userLimiter{
+			msgs:  server.NewTokenBucket(limits.Messages),
+			bytes: server.NewTokenBucket(limits.Bytes),
+		})
+	}
+	l := v.(*userLimiter)
+	return opts, l.msgs.AllowN(now, 1) && l.bytes.Take(now, float64(len(m.Body)))
+}
+
+func (r *Router) allowMessage(s server.Session, m *server.RoutePacket) bool {
+	opts, ok := r.takeTokens(sessionLimiterKey(s), sessionRole(s), m)
+	if ok {
+		return true
+	}
+
+	if opts.Action == LimitDisconnect {
+		s.Close()
+		return false
+	}
+	r.replyError(s, ErrCodeRateLimited, "rate limited")
+	r.dealSocketErrCnt(s)
+	return false
+}
@@ -0,0 +1,75 @@
+package handle
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"route/server"
+)
+
+// limitedSession is a connected session as far as allowMessage looks at it.
+type limitedSession struct {
+	server.Session
+	sync.Map
+	id     string
+	uid    uint32
+	remote net.Addr
+}
+
+func (s *limitedSession) SessionID() string             { return s.id }
+func (s *limitedSession) SessionType() string           { return "tcp" }
+func (s *limitedSession) UserID() uint32                { return s.uid }
+func (s *limitedSession) RemoteAddr() net.Addr          { return s.remote }
+func (s *limitedSession) Send(server.Packet) error      { return nil }
+func (s *limitedSession) SetUserData(k, v any)          { s.Store(k, v) }
+func (s *limitedSession) GetUserData(k any) (any, bool) { return s.Load(k) }
+
+func TestRateLimitBuckets(t *testing.T) {
+	r, err := NewRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.MaxSessionErrCnt = 0
+	r.SetRateLimits(&RateLimitOptions{Default: UserRateLimits{Messages: server.RateLimit{Rate: 0.001, Burst: 1}}})
+	addr := func(s string) net.Addr {
+		a, _ := net.ResolveTCPAddr("tcp", s)
+		return a
+	}
+	m := server.NewRoutePacket()
+
+	// anonymous sessions from different hosts do not share a bucket, the ones of a host do
+	a := &limitedSession{id: "a", remote: addr("10.0.0.1:1000")}
+	b := &limitedSession{id: "b", remote: addr("10.0.0.2:1000")}
+	a2 := &limitedSession{id: "a2", remote: addr("10.0.0.1:2000")}
+	if !r.allowMessage(a, m) || !r.allowMessage(b, m) {
+		t.Fatal("anonymous hosts limited together")
+	}
+	if r.allowMessage(a2, m) {
+		t.Fatal("second connection of a host got a fresh bucket")
+	}
+
+	// a user disconnecting keeps its empty bucket
+	u := &limitedSession{id: "u", uid: 7, remote: addr("10.0.0.3:1000")}
+	if !r.allowMessage(u, m) {
+		t.Fatal("first message of a user limited")
+	}
+	r.onUserOffline(u)
+	u = &limitedSession{id: "u2", uid: 7, remote: addr("10.0.0.4:1000")}
+	if r.allowMessage(u, m) {
+		t.Fatal("reconnecting refilled the bucket")
+	}
+
+	// buckets are only forgotten once full again
+	r.limitersSweepAt.Store(0)
+	r.sweepLimiters(time.Now())
+	if _, has := r.limiters.Load(sessionLimiterKey(u)); !has {
+		t.Fatal("empty bucket swept")
+	}
+	r.limitersSweepAt.Store(0)
+	r.sweepLimiters(time.Now().Add(time.Hour))
+	if _, has := r.limiters.Load(sessionLimiterKey(u)); has {
+		t.Fatal("full bucket kept")
+	}
+}
@@ -1,19 +1,31 @@
 package handle
 
 import (
-	"fmt"
-	"log"
+	"log/slog"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"google.golang.org/protobuf/proto"
 
+	"route/audit"
 	"route/auth"
+	"route/msg"
 	"route/server"
 )
 
+const DefaultMaxSessionErrCnt = 10
+
+// ErrCodeTargetOffline answers a message to a user without a session, the reply carries the uid of the target.
+const ErrCodeTargetOffline int32 = 404
+
 func NewRouter() (*Router, error) {
 	ret := &Router{
-		userSession: make(map[uint32]server.Session),
+		userSession:      make(map[uint32]server.Session),
+		MaxSessionErrCnt: DefaultMaxSessionErrCnt,
+		Logger:           slog.Default(),
+		Tracer:           server.NopTracer{},
+		Audit:            audit.Discard,
 		// UserSessions :
 	}
 
@@ -27,6 +39,25 @@ type Router struct {
 	// UserSessions *UserSessions
 
 	Selfinfo *auth.UserInfo
+
+	// sessions are closed after this many bad requests, 0 disables it
+	MaxSessionErrCnt int
+
+	// diagnostics of routing, every record about a session carries its attributes
+	Logger *slog.Logger
+	// spans of forwarded packets and calls to route itself, continuing the trace of the packet
+	Tracer server.Tracer
+	// kicks, refused forwards, group changes and refused api calls
+	Audit audit.Sink
+
+	rateLimits atomic.Pointer[RateLimitOptions]
+	limiters   sync.Map
+	// unix nanoseconds of the next sweep of limiters
+	limitersSweepAt atomic.Int64
+
+	groups Groups
+	// every connected session by id, userSession only has the latest of each user
+	sessions sync.Map
 }
 
 type tcpSocketKeyT struct{}
@@ -36,7 +67,13 @@ var tcpSocketKey = tcpSocketKeyT{}
 var tcpPacketKey = tcpPacketKeyT{}
 
 func (r *Router) OnSessionStatus(s server.Session, enable bool) {
-	fmt.Printf("OnSessionStatus: %v %v, %v \n", s.SessionID(), s.RemoteAddr(), enable)
+	server.SessionLogger(r.Logger, s).Debug("session status", "online", enable)
+
+	if enable {
+		r.sessions.Store(s.SessionID(), s)
+	} else {
+		r.sessions.Delete(s.SessionID())
+	}
 
 	currSession := r.GetUserSession(s.UserID())
 	if enable {
@@ -66,34 +103,85 @@ func (r *Router) OnSessionMessage(s server.Session, m server.Packet) {
 
 	switch m := m.(type) {
 	case *server.RoutePacket:
-		var err error
-		targetuid := m.GetUid()
+		start := time.Now()
+		span := r.Tracer.StartSpan("route.forward", m.GetTrace())
+		span.SetAttributes("sid", s.SessionID(), "uid", s.UserID(), "target", m.GetUid())
+		result, err := r.forward(s, m, span)
+		observeForward(result, start)
+		span.SetAttributes("result", result)
+		span.End(err)
+	default:
 
-		if targetuid == 0 {
-			//call my self
-			r.OnCall(s, m)
-			return
-		}
+	}
+}
 
-		target := r.GetUserSession(targetuid)
-		if target == nil {
-			//TODO: send err to source
-			log.Println("session not found")
-			return
-		}
+// forward sends m on to its target user and tells the outcome, as counted by route_forward_total.
+func (r *Router) forward(s server.Session, m *server.RoutePacket, span server.Span) (string, error) {
+	targetuid := m.GetUid()
 
-		if !r.forwardEnable(s, target, m) {
-			return
-		}
+	if !r.allowMessage(s, m) {
+		return "limited", nil
+	}
 
-		m.SetUid(s.UserID())
-		err = target.Send(m)
-		if err != nil {
-			log.Println(err)
-		}
-	default:
+	if targetuid == 0 {
+		//call my self
+		r.dispatch(s, m, span.Context())
+		return "self", nil
+	}
 
+	target := r.GetUserSession(targetuid)
+	if target == nil {
+		// not a misbehaviour, users go offline while others still talk to them
+		server.SessionLogger(r.Logger, s).Debug("target offline", "target", targetuid)
+		r.replyErrorFrom(s, targetuid, ErrCodeTargetOffline, "target offline")
+		return "offline", nil
 	}
+
+	if !r.forwardEnable(s, target, m) {
+		r.auditSession(audit.ActionDeny, s, audit.Event{Actor: audit.ActorRouter, Target: targetuid})
+		r.dealSocketErrCnt(s)
+		return "denied", nil
+	}
+
+	m.SetUid(s.UserID())
+	// the next hop is a child of this one
+	if tc := span.Context(); tc.IsValid() {
+		m.SetTrace(tc)
+	}
+	if err := target.Send(m); err != nil {
+		server.SessionLogger(r.Logger, s).Warn("forward failed", "target", targetuid, "err", err)
+		return "failed", err
+	}
+	return "ok", nil
+}
+
+// dispatch runs a call to route itself in a span of its own.
+func (r *Router) dispatch(s server.Session, m *server.RoutePacket, parent server.TraceContext) {
+	span := r.Tracer.StartSpan("route.dispatch", parent)
+	span.SetAttributes("sid", s.SessionID(), "uid", s.UserID(), "msgtype", m.GetMsgtype())
+	if tc := span.Context(); tc.IsValid() {
+		m.SetTrace(tc)
+	}
+	r.OnCall(s, m)
+	span.End(nil)
+}
+
+// GetSession returns the connected session with the id.
+func (r *Router) GetSession(id string) server.Session {
+	if v, ok := r.sessions.Load(id); ok {
+		return v.(server.Session)
+	}
+	return nil
+}
+
+// Sessions returns every connected session.
+func (r *Router) Sessions() []server.Session {
+	var ret []server.Session
+	r.sessions.Range(func(k, v any) bool {
+		ret = append(ret, v.(server.Session))
+		return true
+	})
+	return ret
 }
 
 func (r *Router) GetUserSession(uid uint32) server.Session {
@@ -115,6 +203,7 @@ func (r *Router) RemoveUserSession(uid uint32) {
 }
 
 func (r *Router) onUserOnline(s server.Session) {
+	metricUsersOnline.Inc()
 	// uinfo.Groups.Range(func(k, v interface{}) bool {
 	// 	r.gm.AddTo(k.(string), uinfo.UID, s)
 	// 	return true
@@ -128,6 +217,9 @@ func (r *Router) onUserOnline(s server.Session) {
 }
 
 func (r *Router) onUserOffline(s server.Session) {
+	metricUsersOnline.Dec()
+	r.leaveAllGroups(s)
+
 	// uinfo.Groups.Range(func(k, v interface{}) bool {
 	// 	r.gm.RemoveFromGroup(k.(string), uinfo.UID, s)
 	// 	return true
@@ -140,8 +232,26 @@ func (r *Router) onUserOffline(s server.Session) {
 	// })
 }
 
+// replyError sends an error packet from route itself to s.
+func (r *Router) replyError(s server.Session, code int32, errmsg string) error {
+	return r.replyErrorFrom(s, 0, code, errmsg)
+}
+
+// replyErrorFrom sends an error as if it came from uid, telling the sender which target it is about.
+func (r *Router) replyErrorFrom(s server.Session, uid uint32, code int32, errmsg string) error {
+	body, err := proto.Marshal(&msg.Error{Code: code, Errmsg: errmsg})
+	if err != nil {
+		return err
+	}
+	p := server.NewRoutePacket()
+	p.SetMsgtype(server.RouteTypRespErr)
+	p.SetUid(uid)
+	p.Body = body
+	return s.Send(p)
+}
+
 func (r *Router) PublishEvent(event proto.Message) {
-	log.Printf("[Mock PublishEvent] name:%v, msg:%v\n", string(proto.MessageName(event).Name()), event)
+	r.Logger.Debug("mock publish event", "name", string(proto.MessageName(event).Name()), "msg", event)
 }
 
 func (r *Router) OnCall(s server.Session, msg *server.RoutePacket) {
@@ -152,7 +262,7 @@ func (r *Router) OnCall(s server.Session, msg *server.RoutePacket) {
 	// enable := r.callEnable(s, uint32(msgid))
 	// if !enable {
 	// 	log.Print("not enable to call this method:", msgid)
-	// 	dealSocketErrCnt(s)
+	// 	r.dealSocketErrCnt(s)
 	// 	return
 	// }
 
@@ -160,7 +270,7 @@ func (r *Router) OnCall(s server.Session, msg *server.RoutePacket) {
 	// method := r.ct.Get(msgid)
 	// if method == nil {
 	// 	log.Print("not found method,msgid:", msgid)
-	// 	dealSocketErrCnt(s)
+	// 	r.dealSocketErrCnt(s)
 	// 	return
 	// }
 
@@ -224,7 +334,8 @@ func (r *Router) OnCall(s server.Session, msg *server.RoutePacket) {
 	// }
 }
 
-func (r *Router) forwardEnable(s server.Session, target server.Session, msg *server.RoutePacket) bool {
+// forwardEnable tells whether from may send msg to target, from is a session or an api caller.
+func (r *Router) forwardEnable(from server.User, target server.Session, msg *server.RoutePacket) bool {
 	// suinfo := GetSocketUserInfo(s)
 	// tuinfo := GetSocketUserInfo(target)
 	// if suinfo == nil || tuinfo == nil {
@@ -0,0 +1,149 @@
+package handle
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"route/audit"
+	"route/msg"
+	"route/server"
+)
+
+func TestForwardOffline(t *testing.T) {
+	r, err := NewRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.MaxSessionErrCnt = 2
+	trail := &memoryTrail{}
+	r.Audit = trail
+	svr, err := server.NewTcpServer(server.TcpServerOptions{
+		ListenAddr: "127.0.0.1:0",
+		AuthFunc: func(b []byte) (*server.UserInfo, error) {
+			uid, err := strconv.ParseUint(string(b), 10, 32)
+			return &server.UserInfo{UId: uint32(uid)}, err
+		},
+		OnSessionPacket: r.OnSessionMessage,
+		OnSessionStatus: r.OnSessionStatus,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	svr.Start()
+	defer svr.Stop()
+
+	replies := make(chan *server.RoutePacket, 8)
+	cli := server.NewTcpClient(server.TcpClientOptions{
+		RemoteAddress:        svr.Address().String(),
+		Token:                "7",
+		ReconnectDelaySecond: -1,
+		OnSessionPacket: func(s server.Session, p server.Packet) {
+			if rp, ok := p.(*server.RoutePacket); ok {
+				replies <- rp.Clone()
+			}
+		},
+	})
+	if err := cli.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	// talking to offline users is not a misbehaviour, however often it happens
+	for i := 0; i < 4; i++ {
+		p := server.NewRoutePacket()
+		p.SetMsgtype(server.RouteTypAsync)
+		p.SetUid(99)
+		p.Body = []byte("hello")
+		cli.Send(p)
+		select {
+		case rp := <-replies:
+			var e msg.Error
+			if rp.GetMsgtype() != server.RouteTypRespErr || rp.GetUid() != 99 || proto.Unmarshal(rp.Body, &e) != nil || e.Code != ErrCodeTargetOffline {
+				t.Fatalf("unexpected reply %v uid=%d %+v", rp.GetMsgtype(), rp.GetUid(), &e)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("no error reply")
+		}
+	}
+	if len(r.Sessions()) != 1 || trail.find(audit.ActionKick, "") != nil {
+		t.Fatal("sender kicked for offline targets")
+	}
+}
+
+func TestKickInvalidPackets(t *testing.T) {
+	r, err := NewRouter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.MaxSessionErrCnt = 2
+	trail := &memoryTrail{}
+	r.Audit = trail
+	svr, err := server.NewTcpServer(server.TcpServerOptions{
+		ListenAddr: "127.0.0.1:0",
+		AuthFunc: func(b []byte) (*server.UserInfo, error) {
+			return &server.UserInfo{UId: 7}, nil
+		},
+		OnSessionPacket: r.OnSessionMessage,
+		OnSessionStatus: r.OnSessionStatus,
+		OnSessionError:  r.OnSessionError,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	svr.Start()
+	defer svr.Stop()
+
+	replies := make(chan *server.RoutePacket, 8)
+	cli := server.NewTcpClient(server.TcpClientOptions{
+		RemoteAddress:        svr.Address().String(),
+		Token:                "7",
+		ReconnectDelaySecond: -1,
+		OnSessionPacket: func(s server.Session, p server.Packet) {
+			if rp, ok := p.(*server.RoutePacket); ok {
+				replies <- rp.Clone()
+			}
+		},
+	})
+	if err := cli.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	invalid := func() {
+		p := server.NewRoutePacket()
+		// a high msgtype bit no session negotiates
+		p.RoutePacketHead[0] = 0x10
+		p.SetUid(99)
+		p.Body = []byte("hello")
+		cli.Send(p)
+	}
+
+	// the invalid packet is dropped, the one behind it still arrives
+	invalid()
+	p := server.NewRoutePacket()
+	p.SetUid(99)
+	cli.Send(p)
+	select {
+	case <-replies:
+	case <-time.After(2 * time.Second):
+		t.Fatal("session closed on the first invalid packet")
+	}
+	if len(r.Sessions()) != 1 {
+		t.Fatal("session gone after one invalid packet")
+	}
+
+	invalid()
+	deadline := time.Now().Add(2 * time.Second)
+	for len(r.Sessions()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("session not kicked")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if e := trail.find(audit.ActionKick, ""); e == nil || e.Reason != "too many errors" || e.UId != 7 {
+		t.Fatalf("kick not audited: %+v", e)
+	}
+}
@@ -2,9 +2,10 @@ package handle
 
 import (
 	"context"
-	"fmt"
 	"hash/fnv"
+	"route/audit"
 	"route/auth"
+	"sync"
 
 	"route/server"
 )
@@ -19,20 +20,37 @@ func GetSocketUserInfo(s server.Session) *auth.UserInfo {
 	return nil
 }
 
+type errcntKeyT struct{}
+
+var errcntKey = errcntKeyT{}
+
+// errcnts of sessions are counted from their reading goroutine too, see OnSessionError
+var errcntMu sync.Mutex
+
 func addSocketErrCnt(s server.Session) int {
-	// if v, ok := s.MetaLoad(errcntKey); ok {
-	// 	cnt := v.(int)
-	// 	cnt++
-	// 	s.MetaStore(errcntKey, cnt)
-	// 	return cnt
-	// }
-	// s.MetaStore(errcntKey, 1)
-	return 1
+	errcntMu.Lock()
+	defer errcntMu.Unlock()
+	cnt := 1
+	if v, ok := s.GetUserData(errcntKey); ok {
+		cnt += v.(int)
+	}
+	s.SetUserData(errcntKey, cnt)
+	return cnt
 }
 
-func dealSocketErrCnt(s server.Session) {
+// dealSocketErrCnt counts a misbehaviour of the session and closes it once the limit is reached.
+func (r *Router) dealSocketErrCnt(s server.Session) {
 	cnt := addSocketErrCnt(s)
-	fmt.Printf("socket:%v, uid:%v, errcnt:%v", s.SessionID(), s.UserID(), cnt)
+	server.SessionLogger(r.Logger, s).Warn("session misbehaved", "errcnt", cnt)
+	if r.MaxSessionErrCnt > 0 && cnt >= r.MaxSessionErrCnt {
+		r.Kick(s, audit.ActorRouter, "too many errors")
+	}
+}
+
+// OnSessionError counts a packet the server dropped for breaking the protocol against s.
+func (r *Router) OnSessionError(s server.Session, err error) {
+	server.SessionLogger(r.Logger, s).Debug("invalid packet", "err", err)
+	r.dealSocketErrCnt(s)
 }
 
 func GetSocketFromCtx(ctx context.Context) server.Session {
@@ -0,0 +1,213 @@
+// Package metrics keeps counters, gauges and histograms and writes them in the
+// prometheus text exposition format, without pulling in a client library.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Default is the registry the package level constructors register in.
+var Default = NewRegistry()
+
+// DefBuckets suit latencies in seconds, from 5ms to 10s.
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// ExponentialBuckets returns count buckets, the first one start and every next one factor times larger.
+func ExponentialBuckets(start, factor float64, count int) []float64 {
+	ret := make([]float64, count)
+	for i := range ret {
+		ret[i] = start
+		start *= factor
+	}
+	return ret
+}
+
+type family interface {
+	name() string
+	write(w *bufio.Writer)
+}
+
+type Registry struct {
+	mu       sync.Mutex
+	families []family
+	names    map[string]bool
+}
+
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+// register panics on a name already taken, metrics are declared once at init.
+func (r *Registry) register(f family) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.names[f.name()] {
+		panic("metrics: duplicate metric " + f.name())
+	}
+	r.names[f.name()] = true
+	r.families = append(r.families, f)
+}
+
+// WriteTo writes every metric in the text exposition format, sorted by name.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	families := append([]family(nil), r.families...)
+	r.mu.Unlock()
+	sort.Slice(families, func(i, j int) bool { return families[i].name() < families[j].name() })
+
+	cw := &countWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	for _, f := range families {
+		f.write(bw)
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteTo(w)
+	})
+}
+
+// Handler serves the Default registry.
+func Handler() http.Handler {
+	return Default.Handler()
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// desc is the name, help and labels shared by the series of a family.
+type desc struct {
+	fqName string
+	help   string
+	typ    string
+	labels []string
+}
+
+func (d *desc) name() string {
+	return d.fqName
+}
+
+func (d *desc) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.fqName, escapeHelp(d.help), d.fqName, d.typ)
+}
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+// labelPairs formats names and values as {a="x",b="y"}, extra is appended as is.
+func labelPairs(names, values []string, extra string) string {
+	if len(names) == 0 && extra == "" {
+		return ""
+	}
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, n := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(n)
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(values[i]))
+		b.WriteByte('"')
+	}
+	if extra != "" {
+		if len(names) > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(extra)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// vec holds the series of a family by label values.
+type vec[T any] struct {
+	desc
+	mu       sync.RWMutex
+	children map[string]*series[T]
+	newT     func() T
+}
+
+type series[T any] struct {
+	values []string
+	m      T
+}
+
+func (v *vec[T]) with(values []string) T {
+	if len(values) != len(v.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", v.fqName, len(v.labels), len(values)))
+	}
+	key := strings.Join(values, "\xff")
+	v.mu.RLock()
+	s, ok := v.children[key]
+	v.mu.RUnlock()
+	if ok {
+		return s.m
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if s, ok = v.children[key]; !ok {
+		s = &series[T]{values: append([]string(nil), values...), m: v.newT()}
+		v.children[key] = s
+	}
+	return s.m
+}
+
+// sorted returns the series ordered by label values, for a stable output.
+func (v *vec[T]) sorted() []*series[T] {
+	v.mu.RLock()
+	ret := make([]*series[T], 0, len(v.children))
+	for _, s := range v.children {
+		ret = append(ret, s)
+	}
+	v.mu.RUnlock()
+	sort.Slice(ret, func(i, j int) bool {
+		return strings.Join(ret[i].values, "\xff") < strings.Join(ret[j].values, "\xff")
+	})
+	return ret
+}
+
+func newVec[T any](name, help, typ string, labels []string, newT func() T) *vec[T] {
+	return &vec[T]{
+		desc:     desc{fqName: name, help: help, typ: typ, labels: labels},
+		children: make(map[string]*series[T]),
+		newT:     newT,
+	}
+}
@@ -0,0 +1,55 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExposition(t *testing.T) {
+	r := NewRegistry()
+	reqs := r.NewCounterVec("test_requests_total", "requests by code\nand method", "code", "method")
+	reqs.With("200", "GET").Add(3)
+	reqs.With("500", `P"OST`).Inc()
+	g := r.NewGauge("test_active", "active things")
+	g.Inc()
+	g.Inc()
+	g.Dec()
+	h := r.NewHistogram("test_latency_seconds", "latency", []float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(5)
+	r.NewGaugeFunc("test_func", "read on scrape", func() float64 { return 1.5 })
+
+	var b strings.Builder
+	if _, err := r.WriteTo(&b); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP test_active active things
+# TYPE test_active gauge
+test_active 1
+# HELP test_func read on scrape
+# TYPE test_func gauge
+test_func 1.5
+# HELP test_latency_seconds latency
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{le="0.1"} 1
+test_latency_seconds_bucket{le="1"} 2
+test_latency_seconds_bucket{le="+Inf"} 3
+test_latency_seconds_sum 5.55
+test_latency_seconds_count 3
+# HELP test_requests_total requests by code\nand method
+# TYPE test_requests_total counter
+test_requests_total{code="200",method="GET"} 3
+test_requests_total{code="500",method="P\"OST"} 1
+`
+	if b.String() != want {
+		t.Fatalf("got\n%s\nwant\n%s", b.String(), want)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("duplicate name registered")
+		}
+	}()
+	r.NewCounter("test_active", "again")
+}
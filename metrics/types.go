@@ -0,0 +1,218 @@
+package metrics
+
+import (
+	"bufio"
+	"math"
+	"sort"
+	"sync/atomic"
+)
+
+// Counter only goes up.
+type Counter struct {
+	v uint64
+}
+
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.v, 1)
+}
+
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.v, n)
+}
+
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.v)
+}
+
+// Gauge goes up and down.
+type Gauge struct {
+	v int64
+}
+
+func (g *Gauge) Inc() {
+	atomic.AddInt64(&g.v, 1)
+}
+
+func (g *Gauge) Dec() {
+	atomic.AddInt64(&g.v, -1)
+}
+
+func (g *Gauge) Add(n int64) {
+	atomic.AddInt64(&g.v, n)
+}
+
+func (g *Gauge) Set(n int64) {
+	atomic.StoreInt64(&g.v, n)
+}
+
+func (g *Gauge) Value() int64 {
+	return atomic.LoadInt64(&g.v)
+}
+
+// Histogram counts observations into buckets by their upper bound.
+type Histogram struct {
+	upper  []float64
+	counts []uint64
+	count  uint64
+	// float64 bits
+	sum uint64
+}
+
+func newHistogram(buckets []float64) *Histogram {
+	upper := append([]float64(nil), buckets...)
+	sort.Float64s(upper)
+	return &Histogram{upper: upper, counts: make([]uint64, len(upper))}
+}
+
+func (h *Histogram) Observe(v float64) {
+	if i := sort.SearchFloat64s(h.upper, v); i < len(h.upper) {
+		atomic.AddUint64(&h.counts[i], 1)
+	}
+	atomic.AddUint64(&h.count, 1)
+	for {
+		old := atomic.LoadUint64(&h.sum)
+		if atomic.CompareAndSwapUint64(&h.sum, old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+func (h *Histogram) Count() uint64 {
+	return atomic.LoadUint64(&h.count)
+}
+
+func (h *Histogram) write(w *bufio.Writer, name string, labels, values []string) {
+	var cum uint64
+	for i, upper := range h.upper {
+		cum += atomic.LoadUint64(&h.counts[i])
+		w.WriteString(name + "_bucket" + labelPairs(labels, values, `le="`+formatFloat(upper)+`"`) + " " + formatUint(cum) + "\n")
+	}
+	count := atomic.LoadUint64(&h.count)
+	w.WriteString(name + "_bucket" + labelPairs(labels, values, `le="+Inf"`) + " " + formatUint(count) + "\n")
+	w.WriteString(name + "_sum" + labelPairs(labels, values, "") + " " + formatFloat(math.Float64frombits(atomic.LoadUint64(&h.sum))) + "\n")
+	w.WriteString(name + "_count" + labelPairs(labels, values, "") + " " + formatUint(count) + "\n")
+}
+
+func formatUint(v uint64) string {
+	return formatFloat(float64(v))
+}
+
+type CounterVec struct {
+	*vec[*Counter]
+}
+
+// With returns the counter of the label values, in the order the labels were declared.
+func (v CounterVec) With(values ...string) *Counter {
+	return v.with(values)
+}
+
+func (v CounterVec) write(w *bufio.Writer) {
+	v.writeHeader(w)
+	for _, s := range v.sorted() {
+		w.WriteString(v.fqName + labelPairs(v.labels, s.values, "") + " " + formatUint(s.m.Value()) + "\n")
+	}
+}
+
+type GaugeVec struct {
+	*vec[*Gauge]
+}
+
+func (v GaugeVec) With(values ...string) *Gauge {
+	return v.with(values)
+}
+
+func (v GaugeVec) write(w *bufio.Writer) {
+	v.writeHeader(w)
+	for _, s := range v.sorted() {
+		w.WriteString(v.fqName + labelPairs(v.labels, s.values, "") + " " + formatFloat(float64(s.m.Value())) + "\n")
+	}
+}
+
+type HistogramVec struct {
+	*vec[*Histogram]
+}
+
+func (v HistogramVec) With(values ...string) *Histogram {
+	return v.with(values)
+}
+
+func (v HistogramVec) write(w *bufio.Writer) {
+	v.writeHeader(w)
+	for _, s := range v.sorted() {
+		s.m.write(w, v.fqName, v.labels, s.values)
+	}
+}
+
+// gaugeFunc reads its value when written out.
+type gaugeFunc struct {
+	desc
+	f func() float64
+}
+
+func (g *gaugeFunc) write(w *bufio.Writer) {
+	g.writeHeader(w)
+	w.WriteString(g.fqName + " " + formatFloat(g.f()) + "\n")
+}
+
+func (r *Registry) NewCounterVec(name, help string, labels ...string) CounterVec {
+	ret := CounterVec{newVec(name, help, "counter", labels, func() *Counter { return &Counter{} })}
+	r.register(ret)
+	return ret
+}
+
+func (r *Registry) NewGaugeVec(name, help string, labels ...string) GaugeVec {
+	ret := GaugeVec{newVec(name, help, "gauge", labels, func() *Gauge { return &Gauge{} })}
+	r.register(ret)
+	return ret
+}
+
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) HistogramVec {
+	ret := HistogramVec{newVec(name, help, "histogram", labels, func() *Histogram { return newHistogram(buckets) })}
+	r.register(ret)
+	return ret
+}
+
+func (r *Registry) NewCounter(name, help string) *Counter {
+	return r.NewCounterVec(name, help).With()
+}
+
+func (r *Registry) NewGauge(name, help string) *Gauge {
+	return r.NewGaugeVec(name, help).With()
+}
+
+func (r *Registry) NewHistogram(name, help string, buckets []float64) *Histogram {
+	return r.NewHistogramVec(name, help, buckets).With()
+}
+
+// NewGaugeFunc registers a gauge whose value is f at the time of every scrape.
+func (r *Registry) NewGaugeFunc(name, help string, f func() float64) {
+	r.register(&gaugeFunc{desc: desc{fqName: name, help: help, typ: "gauge"}, f: f})
+}
+
+func NewCounterVec(name, help string, labels ...string) CounterVec {
+	return Default.NewCounterVec(name, help, labels...)
+}
+
+func NewGaugeVec(name, help string, labels ...string) GaugeVec {
+	return Default.NewGaugeVec(name, help, labels...)
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) HistogramVec {
+	return Default.NewHistogramVec(name, help, buckets, labels...)
+}
+
+func NewCounter(name, help string) *Counter {
+	return Default.NewCounter(name, help)
+}
+
+func NewGauge(name, help string) *Gauge {
+	return Default.NewGauge(name, help)
+}
+
+func NewHistogram(name, help string, buckets []float64) *Histogram {
+	return Default.NewHistogram(name, help, buckets)
+}
+
+func NewGaugeFunc(name, help string, f func() float64) {
+	Default.NewGaugeFunc(name, help, f)
+}
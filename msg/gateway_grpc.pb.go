@@ -0,0 +1,238 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.5.1
+// - protoc             (unknown)
+// source: msg/gateway.proto
+
+package msg
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.64.0 or later.
+const _ = grpc.SupportPackageIsVersion9
+
+const (
+	Route_SendToUser_FullMethodName = "/route.Route/SendToUser"
+	Route_Broadcast_FullMethodName  = "/route.Route/Broadcast"
+	Route_Presence_FullMethodName   = "/route.Route/Presence"
+	Route_Stream_FullMethodName     = "/route.Route/Stream"
+)
+
+// RouteClient is the client API for Route service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+//
+// Route lets services push messages into route without holding a session,
+// or hold one over Stream.
+type RouteClient interface {
+	SendToUser(ctx context.Context, in *SendToUserRequest, opts ...grpc.CallOption) (*SendResponse, error)
+	Broadcast(ctx context.Context, in *BroadcastRequest, opts ...grpc.CallOption) (*SendResponse, error)
+	Presence(ctx context.Context, in *PresenceRequest, opts ...grpc.CallOption) (*PresenceResponse, error)
+	// Stream carries the same packet stream as a tcp connection, handshake and auth included.
+	Stream(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[Frame, Frame], error)
+}
+
+type routeClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewRouteClient(cc grpc.ClientConnInterface) RouteClient {
+	return &routeClient{cc}
+}
+
+func (c *routeClient) SendToUser(ctx context.Context, in *SendToUserRequest, opts ...grpc.CallOption) (*SendResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(SendResponse)
+	err := c.cc.Invoke(ctx, Route_SendToUser_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *routeClient) Broadcast(ctx context.Context, in *BroadcastRequest, opts ...grpc.CallOption) (*SendResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(SendResponse)
+	err := c.cc.Invoke(ctx, Route_Broadcast_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *routeClient) Presence(ctx context.Context, in *PresenceRequest, opts ...grpc.CallOption) (*PresenceResponse, error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	out := new(PresenceResponse)
+	err := c.cc.Invoke(ctx, Route_Presence_FullMethodName, in, out, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *routeClient) Stream(ctx context.Context, opts ...grpc.CallOption) (grpc.BidiStreamingClient[Frame, Frame], error) {
+	cOpts := append([]grpc.CallOption{grpc.StaticMethod()}, opts...)
+	stream, err := c.cc.NewStream(ctx, &Route_ServiceDesc.Streams[0], Route_Stream_FullMethodName, cOpts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &grpc.GenericClientStream[Frame, Frame]{ClientStream: stream}
+	return x, nil
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Route_StreamClient = grpc.BidiStreamingClient[Frame, Frame]
+
+// RouteServer is the server API for Route service.
+// All implementations must embed UnimplementedRouteServer
+// for forward compatibility.
+//
+// Route lets services push messages into route without holding a session,
+// or hold one over Stream.
+type RouteServer interface {
+	SendToUser(context.Context, *SendToUserRequest) (*SendResponse, error)
+	Broadcast(context.Context, *BroadcastRequest) (*SendResponse, error)
+	Presence(context.Context, *PresenceRequest) (*PresenceResponse, error)
+	// Stream carries the same packet stream as a tcp connection, handshake and auth included.
+	Stream(grpc.BidiStreamingServer[Frame, Frame]) error
+	mustEmbedUnimplementedRouteServer()
+}
+
+// UnimplementedRouteServer must be embedded to have
+// forward compatible implementations.
+//
+// NOTE: this should be embedded by value instead of pointer to avoid a nil
+// pointer dereference when methods are called.
+type UnimplementedRouteServer struct{}
+
+func (UnimplementedRouteServer) SendToUser(context.Context, *SendToUserRequest) (*SendResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SendToUser not implemented")
+}
+func (UnimplementedRouteServer) Broadcast(context.Context, *BroadcastRequest) (*SendResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Broadcast not implemented")
+}
+func (UnimplementedRouteServer) Presence(context.Context, *PresenceRequest) (*PresenceResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Presence not implemented")
+}
+func (UnimplementedRouteServer) Stream(grpc.BidiStreamingServer[Frame, Frame]) error {
+	return status.Errorf(codes.Unimplemented, "method Stream not implemented")
+}
+func (UnimplementedRouteServer) mustEmbedUnimplementedRouteServer() {}
+func (UnimplementedRouteServer) testEmbeddedByValue()               {}
+
+// UnsafeRouteServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to RouteServer will
+// result in compilation errors.
+type UnsafeRouteServer interface {
+	mustEmbedUnimplementedRouteServer()
+}
+
+func RegisterRouteServer(s grpc.ServiceRegistrar, srv RouteServer) {
+	// If the following call pancis, it indicates UnimplementedRouteServer was
+	// embedded by pointer and is nil.  This will cause panics if an
+	// unimplemented method is ever invoked, so we test this at initialization
+	// time to prevent it from happening at runtime later due to I/O.
+	if t, ok := srv.(interface{ testEmbeddedByValue() }); ok {
+		t.testEmbeddedByValue()
+	}
+	s.RegisterService(&Route_ServiceDesc, srv)
+}
+
+func _Route_SendToUser_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SendToUserRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RouteServer).SendToUser(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Route_SendToUser_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RouteServer).SendToUser(ctx, req.(*SendToUserRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Route_Broadcast_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BroadcastRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RouteServer).Broadcast(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Route_Broadcast_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RouteServer).Broadcast(ctx, req.(*BroadcastRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Route_Presence_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PresenceRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(RouteServer).Presence(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Route_Presence_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(RouteServer).Presence(ctx, req.(*PresenceRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Route_Stream_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(RouteServer).Stream(&grpc.GenericServerStream[Frame, Frame]{ServerStream: stream})
+}
+
+// This type alias is provided for backwards compatibility with existing code that references the prior non-generic stream type by name.
+type Route_StreamServer = grpc.BidiStreamingServer[Frame, Frame]
+
+// Route_ServiceDesc is the grpc.ServiceDesc for Route service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Route_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "route.Route",
+	HandlerType: (*RouteServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "SendToUser",
+			Handler:    _Route_SendToUser_Handler,
+		},
+		{
+			MethodName: "Broadcast",
+			Handler:    _Route_Broadcast_Handler,
+		},
+		{
+			MethodName: "Presence",
+			Handler:    _Route_Presence_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Stream",
+			Handler:       _Route_Stream_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+	},
+	Metadata: "msg/gateway.proto",
+}
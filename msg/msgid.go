@@ -0,0 +1,41 @@
+package msg
+
+import (
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+)
+
+var (
+	msgidOnce  sync.Once
+	msgidTypes map[int32]protoreflect.MessageType
+)
+
+// NewMessageByID returns an empty message of the type whose nested MSGID enum has the ID value,
+// nil when no message of route.proto declares it.
+func NewMessageByID(id int32) proto.Message {
+	msgidOnce.Do(func() {
+		msgidTypes = make(map[int32]protoreflect.MessageType)
+		msgs := File_msg_route_proto.Messages()
+		for i := 0; i < msgs.Len(); i++ {
+			md := msgs.Get(i)
+			enum := md.Enums().ByName("MSGID")
+			if enum == nil {
+				continue
+			}
+			v := enum.Values().ByName("ID")
+			if v == nil {
+				continue
+			}
+			if mt, err := protoregistry.GlobalTypes.FindMessageByName(md.FullName()); err == nil {
+				msgidTypes[int32(v.Number())] = mt
+			}
+		}
+	})
+	if mt, ok := msgidTypes[id]; ok {
+		return mt.New().Interface()
+	}
+	return nil
+}
@@ -0,0 +1,224 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type AdmissionOptions struct {
+	// live connections, handshaking ones included. 0 means unlimited
+	MaxConns int
+	// connections in handshake at the same time. 0 means unlimited
+	MaxHandshakes int
+	// accepted connections per second over all peers
+	AcceptRate RateLimit
+	// ips or cidrs, when Allow is not empty only matching peers are let in. Deny wins over Allow
+	Allow []string
+	Deny  []string
+}
+
+// Validate tells what SetAdmission of a listener would refuse.
+func (o AdmissionOptions) Validate() error {
+	if _, err := ParseIPNetList(o.Allow); err != nil {
+		return err
+	}
+	_, err := ParseIPNetList(o.Deny)
+	return err
+}
+
+// reasons a connection is turned away
+const (
+	RejectAcceptRate    = "accept_rate"
+	RejectDenied        = "denied"
+	RejectMaxConns      = "max_conns"
+	RejectMaxHandshakes = "max_handshakes"
+	RejectIPLimit       = "ip_limit"
+	RejectHandshake     = "handshake"
+	RejectProxyHeader   = "proxy_header"
+)
+
+var rejectReasons = [...]string{RejectAcceptRate, RejectDenied, RejectMaxConns, RejectMaxHandshakes, RejectIPLimit, RejectHandshake, RejectProxyHeader}
+
+type IPNetList []*net.IPNet
+
+// ParseIPNetList parses ips and cidrs, a plain ip matches only itself.
+func ParseIPNetList(list []string) (IPNetList, error) {
+	ret := make(IPNetList, 0, len(list))
+	for _, v := range list {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid ip %q", v)
+			}
+			bits := 32
+			if ip.To4() == nil {
+				bits = 128
+			}
+			v = fmt.Sprintf("%s/%d", v, bits)
+		}
+		_, ipnet, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, ipnet)
+	}
+	return ret, nil
+}
+
+func (l IPNetList) Contains(ip net.IP) bool {
+	for _, n := range l {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+type admission struct {
+	rules  atomic.Pointer[admissionRules]
+	logger *slog.Logger
+
+	conns      int64
+	handshakes int64
+
+	rejected   [len(rejectReasons)]uint64
+	logMu      sync.Mutex
+	loggedAt   map[string]time.Time
+	suppressed map[string]int
+}
+
+// admissionRules are the parts of AdmissionOptions replaced at once by setOptions,
+// the counters of the admission carry over.
+type admissionRules struct {
+	opts       AdmissionOptions
+	allow      IPNetList
+	deny       IPNetList
+	acceptRate *TokenBucket
+}
+
+func newAdmission(opts AdmissionOptions) (*admission, error) {
+	ret := &admission{
+		logger:     slog.Default(),
+		loggedAt:   make(map[string]time.Time),
+		suppressed: make(map[string]int),
+	}
+	if err := ret.setOptions(opts); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (a *admission) setOptions(opts AdmissionOptions) error {
+	allow, err := ParseIPNetList(opts.Allow)
+	if err != nil {
+		return err
+	}
+	deny, err := ParseIPNetList(opts.Deny)
+	if err != nil {
+		return err
+	}
+	a.rules.Store(&admissionRules{
+		opts:       opts,
+		allow:      allow,
+		deny:       deny,
+		acceptRate: NewTokenBucket(opts.AcceptRate),
+	})
+	return nil
+}
+
+func ipOf(addr net.Addr) net.IP {
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP
+	}
+	return net.ParseIP(hostOf(addr))
+}
+
+// admitConn runs in the accept loop, before anything is spent on the connection.
+func (a *admission) admitConn() string {
+	rules := a.rules.Load()
+	if !rules.acceptRate.Allow() {
+		return RejectAcceptRate
+	}
+	n := atomic.AddInt64(&a.conns, 1)
+	if rules.opts.MaxConns > 0 && n > int64(rules.opts.MaxConns) {
+		atomic.AddInt64(&a.conns, -1)
+		return RejectMaxConns
+	}
+	return ""
+}
+
+// allowed applies the ip filters, to the proxied address when there is one.
+func (a *admission) allowed(addr net.Addr) bool {
+	ip := ipOf(addr)
+	if ip == nil {
+		return true
+	}
+	rules := a.rules.Load()
+	return !rules.deny.Contains(ip) && (len(rules.allow) == 0 || rules.allow.Contains(ip))
+}
+
+func (a *admission) connDone() {
+	atomic.AddInt64(&a.conns, -1)
+}
+
+func (a *admission) enterHandshake() bool {
+	n := atomic.AddInt64(&a.handshakes, 1)
+	if max := a.rules.Load().opts.MaxHandshakes; max > 0 && n > int64(max) {
+		atomic.AddInt64(&a.handshakes, -1)
+		return false
+	}
+	return true
+}
+
+func (a *admission) leaveHandshake() {
+	atomic.AddInt64(&a.handshakes, -1)
+}
+
+// reject counts the rejection and logs it, at most once a second per reason.
+func (a *admission) reject(reason string, addr net.Addr) {
+	metricRejects.With(reason).Inc()
+	for i, r := range rejectReasons {
+		if r == reason {
+			atomic.AddUint64(&a.rejected[i], 1)
+		}
+	}
+
+	a.logMu.Lock()
+	defer a.logMu.Unlock()
+	now := time.Now()
+	if now.Sub(a.loggedAt[reason]) < time.Second {
+		a.suppressed[reason]++
+		return
+	}
+	a.logger.Warn("connection rejected", "remote", addrString(addr), "reason", reason, "suppressed", a.suppressed[reason])
+	a.loggedAt[reason] = now
+	a.suppressed[reason] = 0
+}
+
+// AdmissionStats are the counters of turned away connections, by reason, and the live ones.
+type AdmissionStats struct {
+	Conns      int64
+	Handshakes int64
+	Rejected   map[string]uint64
+}
+
+func (a *admission) stats() AdmissionStats {
+	ret := AdmissionStats{
+		Conns:      atomic.LoadInt64(&a.conns),
+		Handshakes: atomic.LoadInt64(&a.handshakes),
+		Rejected:   make(map[string]uint64, len(rejectReasons)),
+	}
+	for i, r := range rejectReasons {
+		ret.Rejected[r] = atomic.LoadUint64(&a.rejected[i])
+	}
+	return ret
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"net"
+	"testing"
+)
+
+func TestAdmission(t *testing.T) {
+	if _, err := newAdmission(AdmissionOptions{Deny: []string{"10.0.0.300"}}); err == nil {
+		t.Fatalf("invalid ip accepted")
+	}
+
+	a, err := newAdmission(AdmissionOptions{
+		MaxConns: 2,
+		Allow:    []string{"10.0.0.0/8", "192.168.1.7"},
+		Deny:     []string{"10.1.0.0/16"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := func(ip string) net.Addr {
+		return &net.TCPAddr{IP: net.ParseIP(ip), Port: 1000}
+	}
+
+	if a.allowed(addr("10.1.2.3")) {
+		t.Fatalf("denied cidr admitted")
+	}
+	if a.allowed(addr("192.168.1.8")) {
+		t.Fatalf("ip outside allow list admitted")
+	}
+	if !a.allowed(addr("192.168.1.7")) || !a.allowed(addr("10.2.0.1")) {
+		t.Fatalf("allowed peers rejected")
+	}
+	if a.admitConn() != "" || a.admitConn() != "" {
+		t.Fatalf("conns under the limit rejected")
+	}
+	if r := a.admitConn(); r != RejectMaxConns {
+		t.Fatalf("max conns not applied: %q", r)
+	}
+	a.connDone()
+	if a.admitConn() != "" {
+		t.Fatalf("freed slot not reused")
+	}
+
+	a.reject(RejectMaxConns, addr("10.2.0.2"))
+	if st := a.stats(); st.Rejected[RejectMaxConns] != 1 || st.Conns != 2 {
+		t.Fatalf("unexpected stats %+v", st)
+	}
+
+	// new rules apply at once, live connections are still counted
+	if err := a.setOptions(AdmissionOptions{MaxConns: 3, Deny: []string{"bad"}}); err == nil {
+		t.Fatalf("invalid rules accepted")
+	}
+	if err := a.setOptions(AdmissionOptions{MaxConns: 3}); err != nil {
+		t.Fatal(err)
+	}
+	if !a.allowed(addr("192.168.1.8")) || a.admitConn() != "" || a.admitConn() != RejectMaxConns {
+		t.Fatalf("replaced rules not applied")
+	}
+}
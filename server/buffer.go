@@ -0,0 +1,64 @@
+package server
+
+import (
+	"math/bits"
+	"sync"
+)
+
+// bodies are pooled in power of two classes from 64B up to 64KB, bigger ones are left to the gc
+const (
+	minBufferClassBits = 6
+	maxBufferClassBits = 16
+)
+
+var bufferPools [maxBufferClassBits - minBufferClassBits + 1]sync.Pool
+
+func bufferClass(n int) int {
+	if n <= 1<<minBufferClassBits {
+		return 0
+	}
+	return bits.Len(uint(n-1)) - minBufferClassBits
+}
+
+// getBuffer returns a pooled buffer of length n, or nil when n is too big to be pooled.
+func getBuffer(n int) *[]byte {
+	c := bufferClass(n)
+	if c >= len(bufferPools) {
+		return nil
+	}
+	if v := bufferPools[c].Get(); v != nil {
+		buf := v.(*[]byte)
+		*buf = (*buf)[:n]
+		return buf
+	}
+	buf := make([]byte, n, 1<<(c+minBufferClassBits))
+	return &buf
+}
+
+func putBuffer(buf *[]byte) {
+	c := bufferClass(cap(*buf))
+	if c >= len(bufferPools) || cap(*buf) != 1<<(c+minBufferClassBits) {
+		return
+	}
+	bufferPools[c].Put(buf)
+}
+
+// Retainer is implemented by packets which may hold pooled buffers.
+// a packet read with pooling starts with one reference owned by the reader,
+// every holder keeping it beyond the callback it was handed in must Retain it and Release it when done.
+type Retainer interface {
+	Retain()
+	Release()
+}
+
+func retainPacket(p Packet) {
+	if r, ok := p.(Retainer); ok {
+		r.Retain()
+	}
+}
+
+func releasePacket(p Packet) {
+	if r, ok := p.(Retainer); ok {
+		r.Release()
+	}
+}
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// a capture file starts with captureMagic and the format version, then holds one record per packet:
+// 8 bytes unix nanoseconds, 1 byte direction, 1 byte session id length, the session id
+// and the packet as WritePacket writes it.
+// packets are recorded as the application sends and receives them, before compression and fragmentation.
+const (
+	captureMagic   = "RCAP"
+	captureVersion = 1
+)
+
+var ErrInvalidCapture = errors.New("invalid capture file")
+
+type CaptureDirection byte
+
+const (
+	CaptureIn CaptureDirection = iota
+	CaptureOut
+)
+
+func (d CaptureDirection) String() string {
+	if d == CaptureIn {
+		return "in"
+	}
+	return "out"
+}
+
+// Capture records the packets of the sessions it is given to, safe for concurrent use.
+// a nil Capture records nothing.
+type Capture struct {
+	mu  sync.Mutex
+	w   io.Writer
+	buf bytes.Buffer
+	err error
+}
+
+// NewCapture writes the file header to w and records into it.
+func NewCapture(w io.Writer) (*Capture, error) {
+	if _, err := w.Write(append([]byte(captureMagic), captureVersion)); err != nil {
+		return nil, err
+	}
+	return &Capture{w: w}, nil
+}
+
+// CreateCapture records into a new file at path.
+func CreateCapture(path string) (*Capture, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	c, err := NewCapture(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Record appends p, the first write error stops the capture and is kept for Err.
+func (c *Capture) Record(sid string, dir CaptureDirection, p Packet) {
+	if c == nil {
+		return
+	}
+	if len(sid) > 255 {
+		sid = sid[:255]
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.buf.Reset()
+	var head [10]byte
+	binary.LittleEndian.PutUint64(head[:8], uint64(time.Now().UnixNano()))
+	head[8] = byte(dir)
+	head[9] = byte(len(sid))
+	c.buf.Write(head[:])
+	c.buf.WriteString(sid)
+	if _, err := WritePacket(&c.buf, p); err != nil {
+		// the packet can not be encoded, nothing of it is written
+		return
+	}
+	_, c.err = c.w.Write(c.buf.Bytes())
+}
+
+func (c *Capture) Err() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err
+}
+
+// Close stops recording and closes the underlying writer when it is a Closer.
+func (c *Capture) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err == nil {
+		c.err = os.ErrClosed
+	}
+	if closer, ok := c.w.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+type CaptureRecord struct {
+	Time      time.Time
+	SessionID string
+	Dir       CaptureDirection
+	Packet    Packet
+}
+
+type CaptureReader struct {
+	r *bufio.Reader
+}
+
+// NewCaptureReader checks the file header and reads records from r.
+func NewCaptureReader(r io.Reader) (*CaptureReader, error) {
+	br := bufio.NewReader(r)
+	head := make([]byte, len(captureMagic)+1)
+	if _, err := io.ReadFull(br, head); err != nil {
+		return nil, ErrInvalidCapture
+	}
+	if string(head[:len(captureMagic)]) != captureMagic {
+		return nil, ErrInvalidCapture
+	}
+	if head[len(captureMagic)] != captureVersion {
+		return nil, fmt.Errorf("%w: version %d", ErrInvalidCapture, head[len(captureMagic)])
+	}
+	return &CaptureReader{r: br}, nil
+}
+
+// Next returns the next record, io.EOF after the last one.
+func (cr *CaptureReader) Next() (*CaptureRecord, error) {
+	var head [10]byte
+	if _, err := io.ReadFull(cr.r, head[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = ErrInvalidCapture
+		}
+		return nil, err
+	}
+	sid := make([]byte, head[9])
+	if _, err := io.ReadFull(cr.r, sid); err != nil {
+		return nil, ErrInvalidCapture
+	}
+	p, err := ReadPacket(cr.r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidCapture, err)
+	}
+	return &CaptureRecord{
+		Time:      time.Unix(0, int64(binary.LittleEndian.Uint64(head[:8]))),
+		SessionID: string(sid),
+		Dir:       CaptureDirection(head[8]),
+		Packet:    p,
+	}, nil
+}
+
+var hvFlagNames = map[byte]string{
+	hvPacketFlagHandShake:     "handshake",
+	hvPacketFlagActionRequire: "action-require",
+	hvPacketFlagDoAction:      "do-action",
+	hvPacketFlagAckResult:     "ack-result",
+	HVPacketFlagHeartbeat:     "heartbeat",
+	HVPacketFlagEcho:          "echo",
+	HVPacketFlagMessage:       "message",
+	hvPacketFlagReject:        "reject",
+	HVPacketFlagPing:          "ping",
+	HVPacketFlagPong:          "pong",
+}
+
+var routeMsgtypeNames = [...]string{"async", "request", "response", "resp-err"}
+
+// DescribePacket summarizes the head of p in one line, bodies are left to the caller.
+func DescribePacket(p Packet) string {
+	switch p := p.(type) {
+	case *HVPacket:
+		name, ok := hvFlagNames[p.GetFlag()]
+		if !ok {
+			name = fmt.Sprintf("0x%02x", p.GetFlag())
+		}
+		return fmt.Sprintf("hv %s len=%d", name, len(p.GetBody()))
+	case *RoutePacket:
+		typ := fmt.Sprintf("msgtype-%d", p.GetMsgtype())
+		if int(p.GetMsgtype()) < len(routeMsgtypeNames) {
+			typ = routeMsgtypeNames[p.GetMsgtype()]
+		}
+		var b strings.Builder
+		fmt.Fprintf(&b, "route %s uid=%d len=%d", typ, p.GetUid(), len(p.Body))
+		if p.HasFlag(RouteFlagCompressed) {
+			b.WriteString(" compressed")
+		}
+		if p.HasFlag(RouteFlagFragment) {
+			b.WriteString(" fragment")
+		}
+		if p.GetPriority() != PriorityNormal {
+			fmt.Fprintf(&b, " priority=%s", p.GetPriority())
+		}
+		if p.GetTrace().IsValid() {
+			fmt.Fprintf(&b, " traceparent=%s", p.GetTrace())
+		}
+		return b.String()
+	}
+	return fmt.Sprintf("packet type %d", p.PacketType())
+}
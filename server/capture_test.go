@@ -0,0 +1,90 @@
+package server
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCapture(t *testing.T) {
+	buf := &bytes.Buffer{}
+	capture, err := NewCapture(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoed := make(chan struct{}, 1)
+	svr, err := NewTcpServer(TcpServerOptions{
+		ListenAddr: "127.0.0.1:0",
+		Capture:    capture,
+		OnSessionPacket: func(s Session, p Packet) {
+			if rp, ok := p.(*RoutePacket); ok {
+				s.Send(rp.Clone())
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	svr.Start()
+
+	cli := NewTcpClient(TcpClientOptions{
+		RemoteAddress:        svr.Address().String(),
+		ReconnectDelaySecond: -1,
+		OnSessionPacket: func(s Session, p Packet) {
+			if _, ok := p.(*RoutePacket); ok {
+				echoed <- struct{}{}
+			}
+		},
+	})
+	if err := cli.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	p := NewRoutePacket()
+	p.SetMsgtype(RouteTypRequest)
+	p.SetPriority(PriorityHigh)
+	p.Body = []byte("replay me")
+	cli.Send(p)
+	select {
+	case <-echoed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("echo never arrived")
+	}
+	cli.Close()
+	svr.Stop()
+	// sessions may still be winding down, nothing is recorded past Close
+	capture.Close()
+
+	cr, err := NewCaptureReader(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var routes []*CaptureRecord
+	for {
+		r, err := cr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := r.Packet.(*RoutePacket); ok {
+			routes = append(routes, r)
+		}
+	}
+	if len(routes) != 2 || routes[0].Dir != CaptureIn || routes[1].Dir != CaptureOut || routes[0].SessionID != routes[1].SessionID {
+		t.Fatalf("unexpected records %+v", routes)
+	}
+	got := routes[0].Packet.(*RoutePacket)
+	if string(got.Body) != "replay me" || got.GetPriority() != PriorityHigh {
+		t.Fatalf("unexpected packet %q %v", got.Body, got.GetPriority())
+	}
+	if d := DescribePacket(got); !strings.HasPrefix(d, "route request uid=0 len=9 priority=high") {
+		t.Fatalf("describe %q", d)
+	}
+
+	if _, err := NewCaptureReader(strings.NewReader("PCAP\x01")); err == nil {
+		t.Fatal("foreign file accepted")
+	}
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"errors"
+	"io"
+	"sync"
+)
+
+type CompressAlgo uint8
+
+const (
+	CompressNone    CompressAlgo = 0
+	CompressDeflate CompressAlgo = 1 << 0
+	CompressGzip    CompressAlgo = 1 << 1
+)
+
+// SupportedCompressions in order of preference.
+var SupportedCompressions = []CompressAlgo{CompressDeflate, CompressGzip}
+
+const DefaultCompressThreshold = 512
+
+var ErrUnknownCompression = errors.New("unknown compression")
+var ErrDecompressTooLarge = errors.New("decompressed body too large")
+
+func (a CompressAlgo) String() string {
+	switch a {
+	case CompressNone:
+		return "none"
+	case CompressDeflate:
+		return "deflate"
+	case CompressGzip:
+		return "gzip"
+	}
+	return "unknown"
+}
+
+func allCompressions() CompressAlgo {
+	var ret CompressAlgo
+	for _, a := range SupportedCompressions {
+		ret |= a
+	}
+	return ret
+}
+
+// chooseCompression picks the most preferred algorithm offered by both sides.
+func chooseCompression(local, remote CompressAlgo) CompressAlgo {
+	for _, a := range SupportedCompressions {
+		if local&a != 0 && remote&a != 0 {
+			return a
+		}
+	}
+	return CompressNone
+}
+
+var (
+	deflateWriters sync.Pool
+	gzipWriters    sync.Pool
+)
+
+func compressBody(algo CompressAlgo, data []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, len(data)/2))
+	switch algo {
+	case CompressDeflate:
+		w, _ := deflateWriters.Get().(*flate.Writer)
+		if w == nil {
+			w, _ = flate.NewWriter(buf, flate.BestSpeed)
+		} else {
+			w.Reset(buf)
+		}
+		defer deflateWriters.Put(w)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	case CompressGzip:
+		w, _ := gzipWriters.Get().(*gzip.Writer)
+		if w == nil {
+			w, _ = gzip.NewWriterLevel(buf, gzip.BestSpeed)
+		} else {
+			w.Reset(buf)
+		}
+		defer gzipWriters.Put(w)
+		if _, err := w.Write(data); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, ErrUnknownCompression
+	}
+	return buf.Bytes(), nil
+}
+
+func decompressBody(algo CompressAlgo, data []byte, limit int64) ([]byte, error) {
+	var r io.ReadCloser
+	switch algo {
+	case CompressDeflate:
+		r = flate.NewReader(bytes.NewReader(data))
+	case CompressGzip:
+		gr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		r = gr
+	default:
+		return nil, ErrUnknownCompression
+	}
+	defer r.Close()
+
+	ret, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(ret)) > limit {
+		return nil, ErrDecompressTooLarge
+	}
+	return ret, nil
+}
+
+// compressPacket returns a compressed copy of p, or p itself when compression does not pay off.
+func compressPacket(algo CompressAlgo, threshold int, p *RoutePacket) *RoutePacket {
+	if algo == CompressNone || len(p.Body) < threshold || p.HasFlag(RouteFlagCompressed) {
+		return p
+	}
+	body, err := compressBody(algo, p.Body)
+	if err != nil || len(body) >= len(p.Body) {
+		return p
+	}
+	ret := p.Clone()
+	ret.Body = body
+	ret.SetFlag(RouteFlagCompressed, true)
+	return ret
+}
+
+func decompressPacket(algo CompressAlgo, p *RoutePacket, limit int64) error {
+	if !p.HasFlag(RouteFlagCompressed) {
+		return nil
+	}
+	if algo == CompressNone {
+		return ErrInvalidPacket
+	}
+	body, err := decompressBody(algo, p.Body, limit)
+	if err != nil {
+		return err
+	}
+	p.detachBody(body)
+	p.SetFlag(RouteFlagCompressed, false)
+	return nil
+}
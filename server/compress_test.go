@@ -0,0 +1,88 @@
+package server
+
+import (
+	"bytes"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCompressPacket(t *testing.T) {
+	body := bytes.Repeat([]byte("telemetry,"), 200)
+	for _, algo := range SupportedCompressions {
+		p := NewRoutePacket()
+		p.SetMsgtype(3)
+		p.Body = body
+
+		cp := compressPacket(algo, DefaultCompressThreshold, p)
+		if cp == p || !cp.HasFlag(RouteFlagCompressed) || len(cp.Body) >= len(body) {
+			t.Fatalf("%v: packet not compressed", algo)
+		}
+		if p.HasFlag(RouteFlagCompressed) {
+			t.Fatalf("%v: source packet modified", algo)
+		}
+		if err := decompressPacket(algo, cp, MaxPacketBodyLen); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(cp.Body, body) || cp.GetMsgtype() != 3 || cp.HasFlag(RouteFlagCompressed) {
+			t.Fatalf("%v: roundtrip mismatch", algo)
+		}
+	}
+
+	small := NewRoutePacket()
+	small.Body = []byte("tiny")
+	if compressPacket(CompressDeflate, DefaultCompressThreshold, small) != small {
+		t.Fatalf("packet below threshold should stay raw")
+	}
+}
+
+func TestCompressSession(t *testing.T) {
+	body := bytes.Repeat([]byte("telemetry,"), 400)
+	recv := make(chan *RoutePacket, 1)
+
+	svr, err := NewTcpServer(TcpServerOptions{
+		ListenAddr:   "127.0.0.1:0",
+		Compressions: CompressGzip,
+		OnSessionPacket: func(s Session, p Packet) {
+			if rp, ok := p.(*RoutePacket); ok {
+				recv <- rp
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	svr.Start()
+	defer svr.Stop()
+
+	cli := NewTcpClient(TcpClientOptions{
+		RemoteAddress:        svr.Address().String(),
+		ReconnectDelaySecond: -1,
+	})
+	if err := cli.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	if cli.Compression() != CompressGzip {
+		t.Fatalf("compression %v, want gzip", cli.Compression())
+	}
+
+	p := NewRoutePacket()
+	p.Body = body
+	if err := cli.Send(p); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case rp := <-recv:
+		if !bytes.Equal(rp.Body, body) {
+			t.Fatalf("body mismatch")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+	if n := atomic.LoadInt64(&cli.writeSize); n >= int64(len(body)) {
+		t.Fatalf("wrote %d bytes, body not compressed", n)
+	}
+}
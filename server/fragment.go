@@ -0,0 +1,141 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+const (
+	DefaultFragmentSize       = 1 << 20
+	DefaultMaxReassemblyBytes = 64 << 20
+	// a message without a new fragment for this long is dropped, its peer gave up on it
+	reassemblyTimeout = 30 * time.Second
+)
+
+// every fragment body starts with id, total length and offset of the chunk
+const fragmentHeadLen = 12
+
+var ErrBodyTooLarge = errors.New("packet body too large")
+var ErrReassemblyLimit = errors.New("reassembly memory limit exceeded")
+
+// splitPacket cuts p into fragments carrying at most size bytes of body each.
+func splitPacket(p *RoutePacket, id uint32, size int) []*RoutePacket {
+	total := len(p.Body)
+	ret := make([]*RoutePacket, 0, (total+size-1)/size)
+	for offset := 0; offset < total; offset += size {
+		end := offset + size
+		if end > total {
+			end = total
+		}
+		frag := p.Clone()
+		frag.SetFlag(RouteFlagFragment, true)
+		frag.Body = make([]byte, fragmentHeadLen+end-offset)
+		binary.LittleEndian.PutUint32(frag.Body[0:4], id)
+		binary.LittleEndian.PutUint32(frag.Body[4:8], uint32(total))
+		binary.LittleEndian.PutUint32(frag.Body[8:12], uint32(offset))
+		copy(frag.Body[fragmentHeadLen:], p.Body[offset:end])
+		ret = append(ret, frag)
+	}
+	return ret
+}
+
+type fragmentBuf struct {
+	total int
+	body  []byte
+	// arrival of the last fragment
+	touched time.Time
+}
+
+// reassembler collects fragments of one session.
+// fragments of a message arrive in order, but may interleave with other messages.
+// size counts the declared totals of pending messages, buffers only grow with the fragments received.
+type reassembler struct {
+	limit   int
+	size    int
+	pending map[uint32]*fragmentBuf
+	sweepAt time.Time
+}
+
+func newReassembler(limit int) *reassembler {
+	return &reassembler{
+		limit:   limit,
+		pending: make(map[uint32]*fragmentBuf),
+	}
+}
+
+// add returns the whole packet once its last fragment arrived, nil before that.
+func (r *reassembler) add(p *RoutePacket) (*RoutePacket, error) {
+	if len(p.Body) < fragmentHeadLen {
+		return nil, ErrInvalidPacket
+	}
+	id := binary.LittleEndian.Uint32(p.Body[0:4])
+	total := int(binary.LittleEndian.Uint32(p.Body[4:8]))
+	offset := int(binary.LittleEndian.Uint32(p.Body[8:12]))
+	chunk := p.Body[fragmentHeadLen:]
+
+	now := time.Now()
+	r.sweep(now)
+	buf, has := r.pending[id]
+	if !has {
+		if offset != 0 {
+			return nil, ErrInvalidPacket
+		}
+		if r.size+total > r.limit {
+			return nil, ErrReassemblyLimit
+		}
+		buf = &fragmentBuf{total: total}
+		r.pending[id] = buf
+		r.size += total
+	}
+
+	if buf.total != total || offset != len(buf.body) || offset+len(chunk) > total {
+		return nil, ErrInvalidPacket
+	}
+	buf.touched = now
+	buf.grow(len(chunk))
+	buf.body = append(buf.body, chunk...)
+	if len(buf.body) < total {
+		return nil, nil
+	}
+
+	delete(r.pending, id)
+	r.size -= total
+
+	ret := p.Clone()
+	ret.SetFlag(RouteFlagFragment, false)
+	ret.Body = buf.body
+	return ret, nil
+}
+
+// grow makes room for n more bytes, doubling like append but never beyond the total.
+func (b *fragmentBuf) grow(n int) {
+	need := len(b.body) + n
+	if need <= cap(b.body) {
+		return
+	}
+	size := 2 * cap(b.body)
+	if size < need {
+		size = need
+	}
+	if size > b.total {
+		size = b.total
+	}
+	body := make([]byte, len(b.body), size)
+	copy(body, b.body)
+	b.body = body
+}
+
+// sweep drops messages gone stale, at most once a second.
+func (r *reassembler) sweep(now time.Time) {
+	if now.Before(r.sweepAt) {
+		return
+	}
+	r.sweepAt = now.Add(time.Second)
+	for id, buf := range r.pending {
+		if now.Sub(buf.touched) > reassemblyTimeout {
+			delete(r.pending, id)
+			r.size -= buf.total
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestReassemble(t *testing.T) {
+	a := NewRoutePacket()
+	a.SetUid(1)
+	a.Body = make([]byte, 10000)
+	rand.Read(a.Body)
+	b := NewRoutePacket()
+	b.SetUid(2)
+	b.Body = bytes.Repeat([]byte{7}, 2500)
+
+	fa := splitPacket(a, 1, 1000)
+	fb := splitPacket(b, 2, 1000)
+	if len(fa) != 10 || len(fb) != 3 {
+		t.Fatalf("fragments %d %d", len(fa), len(fb))
+	}
+
+	r := newReassembler(DefaultMaxReassemblyBytes)
+	var got []*RoutePacket
+	for i := 0; i < len(fa); i++ {
+		frags := []*RoutePacket{fa[i]}
+		if i < len(fb) {
+			frags = append(frags, fb[i])
+		}
+		for _, f := range frags {
+			p, err := r.add(f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p != nil {
+				got = append(got, p)
+			}
+		}
+	}
+
+	if len(got) != 2 || got[0].GetUid() != 2 || got[1].GetUid() != 1 {
+		t.Fatalf("unexpected reassembled packets")
+	}
+	if !bytes.Equal(got[0].Body, b.Body) || !bytes.Equal(got[1].Body, a.Body) || got[1].HasFlag(RouteFlagFragment) {
+		t.Fatalf("body mismatch")
+	}
+	if r.size != 0 || len(r.pending) != 0 {
+		t.Fatalf("reassembler not drained")
+	}
+
+	small := newReassembler(5000)
+	if _, err := small.add(fa[0]); !errors.Is(err, ErrReassemblyLimit) {
+		t.Fatalf("err %v, want ErrReassemblyLimit", err)
+	}
+	if _, err := r.add(fa[1]); !errors.Is(err, ErrInvalidPacket) {
+		t.Fatalf("out of order fragment should fail, got %v", err)
+	}
+
+	// a message declaring the whole limit holds only what arrived, until it goes stale
+	big := NewRoutePacket()
+	big.Body = make([]byte, DefaultMaxReassemblyBytes)
+	first := splitPacket(big, 3, 1000)[0]
+	if _, err := r.add(first); err != nil {
+		t.Fatal(err)
+	}
+	if c := cap(r.pending[3].body); c != 1000 {
+		t.Fatalf("%d bytes held for the first fragment", c)
+	}
+	r.pending[3].touched = time.Now().Add(-2 * reassemblyTimeout)
+	r.sweepAt = time.Time{}
+	if _, err := r.add(fb[0]); err != nil {
+		t.Fatal(err)
+	}
+	if _, has := r.pending[3]; has || r.size != len(b.Body) {
+		t.Fatalf("stale message kept, %d bytes pending", r.size)
+	}
+}
+
+func TestFragmentSession(t *testing.T) {
+	body := make([]byte, 300000)
+	rand.Read(body)
+	recv := make(chan *RoutePacket, 1)
+
+	svr, err := NewTcpServer(TcpServerOptions{
+		ListenAddr: "127.0.0.1:0",
+		OnSessionPacket: func(s Session, p Packet) {
+			if rp, ok := p.(*RoutePacket); ok {
+				recv <- rp
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	svr.Start()
+	defer svr.Stop()
+
+	cli := NewTcpClient(TcpClientOptions{
+		RemoteAddress:        svr.Address().String(),
+		ReconnectDelaySecond: -1,
+		FragmentSize:         64 * 1024,
+	})
+	if err := cli.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	p := NewRoutePacket()
+	p.Body = body
+	if err := cli.Send(p); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case rp := <-recv:
+		if !bytes.Equal(rp.Body, body) {
+			t.Fatalf("body mismatch")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout")
+	}
+}
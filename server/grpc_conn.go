@@ -0,0 +1,225 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+
+	"route/msg"
+)
+
+// bytes received from a stream and not read yet, receiving pauses beyond it
+const grpcConnMaxPending = 4 * 1024 * 1024
+
+// time a closing client waits for the server to end the stream before cancelling it
+const grpcCloseLinger = 2 * time.Second
+
+// grpcStream is the common half of both ends of a Route.Stream call.
+type grpcStream interface {
+	Send(*msg.Frame) error
+	Recv() (*msg.Frame, error)
+}
+
+// grpcConn carries the packet stream in the frames of a bidirectional grpc stream,
+// so a stream is served by the same socket code as a plain tcp connection.
+type grpcConn struct {
+	stream grpcStream
+	local  net.Addr
+	remote net.Addr
+
+	mu           sync.Mutex
+	in           []byte
+	err          error
+	readDeadline time.Time
+
+	// held while sending, the server ends the stream only once no Send is running
+	wmu     sync.Mutex
+	stopped bool
+
+	chIn    chan struct{}
+	chDrain chan struct{}
+	// closed once the stream stopped receiving
+	recvDone chan struct{}
+	die      chan struct{}
+	once     sync.Once
+	onClose  func()
+}
+
+type grpcAddr string
+
+func (a grpcAddr) Network() string { return "grpc" }
+func (a grpcAddr) String() string  { return string(a) }
+
+func newGrpcConn(stream grpcStream, local, remote net.Addr, onClose func()) *grpcConn {
+	c := &grpcConn{
+		stream:   stream,
+		local:    local,
+		remote:   remote,
+		chIn:     make(chan struct{}, 1),
+		chDrain:  make(chan struct{}, 1),
+		recvDone: make(chan struct{}),
+		die:      make(chan struct{}),
+		onClose:  onClose,
+	}
+	go c.recvWork()
+	return c
+}
+
+func (c *grpcConn) recvWork() {
+	defer close(c.recvDone)
+	for {
+		f, err := c.stream.Recv()
+		c.mu.Lock()
+		if err != nil {
+			c.err = err
+			c.mu.Unlock()
+			notify(c.chIn)
+			return
+		}
+		c.in = append(c.in, f.GetData()...)
+		full := len(c.in) >= grpcConnMaxPending
+		c.mu.Unlock()
+		notify(c.chIn)
+
+		for full {
+			select {
+			case <-c.chDrain:
+			case <-c.die:
+				return
+			}
+			c.mu.Lock()
+			full = len(c.in) >= grpcConnMaxPending
+			c.mu.Unlock()
+		}
+	}
+}
+
+func (c *grpcConn) Read(b []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		if len(c.in) > 0 {
+			n := copy(b, c.in)
+			c.in = c.in[n:]
+			c.mu.Unlock()
+			notify(c.chDrain)
+			return n, nil
+		}
+		if c.err != nil {
+			err := c.err
+			c.mu.Unlock()
+			return 0, err
+		}
+		deadline := c.readDeadline
+		c.mu.Unlock()
+		select {
+		case <-c.die:
+			return 0, net.ErrClosed
+		default:
+		}
+		if err := waitSignal(c.chIn, c.die, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write sends b as one frame. grpc flow control is its only backpressure,
+// write deadlines are not applied.
+func (c *grpcConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.stopped {
+		return 0, net.ErrClosed
+	}
+	if err := c.stream.Send(&msg.Frame{Data: b}); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// stop waits for a running Send and refuses later ones.
+func (c *grpcConn) stop() {
+	c.wmu.Lock()
+	c.stopped = true
+	c.wmu.Unlock()
+}
+
+func (c *grpcConn) Close() error {
+	c.once.Do(func() {
+		close(c.die)
+		if c.onClose != nil {
+			c.onClose()
+		}
+	})
+	return nil
+}
+
+func (c *grpcConn) sessionKind() string {
+	return "grpc"
+}
+
+func (c *grpcConn) LocalAddr() net.Addr  { return c.local }
+func (c *grpcConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *grpcConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *grpcConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	notify(c.chIn)
+	return nil
+}
+
+func (c *grpcConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+func dialGrpc(address string, tlsConfig *tls.Config, timeout time.Duration) (net.Conn, error) {
+	creds := insecure.NewCredentials()
+	if tlsConfig != nil {
+		creds = credentials.NewTLS(tlsConfig)
+	}
+	cc, err := grpc.NewClient(address, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		return nil, err
+	}
+
+	// the context lives as long as the stream, only its setup is timed
+	ctx, cancel := context.WithCancel(context.Background())
+	timer := time.AfterFunc(timeout, cancel)
+	stream, err := msg.NewRouteClient(cc).Stream(ctx, grpc.WaitForReady(true))
+	if !timer.Stop() || err != nil {
+		cancel()
+		cc.Close()
+		if err == nil {
+			err = context.DeadlineExceeded
+		}
+		return nil, err
+	}
+
+	var c *grpcConn
+	c = newGrpcConn(stream, grpcAddr("client"), grpcAddr(address), func() {
+		go func() {
+			// cancelling unblocks a Send stuck on flow control as well
+			linger := time.AfterFunc(grpcCloseLinger, cancel)
+			defer linger.Stop()
+			c.stop()
+			stream.CloseSend()
+			select {
+			case <-c.recvDone:
+			case <-ctx.Done():
+			}
+			cancel()
+			cc.Close()
+		}()
+	})
+	return c, nil
+}
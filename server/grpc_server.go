@@ -0,0 +1,114 @@
+package server
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"route/msg"
+)
+
+type GrpcServerOptions struct {
+	// serves the calls of msg.RouteServer other than Stream, nil leaves them unimplemented
+	Service   msg.RouteServer
+	TLSConfig *tls.Config
+}
+
+// GrpcServer serves the msg.Route service on ln. its Stream calls come out of Accept
+// as connections, to be served by tcpServer like any other.
+type GrpcServer struct {
+	ln       net.Listener
+	svr      *grpc.Server
+	chAccept chan net.Conn
+	die      chan struct{}
+	once     sync.Once
+}
+
+func NewGrpcServer(ln net.Listener, opts GrpcServerOptions) *GrpcServer {
+	var svropts []grpc.ServerOption
+	if opts.TLSConfig != nil {
+		svropts = append(svropts, grpc.Creds(credentials.NewTLS(opts.TLSConfig)))
+	}
+	ret := &GrpcServer{
+		ln:       ln,
+		svr:      grpc.NewServer(svropts...),
+		chAccept: make(chan net.Conn),
+		die:      make(chan struct{}),
+	}
+	service := opts.Service
+	if service == nil {
+		service = msg.UnimplementedRouteServer{}
+	}
+	msg.RegisterRouteServer(ret.svr, grpcRouteServer{RouteServer: service, s: ret})
+	return ret
+}
+
+// grpcRouteServer takes Stream calls, the others go to the configured service.
+type grpcRouteServer struct {
+	msg.RouteServer
+	s *GrpcServer
+}
+
+func (g grpcRouteServer) Stream(stream msg.Route_StreamServer) error {
+	return g.s.stream(stream)
+}
+
+func (s *GrpcServer) Start() error {
+	go s.svr.Serve(s.ln)
+	return nil
+}
+
+func (s *GrpcServer) Stop() error {
+	s.once.Do(func() {
+		close(s.die)
+		s.svr.Stop()
+	})
+	return nil
+}
+
+// Accept, Close and Addr let tcpServer take sessions from it as from a listener.
+func (s *GrpcServer) Accept() (net.Conn, error) {
+	select {
+	case conn := <-s.chAccept:
+		return conn, nil
+	case <-s.die:
+		return nil, net.ErrClosed
+	}
+}
+
+func (s *GrpcServer) Close() error {
+	return s.Stop()
+}
+
+func (s *GrpcServer) Addr() net.Addr {
+	return s.ln.Addr()
+}
+
+func (s *GrpcServer) stream(stream msg.Route_StreamServer) error {
+	var remote net.Addr = grpcAddr("unknown")
+	if p, ok := peer.FromContext(stream.Context()); ok {
+		remote = p.Addr
+	}
+	conn := newGrpcConn(stream, s.ln.Addr(), remote, nil)
+
+	select {
+	case s.chAccept <- conn:
+	case <-s.die:
+		return status.Error(codes.Unavailable, "server closed")
+	}
+
+	// the stream ends when the handler returns, so it lives until the session closes the conn
+	select {
+	case <-conn.die:
+	case <-stream.Context().Done():
+		conn.Close()
+	}
+	conn.stop()
+	return nil
+}
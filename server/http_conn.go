@@ -0,0 +1,387 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// bytes a session buffers each way: for a client that is not polling, writes block beyond it,
+	// and posted by a client and not read yet, further posts are refused beyond it
+	httpConnMaxPending = 4 * 1024 * 1024
+	// bytes returned by one poll
+	httpPollMaxBytes = 1024 * 1024
+	// how long a poll waits for data before returning empty
+	httpPollTimeout = 25 * time.Second
+	// pause of a client before posting again to a server with too much unread
+	httpSendRetry = 50 * time.Millisecond
+)
+
+var (
+	errHTTPSessionGone = errors.New("http session gone")
+	errHTTPBacklog     = errors.New("too much unread data, retry later")
+)
+
+// httpConn is the server side of a polling session: posted bytes are read from it,
+// written bytes wait until the client polls or streams them.
+type httpConn struct {
+	sid    string
+	local  net.Addr
+	remote net.Addr
+
+	mu      sync.Mutex
+	in      []byte
+	out     []byte
+	closed  bool
+	touched time.Time
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	chIn  chan struct{}
+	chOut chan struct{}
+	// signalled when out drains, for blocked writers
+	chDrain chan struct{}
+	// signalled when in is read, for a client waiting to poll
+	chRead chan struct{}
+	die    chan struct{}
+	once   sync.Once
+	// called once when the session is closed, by either side
+	onClose func()
+}
+
+type httpAddr string
+
+func (a httpAddr) Network() string { return "http" }
+func (a httpAddr) String() string  { return string(a) }
+
+func newHTTPSessionID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+func newHTTPConn(sid string, local, remote net.Addr) *httpConn {
+	return &httpConn{
+		sid:     sid,
+		local:   local,
+		remote:  remote,
+		touched: time.Now(),
+		chIn:    make(chan struct{}, 1),
+		chOut:   make(chan struct{}, 1),
+		chDrain: make(chan struct{}, 1),
+		chRead:  make(chan struct{}, 1),
+		die:     make(chan struct{}),
+	}
+}
+
+func waitSignal(ch, die chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-ch:
+	case <-die:
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+	return nil
+}
+
+func (c *httpConn) Read(b []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		if len(c.in) > 0 {
+			n := copy(b, c.in)
+			c.in = c.in[n:]
+			c.mu.Unlock()
+			notify(c.chRead)
+			return n, nil
+		}
+		if c.closed {
+			c.mu.Unlock()
+			return 0, io.EOF
+		}
+		deadline := c.readDeadline
+		c.mu.Unlock()
+		if err := waitSignal(c.chIn, c.die, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (c *httpConn) Write(b []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			return 0, net.ErrClosed
+		}
+		if len(c.out) < httpConnMaxPending {
+			c.out = append(c.out, b...)
+			c.mu.Unlock()
+			notify(c.chOut)
+			return len(b), nil
+		}
+		deadline := c.writeDeadline
+		c.mu.Unlock()
+		if err := waitSignal(c.chDrain, c.die, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// push appends bytes posted by the client, all of them or none when the session has too many unread.
+// a post larger than httpConnMaxPending still goes through once everything before it was read.
+func (c *httpConn) push(b []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return errHTTPSessionGone
+	}
+	if len(c.in) > 0 && len(c.in)+len(b) > httpConnMaxPending {
+		return errHTTPBacklog
+	}
+	c.appendIn(b)
+	return nil
+}
+
+// appendIn adds to the unread bytes, c.mu held.
+func (c *httpConn) appendIn(b []byte) {
+	c.in = append(c.in, b...)
+	c.touched = time.Now()
+	notify(c.chIn)
+}
+
+// take waits up to timeout for bytes to send to the client.
+// it fails once the session is closed and everything was taken.
+func (c *httpConn) take(timeout time.Duration, stop <-chan struct{}) ([]byte, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		c.mu.Lock()
+		c.touched = time.Now()
+		if len(c.out) > 0 {
+			n := len(c.out)
+			if n > httpPollMaxBytes {
+				n = httpPollMaxBytes
+			}
+			ret := append([]byte(nil), c.out[:n]...)
+			c.out = c.out[n:]
+			c.mu.Unlock()
+			notify(c.chDrain)
+			return ret, nil
+		}
+		if c.closed {
+			c.mu.Unlock()
+			return nil, errHTTPSessionGone
+		}
+		c.mu.Unlock()
+
+		select {
+		case <-c.chOut:
+		case <-c.die:
+		case <-stop:
+			return nil, nil
+		case <-timer.C:
+			return nil, nil
+		}
+	}
+}
+
+func (c *httpConn) idleSince() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.touched
+}
+
+func (c *httpConn) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	c.once.Do(func() {
+		close(c.die)
+		if c.onClose != nil {
+			c.onClose()
+		}
+	})
+	return nil
+}
+
+func (c *httpConn) sessionKind() string {
+	return "http"
+}
+
+func (c *httpConn) LocalAddr() net.Addr  { return c.local }
+func (c *httpConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *httpConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *httpConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	notify(c.chIn)
+	return nil
+}
+
+func (c *httpConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	notify(c.chDrain)
+	return nil
+}
+
+// httpClientConn is the client side of a polling session, it long-polls in the background.
+type httpClientConn struct {
+	*httpConn
+	base   string
+	client *http.Client
+}
+
+func dialHTTP(addr string, client *http.Client, timeout time.Duration) (net.Conn, error) {
+	base := strings.TrimSuffix(addr, "/")
+	ctl := &http.Client{Transport: client.Transport, Timeout: timeout}
+	resp, err := ctl.Post(base+"/open", "application/octet-stream", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 256))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("open http session: %s", resp.Status)
+	}
+
+	sid := string(bytes.TrimSpace(body))
+	c := &httpClientConn{
+		httpConn: newHTTPConn(sid, httpAddr("client"), httpAddr(base)),
+		base:     base,
+		client:   &http.Client{Transport: client.Transport, Timeout: httpPollTimeout + timeout},
+	}
+	go c.pollWork()
+	return c, nil
+}
+
+func (c *httpClientConn) url(action string) string {
+	return c.base + "/" + action + "?sid=" + c.sid
+}
+
+func (c *httpClientConn) pollWork() {
+	defer c.httpConn.Close()
+	for {
+		select {
+		case <-c.die:
+			return
+		default:
+		}
+		// the server keeps what the application is not reading yet
+		if err := c.waitRoom(); err != nil {
+			return
+		}
+		resp, err := c.client.Get(c.url("poll"))
+		if err != nil {
+			return
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != http.StatusOK {
+			return
+		}
+		if len(body) > 0 {
+			c.mu.Lock()
+			if !c.closed {
+				c.appendIn(body)
+			}
+			c.mu.Unlock()
+		}
+	}
+}
+
+// waitRoom returns once less than httpConnMaxPending bytes wait to be read.
+func (c *httpClientConn) waitRoom() error {
+	for {
+		c.mu.Lock()
+		full := len(c.in) >= httpConnMaxPending
+		c.mu.Unlock()
+		if !full {
+			return nil
+		}
+		if err := waitSignal(c.chRead, c.die, time.Time{}); err != nil {
+			return err
+		}
+		select {
+		case <-c.die:
+			return net.ErrClosed
+		default:
+		}
+	}
+}
+
+func (c *httpClientConn) Write(b []byte) (int, error) {
+	select {
+	case <-c.die:
+		return 0, net.ErrClosed
+	default:
+	}
+	for {
+		resp, err := c.client.Post(c.url("send"), "application/octet-stream", bytes.NewReader(b))
+		if err != nil {
+			return 0, err
+		}
+		resp.Body.Close()
+		switch resp.StatusCode {
+		case http.StatusOK:
+			return len(b), nil
+		case http.StatusTooManyRequests:
+			// nothing was kept, the same bytes go again once the server caught up
+			select {
+			case <-c.die:
+				return 0, net.ErrClosed
+			case <-time.After(httpSendRetry):
+			}
+		default:
+			return 0, fmt.Errorf("http send: %s", resp.Status)
+		}
+	}
+}
+
+func (c *httpClientConn) Close() error {
+	select {
+	case <-c.die:
+		return nil
+	default:
+	}
+	c.httpConn.Close()
+	go func() {
+		if resp, err := c.client.Post(c.url("close"), "application/octet-stream", nil); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	return nil
+}
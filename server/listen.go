@@ -0,0 +1,198 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// UnixSocketOptions apply when ListenAddr is a unix:// address.
+type UnixSocketOptions struct {
+	// permissions of the socket file, 0 leaves them to the umask. unused for abstract sockets
+	Mode os.FileMode
+	// authenticates local peers from their credentials, before and instead of AuthFunc.
+	// returning nil user and nil error falls back to AuthFunc.
+	PeerCredAuth func(PeerCred) (*UserInfo, error)
+}
+
+// PeerCred identifies the process on the other end of a unix socket.
+type PeerCred struct {
+	PID int32
+	UID uint32
+	GID uint32
+}
+
+var ErrPeerCredUnsupported = errors.New("peer credentials not supported")
+
+// splitAddr splits an address into its scheme and the rest:
+//
+//	host:port or tcp://host:port   plain tcp
+//	tls://host:port                tcp with tls
+//	ws://host:port/path            websocket, wss:// with tls
+//	http://host:port/path          websocket and its http polling fallback, https:// with tls
+//	grpc://host:port               Stream calls of the msg.Route grpc service, grpcs:// with tls
+//	udp://host:port                reliable udp, see rudp.go
+//	unix:///run/route.sock         unix socket file, unix://@route an abstract socket on linux
+func splitAddr(addr string) (string, string) {
+	for _, scheme := range []string{"tcp", "tls", "ws", "wss", "http", "https", "grpc", "grpcs", "udp", "unix"} {
+		if rest, ok := strings.CutPrefix(addr, scheme+"://"); ok {
+			return scheme, rest
+		}
+	}
+	return "tcp", addr
+}
+
+// CheckListenAddr validates the scheme of a listen address and tells whether it needs a tls config.
+func CheckListenAddr(addr string) (needTLS bool, err error) {
+	scheme, rest := splitAddr(addr)
+	if rest == "" || strings.Contains(rest, "://") {
+		return false, fmt.Errorf("invalid listen address %q", addr)
+	}
+	return isTLSScheme(scheme), nil
+}
+
+func isTLSScheme(scheme string) bool {
+	return scheme == "tls" || scheme == "wss" || scheme == "https" || scheme == "grpcs"
+}
+
+// isHTTPScheme tells listeners served by HttpServer.
+func isHTTPScheme(scheme string) bool {
+	return scheme == "ws" || scheme == "wss" || scheme == "http" || scheme == "https"
+}
+
+// proxyProtocolScheme tells listeners whose connections tcpServer reads itself, only those can carry PROXY headers.
+func proxyProtocolScheme(scheme string) bool {
+	return !isHTTPScheme(scheme) && scheme != "grpc" && scheme != "grpcs" && scheme != "udp"
+}
+
+// ProxyProtocolSupported tells whether a listener of addr accepts ProxyProtocolOptions.
+func ProxyProtocolSupported(addr string) bool {
+	scheme, _ := splitAddr(addr)
+	return proxyProtocolScheme(scheme)
+}
+
+func isAbstractSocket(path string) bool {
+	return strings.HasPrefix(path, "@")
+}
+
+func listen(addr string, opts *TcpServerOptions) (net.Listener, string, error) {
+	scheme, address := splitAddr(addr)
+	if isTLSScheme(scheme) && opts.TLSConfig == nil {
+		return nil, "", fmt.Errorf("%s listener requires a tls config", scheme)
+	}
+
+	switch scheme {
+	case "unix":
+		ln, err := listenUnix(address, opts.Unix)
+		return ln, scheme, err
+	case "udp":
+		ln, err := listenRUDP(address)
+		return ln, scheme, err
+	case "grpc", "grpcs":
+		ln, err := net.Listen("tcp", address)
+		if err != nil {
+			return nil, "", err
+		}
+		svropts := GrpcServerOptions{Service: opts.GrpcService}
+		if scheme == "grpcs" {
+			svropts.TLSConfig = opts.TLSConfig
+		}
+		svr := NewGrpcServer(ln, svropts)
+		svr.Start()
+		return svr, scheme, nil
+	case "ws", "wss", "http", "https":
+		host, path := address, "/"
+		if i := strings.IndexByte(address, '/'); i >= 0 {
+			host, path = address[:i], address[i:]
+		}
+		ln, err := net.Listen("tcp", host)
+		if err != nil {
+			return nil, "", err
+		}
+		if isTLSScheme(scheme) {
+			ln = tls.NewListener(ln, opts.TLSConfig)
+		}
+		svr := NewServer(ln, ServerOptions{
+			Path:             path,
+			HeatbeatInterval: opts.HeatbeatInterval,
+			MaxPollSessions:  opts.MaxPollSessions,
+			Handler:          opts.HTTPHandler,
+		})
+		svr.Start()
+		return svr, scheme, nil
+	}
+	// tls is layered on in onAccept, after a PROXY header the balancer sends in front of it
+	ln, err := net.Listen("tcp", address)
+	return ln, scheme, err
+}
+
+func listenUnix(path string, opts UnixSocketOptions) (net.Listener, error) {
+	if isAbstractSocket(path) {
+		return net.Listen("unix", path)
+	}
+
+	removeStaleSocket(path)
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Mode != 0 {
+		if err := os.Chmod(path, opts.Mode); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+	return ln, nil
+}
+
+func dial(addr string, tlsConfig *tls.Config, timeout time.Duration) (net.Conn, error) {
+	scheme, address := splitAddr(addr)
+	switch scheme {
+	case "unix":
+		return net.DialTimeout("unix", address, timeout)
+	case "tls":
+		return tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", address, tlsConfig)
+	case "udp":
+		return dialRUDP(address)
+	case "grpc":
+		return dialGrpc(address, nil, timeout)
+	case "grpcs":
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		return dialGrpc(address, tlsConfig, timeout)
+	case "ws", "wss":
+		return dialWS(addr, tlsConfig, timeout)
+	case "http", "https":
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+		return dialHTTP(addr, client, timeout)
+	}
+	return net.DialTimeout("tcp", address, timeout)
+}
+
+// removeStaleSocket removes a socket file left by a process that did not exit cleanly,
+// a file still accepting connections is left alone so listening fails.
+func removeStaleSocket(path string) {
+	fi, err := os.Lstat(path)
+	if err != nil || fi.Mode()&os.ModeSocket == 0 {
+		return
+	}
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		os.Remove(path)
+	}
+}
+
+func isUnixConn(conn net.Conn) bool {
+	return conn.LocalAddr().Network() == "unix"
+}
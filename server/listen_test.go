@@ -0,0 +1,333 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testTLSConfig(t *testing.T) (*tls.Config, *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	svr := &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	cli := &tls.Config{RootCAs: pool}
+	return svr, cli
+}
+
+func TestMultipleListeners(t *testing.T) {
+	svrTLS, cliTLS := testTLSConfig(t)
+
+	var mu sync.Mutex
+	sessions := make(map[string]string)
+	echoed := make(map[string]bool)
+	onStatus := func(s Session, enable bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		if enable {
+			sessions[s.SessionID()] = s.SessionType()
+		}
+	}
+
+	addrs := []string{
+		"127.0.0.1:0",
+		"tls://127.0.0.1:0",
+		"ws://127.0.0.1:0/route",
+		"wss://127.0.0.1:0/route",
+		"http://127.0.0.1:0/route",
+		"https://127.0.0.1:0/route",
+		"grpc://127.0.0.1:0",
+		"grpcs://127.0.0.1:0",
+		"udp://127.0.0.1:0",
+		"unix://" + filepath.Join(t.TempDir(), "route.sock"),
+	}
+	for _, addr := range addrs {
+		svr, err := NewTcpServer(TcpServerOptions{
+			ListenAddr:      addr,
+			TLSConfig:       svrTLS,
+			OnSessionStatus: onStatus,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		svr.Start()
+		defer svr.Stop()
+
+		scheme, rest := splitAddr(addr)
+		remote := addr
+		switch scheme {
+		case "tcp", "tls", "ws", "wss", "http", "https", "grpc", "grpcs", "udp":
+			path := rest[len("127.0.0.1:0"):]
+			remote = scheme + "://" + svr.Address().String() + path
+		}
+
+		cli := NewTcpClient(TcpClientOptions{
+			RemoteAddress:        remote,
+			TLSConfig:            cliTLS,
+			ReconnectDelaySecond: -1,
+			OnSessionPacket: func(s Session, p Packet) {
+				if hv, ok := p.(*HVPacket); ok && hv.GetFlag() == HVPacketFlagEcho {
+					mu.Lock()
+					echoed[string(hv.GetBody())] = true
+					mu.Unlock()
+				}
+			},
+		})
+		if err := cli.Connect(); err != nil {
+			t.Fatalf("%s: %v", addr, err)
+		}
+		defer cli.Close()
+
+		echo := NewHVPacket()
+		echo.SetFlag(HVPacketFlagEcho)
+		echo.SetBody([]byte(scheme))
+		if err := cli.Send(echo); err != nil {
+			t.Fatalf("%s: %v", addr, err)
+		}
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		mu.Lock()
+		n := len(sessions) + len(echoed)
+		mu.Unlock()
+		if n == 2*len(addrs) || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(sessions) != len(addrs) {
+		t.Fatalf("got %d distinct sessions, want %d: %v", len(sessions), len(addrs), sessions)
+	}
+	kinds := make(map[string]bool)
+	for _, kind := range sessions {
+		kinds[kind] = true
+	}
+	for _, kind := range []string{"tcp", "tls", "ws", "wss", "http", "https", "grpc", "grpcs", "udp", "unix"} {
+		if !kinds[kind] {
+			t.Fatalf("no %s session in %v", kind, sessions)
+		}
+		if !echoed[kind] {
+			t.Fatalf("no echo over %s", kind)
+		}
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("peer credentials need linux")
+	}
+	addr := "unix://" + filepath.Join(t.TempDir(), "route.sock")
+	var cred PeerCred
+	svr, err := NewTcpServer(TcpServerOptions{
+		ListenAddr: addr,
+		Unix: UnixSocketOptions{
+			Mode: 0600,
+			PeerCredAuth: func(c PeerCred) (*UserInfo, error) {
+				cred = c
+				return &UserInfo{UId: c.UID + 1, URole: "local"}, nil
+			},
+		},
+		AuthFunc: func([]byte) (*UserInfo, error) {
+			return nil, errors.New("token auth should be skipped")
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	svr.Start()
+	defer svr.Stop()
+
+	fi, err := os.Stat(strings.TrimPrefix(addr, "unix://"))
+	if err != nil || fi.Mode().Perm() != 0600 {
+		t.Fatalf("socket file mode %v %v", fi, err)
+	}
+
+	cli := NewTcpClient(TcpClientOptions{RemoteAddress: addr, ReconnectDelaySecond: -1})
+	if err := cli.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	if cred.UID != uint32(os.Getuid()) || cred.PID != int32(os.Getpid()) {
+		t.Fatalf("unexpected peer cred %+v", cred)
+	}
+}
+
+func TestHTTPEvents(t *testing.T) {
+	svr, err := NewTcpServer(TcpServerOptions{ListenAddr: "http://127.0.0.1:0/route"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	svr.Start()
+	defer svr.Stop()
+	base := "http://" + svr.Address().String() + "/route"
+
+	resp, err := http.Post(base+"/open", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sid, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	events, err := http.Get(base + "/events?sid=" + string(sid))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer events.Body.Close()
+
+	hello := NewHVPacket()
+	hello.SetFlag(hvPacketFlagHandShake)
+	hello.SetBody((&handshakeHello{Version: ProtocolVersion}).Marshal())
+	buf := &bytes.Buffer{}
+	WritePacket(buf, hello)
+	resp, err = http.Post(base+"/send?sid="+string(sid), "", buf)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("send: %v %v", resp, err)
+	}
+	resp.Body.Close()
+
+	lines := bufio.NewScanner(events.Body)
+	for lines.Scan() {
+		data, ok := strings.CutPrefix(lines.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		raw, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ack, err := ReadPacketT[*HVPacket](bytes.NewReader(raw))
+		if err != nil || ack.GetFlag() != hvPacketFlagAckResult {
+			t.Fatalf("unexpected reply %v %v", ack, err)
+		}
+		return
+	}
+	t.Fatalf("event stream ended: %v", lines.Err())
+}
+
+func TestHTTPPollLimit(t *testing.T) {
+	svr, err := NewTcpServer(TcpServerOptions{ListenAddr: "http://127.0.0.1:0/route", MaxPollSessions: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	svr.Start()
+	defer svr.Stop()
+	base := "http://" + svr.Address().String() + "/route"
+	open := func() int {
+		resp, err := http.Post(base+"/open", "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if open() != http.StatusOK || open() != http.StatusServiceUnavailable {
+		t.Fatalf("max poll sessions not applied")
+	}
+
+	// a session refused by the server gives its slot back before the idle sweep
+	denied, err := NewTcpServer(TcpServerOptions{
+		ListenAddr:      "http://127.0.0.1:0/route",
+		MaxPollSessions: 1,
+		Admission:       AdmissionOptions{Deny: []string{"127.0.0.1"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	denied.Start()
+	defer denied.Stop()
+	base = "http://" + denied.Address().String() + "/route"
+	open()
+	deadline := time.Now().Add(2 * time.Second)
+	for open() != http.StatusOK {
+		if time.Now().After(deadline) {
+			t.Fatalf("refused session kept its slot")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHTTPSendLimits(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	svr := NewServer(ln, ServerOptions{Path: "/route"})
+	svr.Start()
+	defer svr.Stop()
+	base := "http://" + ln.Addr().String() + "/route"
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		if conn, err := svr.Accept(); err == nil {
+			accepted <- conn
+		}
+	}()
+	resp, err := http.Post(base+"/open", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sid, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	conn := <-accepted
+
+	post := func(n int) int {
+		resp, err := http.Post(base+"/send?sid="+string(sid), "", bytes.NewReader(make([]byte, n)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := post(MaxPacketBodyLen + 1); code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("oversized body: %d", code)
+	}
+	// nothing is read by the session, posts stop being buffered
+	if post(3<<20) != http.StatusOK || post(3<<20) != http.StatusTooManyRequests {
+		t.Fatal("unread bytes not bounded")
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 3<<20)); err != nil {
+		t.Fatal(err)
+	}
+	if code := post(3 << 20); code != http.StatusOK {
+		t.Fatalf("post after the session caught up: %d", code)
+	}
+}
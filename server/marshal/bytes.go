@@ -22,6 +22,7 @@ func (n BytesMarshaler) Unmarshal(d []byte, v interface{}) error {
 	switch ve := v.(type) {
 	case *[]byte:
 		*ve = d
+		return nil
 	}
 	return ErrInvalidMessage
 }
@@ -29,3 +30,7 @@ func (n BytesMarshaler) Unmarshal(d []byte, v interface{}) error {
 func (n BytesMarshaler) String() string {
 	return "bytes"
 }
+
+func (BytesMarshaler) ContentType(_ interface{}) string {
+	return "application/octet-stream"
+}
@@ -1,5 +1,7 @@
 package marshal
 
+import "mime"
+
 type Marshaler interface {
 	// Marshal marshals "v" into byte sequence.
 	Marshal(v interface{}) ([]byte, error)
@@ -11,3 +13,13 @@ type Marshaler interface {
 	// affect the content type returned.
 	ContentType(interface{}) string
 }
+
+// ForContentType returns the marshaler of a mime type, raw bytes for anything it does not know.
+func ForContentType(contentType string) Marshaler {
+	mediatype, _, _ := mime.ParseMediaType(contentType)
+	switch mediatype {
+	case "application/json":
+		return &JSONPb{}
+	}
+	return BytesMarshaler{}
+}
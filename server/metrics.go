@@ -0,0 +1,82 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"route/metrics"
+)
+
+var (
+	metricConnsActive = metrics.NewGaugeVec("route_connections_active",
+		"established sessions, by listener kind", "kind")
+	metricConnsTotal = metrics.NewCounterVec("route_connections_total",
+		"established sessions since start, by listener kind", "kind")
+	metricHandshakes = metrics.NewCounterVec("route_handshakes_total",
+		"server handshakes by result, failures by reason", "result", "reason")
+	metricRejects = metrics.NewCounterVec("route_admission_rejects_total",
+		"connections refused before or during the handshake, by reason", "reason")
+	metricPackets = metrics.NewCounterVec("route_packets_total",
+		"packets on the wire by direction and type, fragments counted one by one", "direction", "type")
+	metricBytes = metrics.NewCounterVec("route_bytes_total",
+		"bytes on the wire by direction and packet type", "direction", "type")
+	metricDrops = metrics.NewCounterVec("route_send_drops_total",
+		"packets dropped instead of sent, by reason", "reason")
+	metricQueueDepth = metrics.NewHistogram("route_send_queue_depth",
+		"packets already queued on the session when one more is sent",
+		metrics.ExponentialBuckets(1, 2, 11))
+	metricRTT = metrics.NewHistogram("route_rtt_seconds",
+		"round trip times measured by pings", metrics.DefBuckets)
+	metricClientConnects = metrics.NewCounterVec("route_client_connects_total",
+		"client connection attempts by result", "result")
+	metricClientReconnects = metrics.NewCounter("route_client_reconnects_total",
+		"client reconnection attempts")
+)
+
+const (
+	dirIn = iota
+	dirOut
+)
+
+// wire counters resolved once, they are hit for every packet
+var packetCounters, byteCounters [2][2]*metrics.Counter
+
+func init() {
+	for dir, dirName := range []string{"in", "out"} {
+		for typ, typName := range []string{"route", "hv"} {
+			packetCounters[dir][typ] = metricPackets.With(dirName, typName)
+			byteCounters[dir][typ] = metricBytes.With(dirName, typName)
+		}
+	}
+}
+
+func countPacket(dir int, p Packet, n int64) {
+	typ := 0
+	if p.PacketType() == HVPacketType {
+		typ = 1
+	}
+	packetCounters[dir][typ].Inc()
+	if n > 0 {
+		byteCounters[dir][typ].Add(uint64(n))
+	}
+}
+
+var errAuthFailed = errors.New("auth failed")
+
+// handshakeFailReason names the cause of a failed handshake for metrics.
+func handshakeFailReason(err error) string {
+	switch {
+	case errors.Is(err, ErrVersionTooOld):
+		return "version"
+	case errors.Is(err, errAuthFailed):
+		return "auth"
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "eof"
+	case errors.Is(err, ErrInvalidPacket), errors.Is(err, ErrBodyTooLarge):
+		return "protocol"
+	}
+	return "other"
+}
@@ -3,6 +3,8 @@ package server
 import (
 	"errors"
 	"io"
+	"net"
+	"sync/atomic"
 )
 
 const (
@@ -10,6 +12,12 @@ const (
 	HVPacketType    byte = 0x10
 )
 
+// MaxPacketBodyLen is the largest body a 24-bit length field can describe.
+const MaxPacketBodyLen = 0xFFFFFF
+
+// DefaultMaxHandshakeBodyLen bounds what an unauthenticated peer can make us allocate.
+const DefaultMaxHandshakeBodyLen = 8 * 1024
+
 func init() {
 	RegPacket(NewHVPacket)
 	RegPacket(NewRoutePacket)
@@ -42,6 +50,99 @@ func RegPacket[T Packet](f func() T) error {
 	return nil
 }
 
+// packetReader reads packets of one connection, refusing bodies longer than max before allocating them.
+type packetReader struct {
+	io.Reader
+	max uint32
+	// read route bodies into pooled buffers
+	pool bool
+	// route frame flags the session negotiated, packets with other high msgtype bits are refused
+	routeFlags byte
+	typ        [1]byte
+	// bytes read, updated atomically
+	n int64
+}
+
+func (pr *packetReader) Read(b []byte) (int, error) {
+	n, err := pr.Reader.Read(b)
+	atomic.AddInt64(&pr.n, int64(n))
+	return n, err
+}
+
+// LimitReader returns a reader that fails packets with a body longer than max before allocating it.
+func LimitReader(r io.Reader, max uint32) io.Reader {
+	return &packetReader{Reader: r, max: max, routeFlags: routeFlagMask}
+}
+
+func newPacketReader(r io.Reader, max uint32, pool bool) *packetReader {
+	return &packetReader{Reader: r, max: max, pool: pool}
+}
+
+// skip discards a body of n bytes, refusing it like readBody would.
+func (pr *packetReader) skip(n uint32) error {
+	if err := checkBodyLen(pr, n); err != nil {
+		return err
+	}
+	_, err := io.CopyN(io.Discard, pr, int64(n))
+	return err
+}
+
+func checkBodyLen(r io.Reader, n uint32) error {
+	if pr, ok := r.(*packetReader); ok && n > pr.max {
+		return ErrBodyTooLarge
+	}
+	return nil
+}
+
+func readBody(r io.Reader, n uint32) ([]byte, error) {
+	if err := checkBodyLen(r, n); err != nil {
+		return nil, err
+	}
+	body := make([]byte, n)
+	_, err := io.ReadFull(r, body)
+	return body, err
+}
+
+// framedPacket is implemented by packets that can be written as head and body in one vectored write.
+type framedPacket interface {
+	appendHead(b []byte, ext bool) ([]byte, error)
+	packetBody() []byte
+}
+
+// packetWriter writes every packet with a single vectored write, reusing its buffers.
+type packetWriter struct {
+	w io.Writer
+	// the peer understands the extended route head
+	ext  bool
+	head []byte
+	vec  [2][]byte
+	bufs net.Buffers
+}
+
+func newPacketWriter(w io.Writer) *packetWriter {
+	return &packetWriter{w: w, head: make([]byte, 0, 16)}
+}
+
+func (pw *packetWriter) WritePacket(p Packet) (int64, error) {
+	fp, ok := p.(framedPacket)
+	if !ok {
+		return WritePacket(pw.w, p)
+	}
+	var err error
+	if pw.head, err = fp.appendHead(append(pw.head[:0], p.PacketType()), pw.ext); err != nil {
+		return 0, err
+	}
+	pw.vec[0] = pw.head
+	pw.vec[1] = fp.packetBody()
+	pw.bufs = pw.vec[:]
+	if len(pw.vec[1]) == 0 {
+		pw.bufs = pw.vec[:1]
+	}
+	n, err := pw.bufs.WriteTo(pw.w)
+	pw.vec[1] = nil
+	return n, err
+}
+
 func GetUint24(b []byte) uint32 {
 	_ = b[2] // bounds check hint to compiler; see golang.org/issue/14808
 	return uint32(b[0]) | uint32(b[1])<<8 | uint32(b[2])<<16
@@ -14,6 +14,9 @@ const (
 	HVPacketFlagHeartbeat     hvPacketFlag = HVPacketTypeInnerStartAt_ + iota
 	HVPacketFlagEcho          hvPacketFlag = HVPacketTypeInnerStartAt_ + iota
 	HVPacketFlagMessage       hvPacketFlag = HVPacketTypeInnerStartAt_ + iota
+	hvPacketFlagReject        hvPacketFlag = HVPacketTypeInnerStartAt_ + iota
+	HVPacketFlagPing          hvPacketFlag = HVPacketTypeInnerStartAt_ + iota
+	HVPacketFlagPong          hvPacketFlag = HVPacketTypeInnerStartAt_ + iota
 	HVPcketTypeInnerEndAt_    hvPacketFlag = HVPacketTypeInnerStartAt_ + iota
 )
 
@@ -72,10 +75,9 @@ func (p *HVPacket) ReadFrom(reader io.Reader) (int64, error) {
 
 	bodylen := p.head.getBodyLen()
 
+	p.body = nil
 	if bodylen > 0 {
-		p.body = make([]byte, bodylen)
-		_, err = io.ReadFull(reader, p.body)
-		if err != nil {
+		if p.body, err = readBody(reader, bodylen); err != nil {
 			return 0, err
 		}
 	}
@@ -83,6 +85,9 @@ func (p *HVPacket) ReadFrom(reader io.Reader) (int64, error) {
 }
 
 func (p *HVPacket) WriteTo(writer io.Writer) (int64, error) {
+	if len(p.body) > MaxPacketBodyLen {
+		return 0, ErrBodyTooLarge
+	}
 	_, err := writer.Write(p.head)
 	if err != nil {
 		return 0, err
@@ -97,6 +102,17 @@ func (p *HVPacket) WriteTo(writer io.Writer) (int64, error) {
 	return int64(hvPackMetaLen + len(p.body)), nil
 }
 
+func (p *HVPacket) appendHead(b []byte, ext bool) ([]byte, error) {
+	if len(p.body) > MaxPacketBodyLen {
+		return b, ErrBodyTooLarge
+	}
+	return append(b, p.head...), nil
+}
+
+func (p *HVPacket) packetBody() []byte {
+	return p.body
+}
+
 func (p *HVPacket) SetFlag(h byte) {
 	p.head.setFlag(h)
 }
@@ -2,30 +2,91 @@ package server
 
 import (
 	"encoding/binary"
+	"errors"
 	"io"
+	"sync/atomic"
 )
 
 func NewRoutePacket() *RoutePacket {
-	return &RoutePacket{
-		RoutePacketHead: make(RoutePacketHead, RoutePacketHeadLen),
-	}
+	ret := &RoutePacket{}
+	ret.RoutePacketHead = ret.head[:]
+	return ret
 }
 
 const RoutePacketHeadLen = 8
 
+// msgtype values
+const (
+	RouteTypAsync byte = iota
+	RouteTypRequest
+	RouteTypResponse
+	RouteTypRespErr
+)
+
+// the high bits of the msgtype byte are reserved for frame flags, sent only when the peer
+// negotiated their capability. msgtypes above RouteMsgtypeMax are invalid.
+const (
+	RouteFlagCompressed byte = 0x80
+	RouteFlagFragment   byte = 0x40
+	RouteFlagExtended   byte = 0x20
+
+	RouteMsgtypeMax byte = 0x0F
+
+	routeFlagMask    byte = 0xF0
+	routeMsgtypeMask byte = RouteMsgtypeMax
+)
+
+var ErrInvalidMsgtype = errors.New("invalid route msgtype")
+
 type RoutePacketHead []byte
 
 type RoutePacket struct {
 	RoutePacketHead
 	Body []byte
+
+	head [RoutePacketHeadLen]byte
+	// pooled body buffer and its reference count
+	buf  *[]byte
+	refs int32
+
+	// carried in the extended head
+	priority Priority
+	trace    TraceContext
 }
 
 func (m *RoutePacket) GetMsgtype() byte {
-	return m.RoutePacketHead[0]
+	return m.RoutePacketHead[0] & routeMsgtypeMask
 }
 
+// SetMsgtype keeps the frame flags of the packet, only the bits of typ up to RouteMsgtypeMax are set.
+// see SetMsgtypeChecked to refuse types out of range instead.
 func (m *RoutePacket) SetMsgtype(typ byte) {
-	m.RoutePacketHead[0] = typ
+	m.RoutePacketHead[0] = m.RoutePacketHead[0]&routeFlagMask | typ&routeMsgtypeMask
+}
+
+// SetMsgtypeChecked fails with ErrInvalidMsgtype for types above RouteMsgtypeMax, leaving the packet as it was.
+func (m *RoutePacket) SetMsgtypeChecked(typ byte) error {
+	if typ > RouteMsgtypeMax {
+		return ErrInvalidMsgtype
+	}
+	m.SetMsgtype(typ)
+	return nil
+}
+
+func (m *RoutePacket) HasFlag(f byte) bool {
+	return m.RoutePacketHead[0]&f == f
+}
+
+func (m *RoutePacket) SetFlag(f byte, on bool) {
+	if on {
+		m.RoutePacketHead[0] |= f & routeFlagMask
+	} else {
+		m.RoutePacketHead[0] &^= f & routeFlagMask
+	}
+}
+
+func (m *RoutePacket) GetBodyLen() uint32 {
+	return GetUint24(m.RoutePacketHead[1:4])
 }
 
 func (m *RoutePacket) GetUid() uint32 {
@@ -47,16 +108,82 @@ func (m *RoutePacket) ReadFrom(r io.Reader) (int64, error) {
 	if err != nil {
 		return 0, err
 	}
-	bodylen := GetUint24(m.RoutePacketHead[1:3])
-	if bodylen > 0 {
-		m.Body = make([]byte, bodylen)
-		_, err = io.ReadFull(r, m.Body)
+	// readers of a session only take the flags it negotiated, other high bits are a msgtype out of range
+	pr, session := r.(*packetReader)
+	bodylen := m.GetBodyLen()
+	if session && m.RoutePacketHead[0]&routeFlagMask&^pr.routeFlags != 0 {
+		// the body is skipped, the packets behind it are still framed
+		if err = pr.skip(bodylen); err != nil {
+			return 0, err
+		}
+		return RoutePacketHeadLen + int64(bodylen), ErrInvalidMsgtype
+	}
+	m.Body = nil
+	if bodylen == 0 {
+		return RoutePacketHeadLen, m.readExt()
 	}
-	return (RoutePacketHeadLen + int64(bodylen)), err
+	if session && pr.pool {
+		if err = checkBodyLen(r, bodylen); err != nil {
+			return 0, err
+		}
+		if m.buf = getBuffer(int(bodylen)); m.buf != nil {
+			m.refs = 1
+			m.Body = *m.buf
+			if _, err = io.ReadFull(r, m.Body); err != nil {
+				return 0, err
+			}
+			return (RoutePacketHeadLen + int64(bodylen)), m.readExt()
+		}
+	}
+	if m.Body, err = readBody(r, bodylen); err != nil {
+		return 0, err
+	}
+	return (RoutePacketHeadLen + int64(bodylen)), m.readExt()
+}
+
+func (m *RoutePacket) readExt() error {
+	m.priority = PriorityNormal
+	m.trace = TraceContext{}
+	if !m.HasFlag(RouteFlagExtended) {
+		return nil
+	}
+	n, err := m.parseExt(m.Body)
+	if err != nil {
+		return err
+	}
+	m.Body = m.Body[n:]
+	m.SetFlag(RouteFlagExtended, false)
+	return nil
+}
+
+// appendHead appends the wire head, followed by the extension block when ext is allowed.
+func (m *RoutePacket) appendHead(b []byte, ext bool) ([]byte, error) {
+	n := len(b)
+	b = append(b, m.RoutePacketHead...)
+	// the packet may be shared by several writers, fill flags and length on the copy
+	b[n] &^= RouteFlagExtended
+	if ext && m.hasExt() {
+		b[n] |= RouteFlagExtended
+		b = m.appendExt(b)
+	}
+	bodylen := len(b) - n - RoutePacketHeadLen + len(m.Body)
+	if bodylen > MaxPacketBodyLen {
+		return b[:n], ErrBodyTooLarge
+	}
+	PutUint24(b[n+1:n+4], uint32(bodylen))
+	return b, nil
+}
+
+func (m *RoutePacket) packetBody() []byte {
+	return m.Body
 }
 
 func (m *RoutePacket) WriteTo(w io.Writer) (int64, error) {
-	n, err := w.Write(m.RoutePacketHead)
+	head, err := m.appendHead(make([]byte, 0, RoutePacketHeadLen), true)
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(head)
 	if err != nil {
 		return 0, err
 	}
@@ -69,3 +196,42 @@ func (m *RoutePacket) WriteTo(w io.Writer) (int64, error) {
 	}
 	return int64(n), nil
 }
+
+func (m *RoutePacket) Retain() {
+	if m.buf != nil {
+		atomic.AddInt32(&m.refs, 1)
+	}
+}
+
+// Release drops a reference, the pooled body is recycled once no one holds the packet.
+func (m *RoutePacket) Release() {
+	if m.buf == nil {
+		return
+	}
+	if atomic.AddInt32(&m.refs, -1) == 0 {
+		buf := m.buf
+		m.buf = nil
+		m.Body = nil
+		putBuffer(buf)
+	}
+}
+
+// detachBody swaps the pooled body for b, recycling the old buffer when it is no longer shared.
+func (m *RoutePacket) detachBody(b []byte) {
+	if m.buf != nil && atomic.LoadInt32(&m.refs) <= 1 {
+		putBuffer(m.buf)
+	}
+	m.buf = nil
+	m.refs = 0
+	m.Body = b
+}
+
+// Clone returns a copy with its own head, sharing the body.
+func (m *RoutePacket) Clone() *RoutePacket {
+	ret := NewRoutePacket()
+	copy(ret.RoutePacketHead, m.RoutePacketHead)
+	ret.Body = m.Body
+	ret.priority = m.priority
+	ret.trace = m.trace
+	return ret
+}
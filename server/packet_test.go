@@ -0,0 +1,215 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestReadPacketLimit(t *testing.T) {
+	p := NewRoutePacket()
+	p.SetUid(7)
+	p.Body = make([]byte, 1024)
+	buf := &bytes.Buffer{}
+	if _, err := WritePacket(buf, p); err != nil {
+		t.Fatal(err)
+	}
+	raw := buf.Bytes()
+
+	if _, err := ReadPacket(LimitReader(bytes.NewReader(raw), 1023)); !errors.Is(err, ErrBodyTooLarge) {
+		t.Fatalf("err %v, want ErrBodyTooLarge", err)
+	}
+
+	got, err := ReadPacketT[*RoutePacket](LimitReader(bytes.NewReader(raw), 1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.GetUid() != 7 || len(got.Body) != 1024 {
+		t.Fatalf("unexpected packet")
+	}
+
+	// a header claiming a huge body must not be trusted
+	huge := []byte{HVPacketType, hvPacketFlagHandShake, 0xFF, 0xFF, 0xFF}
+	if _, err := ReadPacket(LimitReader(bytes.NewReader(huge), DefaultMaxHandshakeBodyLen)); !errors.Is(err, ErrBodyTooLarge) {
+		t.Fatalf("err %v, want ErrBodyTooLarge", err)
+	}
+
+	if _, err := ReadPacket(bytes.NewReader(raw[:5])); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("err %v, want ErrUnexpectedEOF", err)
+	}
+	if _, err := ReadPacket(bytes.NewReader([]byte{0x7F})); !errors.Is(err, ErrInvalidPacket) {
+		t.Fatalf("err %v, want ErrInvalidPacket", err)
+	}
+}
+
+// loopReader replays the same frame forever
+type loopReader struct {
+	frame []byte
+	off   int
+}
+
+func (r *loopReader) Read(b []byte) (int, error) {
+	n := copy(b, r.frame[r.off:])
+	r.off = (r.off + n) % len(r.frame)
+	return n, nil
+}
+
+func forwardFrame(b *testing.B, size int) []byte {
+	p := NewRoutePacket()
+	p.SetUid(1)
+	p.Body = make([]byte, size)
+	buf := &bytes.Buffer{}
+	if _, err := WritePacket(buf, p); err != nil {
+		b.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// BenchmarkForward measures the read, retarget and write of one route packet, as the router does.
+func BenchmarkForward(b *testing.B) {
+	frame := forwardFrame(b, 512)
+	r := newPacketReader(&loopReader{frame: frame}, MaxPacketBodyLen, true)
+	w := newPacketWriter(io.Discard)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(frame)))
+	for i := 0; i < b.N; i++ {
+		p, err := ReadPacket(r)
+		if err != nil {
+			b.Fatal(err)
+		}
+		p.(*RoutePacket).SetUid(2)
+		if _, err := w.WritePacket(p); err != nil {
+			b.Fatal(err)
+		}
+		releasePacket(p)
+	}
+}
+
+func BenchmarkForwardUnpooled(b *testing.B) {
+	frame := forwardFrame(b, 512)
+	r := &loopReader{frame: frame}
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(frame)))
+	for i := 0; i < b.N; i++ {
+		p, err := ReadPacket(r)
+		if err != nil {
+			b.Fatal(err)
+		}
+		p.(*RoutePacket).SetUid(2)
+		if _, err := WritePacket(io.Discard, p); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestRouteMsgtype(t *testing.T) {
+	p := NewRoutePacket()
+	if err := p.SetMsgtypeChecked(0x21); err != ErrInvalidMsgtype || p.GetMsgtype() != 0 || p.HasFlag(RouteFlagExtended) {
+		t.Fatalf("msgtype out of range set: %v", err)
+	}
+	// flags are not set through the msgtype
+	p.SetMsgtype(0x21)
+	if p.GetMsgtype() != 1 || p.HasFlag(RouteFlagExtended) {
+		t.Fatalf("msgtype %x set as %x", 0x21, p.RoutePacketHead[0])
+	}
+	if err := p.SetMsgtypeChecked(RouteMsgtypeMax); err != nil {
+		t.Fatal(err)
+	}
+	p.Body = []byte("x")
+
+	// a session reader only takes the flags its peer negotiated
+	raw := &bytes.Buffer{}
+	WritePacket(raw, p)
+	wire := raw.Bytes()
+	wire[1] |= RouteFlagCompressed
+	for _, tc := range []struct {
+		flags byte
+		err   error
+	}{
+		{0, ErrInvalidMsgtype},
+		{CapFragment.routeFlags(), ErrInvalidMsgtype},
+		{CapCompression.routeFlags(), nil},
+	} {
+		pr := newPacketReader(bytes.NewReader(wire), MaxPacketBodyLen, false)
+		pr.routeFlags = tc.flags
+		if _, err := ReadPacket(pr); err != tc.err {
+			t.Fatalf("flags %x: %v", tc.flags, err)
+		}
+	}
+	wire[1] = 0x10
+	if _, err := ReadPacket(newPacketReader(bytes.NewReader(wire), MaxPacketBodyLen, false)); err != ErrInvalidMsgtype {
+		t.Fatalf("reserved bit accepted: %v", err)
+	}
+}
+
+func TestRouteExtendedHead(t *testing.T) {
+	p := NewRoutePacket()
+	p.SetMsgtype(2)
+	p.SetPriority(PriorityBulk)
+	p.Body = []byte("payload")
+
+	buf := &bytes.Buffer{}
+	w := newPacketWriter(buf)
+	w.ext = true
+	if _, err := w.WritePacket(p); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadPacketT[*RoutePacket](buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.GetPriority() != PriorityBulk || got.GetMsgtype() != 2 || string(got.Body) != "payload" || got.HasFlag(RouteFlagExtended) {
+		t.Fatalf("unexpected packet %v %q", got.GetPriority(), got.Body)
+	}
+
+	// peers without the extended head get the plain packet
+	w.ext = false
+	if _, err := w.WritePacket(p); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != 1+RoutePacketHeadLen+len(p.Body) {
+		t.Fatalf("extension written to a peer without support")
+	}
+
+	// peers can not claim the control lane
+	p.SetPriority(PriorityControl)
+	buf.Reset()
+	w.ext = true
+	w.WritePacket(p)
+	if got, _ = ReadPacketT[*RoutePacket](buf); got.GetPriority() != PriorityNormal {
+		t.Fatalf("control priority accepted from peer")
+	}
+}
+
+func TestRouteTraceContext(t *testing.T) {
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	tc, err := ParseTraceparent(traceparent)
+	if err != nil || tc.String() != traceparent || tc.Flags != TraceFlagSampled {
+		t.Fatalf("parse %v %v", tc, err)
+	}
+	for _, v := range []string{"", "00-00000000000000000000000000000000-00f067aa0ba902b7-01", "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", traceparent + "-x"} {
+		if _, err := ParseTraceparent(v); err == nil {
+			t.Fatalf("%q accepted", v)
+		}
+	}
+
+	p := NewRoutePacket()
+	p.SetTrace(tc)
+	p.Body = []byte("payload")
+	buf := &bytes.Buffer{}
+	w := newPacketWriter(buf)
+	w.ext = true
+	if _, err := w.WritePacket(p); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadPacketT[*RoutePacket](buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.GetTrace() != tc || string(got.Body) != "payload" {
+		t.Fatalf("unexpected packet %v %q", got.GetTrace(), got.Body)
+	}
+}
@@ -0,0 +1,31 @@
+//go:build linux
+
+package server
+
+import (
+	"net"
+	"syscall"
+)
+
+func peerCred(conn net.Conn) (PeerCred, error) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return PeerCred{}, ErrPeerCredUnsupported
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return PeerCred{}, err
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return PeerCred{}, err
+	}
+	if credErr != nil {
+		return PeerCred{}, credErr
+	}
+	return PeerCred{PID: cred.Pid, UID: cred.Uid, GID: cred.Gid}, nil
+}
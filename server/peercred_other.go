@@ -0,0 +1,9 @@
+//go:build !linux
+
+package server
+
+import "net"
+
+func peerCred(conn net.Conn) (PeerCred, error) {
+	return PeerCred{}, ErrPeerCredUnsupported
+}
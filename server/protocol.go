@@ -0,0 +1,173 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// ProtocolVersion is the wire protocol version spoken by this release.
+	// version 2 added the compression byte to the hello.
+	ProtocolVersion uint8 = 2
+	// MinProtocolVersion is the oldest peer version accepted by default. version 0 peers
+	// predate the hello, they connect without capabilities until the minimum is raised.
+	MinProtocolVersion uint8 = 0
+)
+
+type Capability uint32
+
+const (
+	CapCompression Capability = 1 << iota
+	CapExtendedRouteHead
+	CapAck
+	CapResume
+	CapFragment
+	// peers answer HVPacketFlagPing, so either side can measure the round trip time
+	CapPing
+)
+
+// SupportedCapabilities are the features this release is able to negotiate.
+var SupportedCapabilities Capability = CapCompression | CapFragment | CapExtendedRouteHead | CapPing
+
+var ErrVersionTooOld = errors.New("protocol version too old")
+var ErrHandshakeRejected = errors.New("handshake rejected")
+
+var capabilityNames = []struct {
+	cap  Capability
+	name string
+}{
+	{CapCompression, "compression"},
+	{CapExtendedRouteHead, "extended-route-head"},
+	{CapAck, "ack"},
+	{CapResume, "resume"},
+	{CapFragment, "fragment"},
+	{CapPing, "ping"},
+}
+
+func (c Capability) Has(f Capability) bool {
+	return c&f == f
+}
+
+func (c Capability) String() string {
+	if c == 0 {
+		return "none"
+	}
+	names := []string{}
+	for _, v := range capabilityNames {
+		if c.Has(v.cap) {
+			names = append(names, v.name)
+			c &^= v.cap
+		}
+	}
+	if c != 0 {
+		names = append(names, fmt.Sprintf("0x%x", uint32(c)))
+	}
+	return strings.Join(names, "|")
+}
+
+// handshakeHello is carried in the body of the handshake packet sent by the client
+// and at the front of the ack result sent back by the server.
+// a legacy peer sends an empty body, which decodes as version 0.
+type handshakeHello struct {
+	Version uint8
+	Caps    Capability
+	// offered compressions from the client, the chosen one from the server
+	Compress CompressAlgo
+}
+
+const (
+	handshakeHelloLen = 6
+	// version 1 hellos end before the compression byte
+	handshakeHelloV1Len = 5
+)
+
+func (h *handshakeHello) Marshal() []byte {
+	if h.Version < 2 {
+		ret := make([]byte, handshakeHelloV1Len)
+		ret[0] = h.Version
+		binary.LittleEndian.PutUint32(ret[1:5], uint32(h.Caps&^CapCompression))
+		return ret
+	}
+	ret := make([]byte, handshakeHelloLen)
+	ret[0] = h.Version
+	binary.LittleEndian.PutUint32(ret[1:5], uint32(h.Caps))
+	ret[5] = byte(h.Compress)
+	return ret
+}
+
+// Unmarshal decodes the hello and returns the number of bytes consumed.
+func (h *handshakeHello) Unmarshal(b []byte) (int, error) {
+	if len(b) == 0 {
+		h.Version = 0
+		h.Caps = 0
+		h.Compress = CompressNone
+		return 0, nil
+	}
+	if b[0] < 2 {
+		if len(b) < handshakeHelloV1Len {
+			return 0, ErrInvalidPacket
+		}
+		h.Version = b[0]
+		h.Caps = Capability(binary.LittleEndian.Uint32(b[1:5])) &^ CapCompression
+		h.Compress = CompressNone
+		return handshakeHelloV1Len, nil
+	}
+	if len(b) < handshakeHelloLen {
+		return 0, ErrInvalidPacket
+	}
+	h.Version = b[0]
+	h.Caps = Capability(binary.LittleEndian.Uint32(b[1:5]))
+	h.Compress = CompressAlgo(b[5])
+	return handshakeHelloLen, nil
+}
+
+// routeFlags returns the route frame flags a session with caps may receive.
+func (c Capability) routeFlags() byte {
+	var ret byte
+	if c.Has(CapCompression) {
+		ret |= RouteFlagCompressed
+	}
+	if c.Has(CapFragment) {
+		ret |= RouteFlagFragment
+	}
+	if c.Has(CapExtendedRouteHead) {
+		ret |= RouteFlagExtended
+	}
+	return ret
+}
+
+func negotiateVersion(local, remote uint8) uint8 {
+	if remote < local {
+		return remote
+	}
+	return local
+}
+
+// legacyAckFail is the ack result of a version 0 server refusing the client.
+const legacyAckFail = "fail"
+
+// isLegacyAck tells the ack result of a version 0 server, a bare session id or legacyAckFail
+// without a hello in front. both start with a printable byte, far above any version.
+func isLegacyAck(b []byte) bool {
+	return len(b) > 0 && b[0] >= ' '
+}
+
+// refusePacket tells a peer of version why its handshake failed, in a packet it understands.
+func refusePacket(version uint8, reason string) *HVPacket {
+	if version == 0 {
+		p := NewHVPacket()
+		p.SetFlag(hvPacketFlagAckResult)
+		p.SetBody([]byte(legacyAckFail))
+		return p
+	}
+	return rejectPacket(reason)
+}
+
+func rejectPacket(reason string) *HVPacket {
+	p := NewHVPacket()
+	p.SetFlag(hvPacketFlagReject)
+	p.SetBody([]byte(reason))
+	return p
+}
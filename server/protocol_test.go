@@ -0,0 +1,164 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestHandshakeHello(t *testing.T) {
+	h := &handshakeHello{Version: 3, Caps: CapCompression | CapAck}
+	raw := append(h.Marshal(), "sid"...)
+
+	got := &handshakeHello{}
+	n, err := got.Unmarshal(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *got != *h || string(raw[n:]) != "sid" {
+		t.Fatalf("unexpected hello %+v, rest %q", got, raw[n:])
+	}
+
+	if n, err := got.Unmarshal(nil); err != nil || n != 0 || got.Version != 0 {
+		t.Fatalf("legacy hello should decode as version 0")
+	}
+	if _, err := got.Unmarshal([]byte{1, 2}); err == nil {
+		t.Fatalf("short hello should fail")
+	}
+
+	// version 1 hellos have no compression byte
+	v1 := (&handshakeHello{Version: 1, Caps: CapCompression | CapFragment, Compress: CompressGzip}).Marshal()
+	if len(v1) != handshakeHelloV1Len {
+		t.Fatalf("version 1 hello of %d bytes", len(v1))
+	}
+	if n, err := got.Unmarshal(append(v1, "sid"...)); err != nil || n != handshakeHelloV1Len || got.Caps != CapFragment || got.Compress != CompressNone {
+		t.Fatalf("version 1 hello %+v %d %v", got, n, err)
+	}
+}
+
+func TestHandshakeNegotiate(t *testing.T) {
+	svr, err := NewTcpServer(TcpServerOptions{ListenAddr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	svr.Start()
+	defer svr.Stop()
+
+	cli := NewTcpClient(TcpClientOptions{
+		RemoteAddress:        svr.Address().String(),
+		ReconnectDelaySecond: -1,
+	})
+	if err := cli.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer cli.Close()
+
+	if cli.ProtocolVersion() != ProtocolVersion {
+		t.Fatalf("version %d, want %d", cli.ProtocolVersion(), ProtocolVersion)
+	}
+	if cli.Capabilities() != SupportedCapabilities {
+		t.Fatalf("caps %v, want %v", cli.Capabilities(), SupportedCapabilities)
+	}
+}
+
+func TestHandshakeRejectOldPeer(t *testing.T) {
+	svr, err := NewTcpServer(TcpServerOptions{ListenAddr: "127.0.0.1:0", MinProtocolVersion: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	svr.Start()
+	defer svr.Stop()
+
+	conn, err := net.Dial("tcp", svr.Address().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// legacy handshake without hello body, refused the way it understands
+	p := NewHVPacket()
+	p.SetFlag(hvPacketFlagHandShake)
+	if _, err := WritePacket(conn, p); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := ReadPacketT[*HVPacket](conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.GetFlag() != hvPacketFlagAckResult || string(resp.GetBody()) != legacyAckFail {
+		t.Fatalf("flag %x body %q, want a legacy fail", resp.GetFlag(), resp.GetBody())
+	}
+
+	cli := NewTcpClient(TcpClientOptions{MinProtocolVersion: ProtocolVersion + 1, ReconnectDelaySecond: -1})
+	c2, err := net.Dial("tcp", svr.Address().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	if err := cli.doHandShake(c2); !errors.Is(err, ErrVersionTooOld) {
+		t.Fatalf("err %v, want ErrVersionTooOld", err)
+	}
+}
+
+func TestHandshakeLegacy(t *testing.T) {
+	// version 0 clients still connect to a server left at the default minimum
+	svr, err := NewTcpServer(TcpServerOptions{ListenAddr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	svr.Start()
+	defer svr.Stop()
+	conn, err := net.Dial("tcp", svr.Address().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	p := NewHVPacket()
+	p.SetFlag(hvPacketFlagHandShake)
+	WritePacket(conn, p)
+	resp, err := ReadPacketT[*HVPacket](conn)
+	if err != nil || resp.GetFlag() != hvPacketFlagAckResult || !isLegacyAck(resp.GetBody()) {
+		t.Fatalf("legacy client not answered with a bare session id: %v %q", err, resp.GetBody())
+	}
+
+	// clients against servers answering with acks of their own making
+	answer := func(body []byte) (*tcpClient, error) {
+		local, remote := net.Pipe()
+		defer local.Close()
+		go func() {
+			defer remote.Close()
+			if _, err := ReadPacketT[*HVPacket](remote); err != nil {
+				return
+			}
+			ack := NewHVPacket()
+			ack.SetFlag(hvPacketFlagAckResult)
+			ack.SetBody(body)
+			WritePacket(remote, ack)
+		}()
+		cli := NewTcpClient(TcpClientOptions{ReconnectDelaySecond: -1, DisabledCapabilities: CapFragment})
+		return cli, cli.doHandShake(local)
+	}
+	cli, err := answer([]byte("1_1760000000"))
+	if err != nil || cli.tcpSocket.id != "1_1760000000" || cli.tcpSocket.version != 0 || cli.tcpSocket.caps != 0 {
+		t.Fatalf("legacy ack: %v id %q version %d caps %v", err, cli.tcpSocket.id, cli.tcpSocket.version, cli.tcpSocket.caps)
+	}
+	if _, err := answer([]byte(legacyAckFail)); err == nil {
+		t.Fatal("legacy fail accepted")
+	}
+	newer := &handshakeHello{Version: ProtocolVersion + 1, Caps: SupportedCapabilities}
+	if _, err := answer(append(newer.Marshal(), "1_1"...)); err == nil {
+		t.Fatal("ack above the offered version accepted")
+	}
+	all := &handshakeHello{Version: ProtocolVersion, Caps: ^Capability(0)}
+	cli, err = answer(append(all.Marshal(), "1_1"...))
+	if err != nil || cli.tcpSocket.caps != SupportedCapabilities&^CapFragment || cli.tcpSocket.id != "1_1" {
+		t.Fatalf("caps not limited to the offer: %v %v", err, cli.tcpSocket.caps)
+	}
+	if cli.tcpSocket.reader.routeFlags&RouteFlagFragment != 0 {
+		t.Fatal("fragment flag allowed without the capability")
+	}
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var ErrInvalidProxyHeader = errors.New("invalid proxy protocol header")
+
+// ProxyProtocolOptions enables HAProxy PROXY protocol v1 and v2 headers from load balancers,
+// the address they carry becomes the RemoteAddr of the session. tcp and tls listeners only.
+type ProxyProtocolOptions struct {
+	// ips or cidrs of the balancers allowed to send a header, empty disables the protocol.
+	// headers from any other peer are not parsed and fail the handshake.
+	TrustedSources []string
+	// trusted peers must send a header, otherwise connections without one are taken as they are
+	Required bool
+}
+
+const proxyV1MaxLen = 107
+
+var proxyV2Sig = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyConn replays what was read past the header and reports the proxied addresses.
+type proxyConn struct {
+	net.Conn
+	r      *bufio.Reader
+	remote net.Addr
+	local  net.Addr
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	if c.r != nil {
+		if c.r.Buffered() > 0 {
+			return c.r.Read(b)
+		}
+		c.r = nil
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+func (c *proxyConn) LocalAddr() net.Addr {
+	if c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+// readProxyHeader consumes a PROXY header from conn if there is one.
+// the returned conn must be used instead of conn even when no header was sent.
+func readProxyHeader(conn net.Conn, required bool, timeout time.Duration) (net.Conn, error) {
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+
+	r := bufio.NewReaderSize(conn, 256)
+	ret := &proxyConn{Conn: conn, r: r}
+
+	// our own packets start with a packet type byte, neither 'P' nor '\r'
+	first, err := r.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch first[0] {
+	case 'P':
+		err = ret.readV1(r)
+	case '\r':
+		err = ret.readV2(r)
+	default:
+		if required {
+			err = ErrInvalidProxyHeader
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (c *proxyConn) readV1(r *bufio.Reader) error {
+	var line []byte
+	for len(line) < proxyV1MaxLen {
+		b, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return ErrInvalidProxyHeader
+	}
+	fields := strings.Split(string(line[:len(line)-2]), " ")
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return ErrInvalidProxyHeader
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil
+	}
+	if (fields[1] != "TCP4" && fields[1] != "TCP6") || len(fields) != 6 {
+		return ErrInvalidProxyHeader
+	}
+	src, err := parseProxyV1Addr(fields[2], fields[4])
+	if err != nil {
+		return err
+	}
+	dst, err := parseProxyV1Addr(fields[3], fields[5])
+	if err != nil {
+		return err
+	}
+	c.remote, c.local = src, dst
+	return nil
+}
+
+func parseProxyV1Addr(ip, port string) (*net.TCPAddr, error) {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return nil, ErrInvalidProxyHeader
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, ErrInvalidProxyHeader
+	}
+	return &net.TCPAddr{IP: addr, Port: int(p)}, nil
+}
+
+func (c *proxyConn) readV2(r *bufio.Reader) error {
+	head, err := r.Peek(16)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(head[:12], proxyV2Sig) || head[12]>>4 != 2 {
+		return ErrInvalidProxyHeader
+	}
+	cmd, family := head[12]&0x0F, head[13]
+	size := int(binary.BigEndian.Uint16(head[14:]))
+	if _, err := r.Discard(16); err != nil {
+		return err
+	}
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return err
+	}
+
+	switch cmd {
+	case 0x0:
+		// LOCAL, health checks of the balancer itself
+		return nil
+	case 0x1:
+	default:
+		return ErrInvalidProxyHeader
+	}
+
+	// only the address families are used, tlvs that follow them are skipped
+	switch family >> 4 {
+	case 0x1:
+		if len(body) < 12 {
+			return ErrInvalidProxyHeader
+		}
+		c.remote = &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:]))}
+		c.local = &net.TCPAddr{IP: net.IP(body[4:8]), Port: int(binary.BigEndian.Uint16(body[10:]))}
+	case 0x2:
+		if len(body) < 36 {
+			return ErrInvalidProxyHeader
+		}
+		c.remote = &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:]))}
+		c.local = &net.TCPAddr{IP: net.IP(body[16:32]), Port: int(binary.BigEndian.Uint16(body[34:]))}
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestProxyHeader(t *testing.T) {
+	v2 := append([]byte{}, proxyV2Sig...)
+	v2 = append(v2, 0x21, 0x11, 0, 12, 192, 0, 2, 1, 10, 0, 0, 1, 0x30, 0x39, 0x1F, 0x90)
+
+	cases := []struct {
+		name   string
+		header []byte
+		remote string
+	}{
+		{"v1", []byte("PROXY TCP4 192.0.2.1 10.0.0.1 12345 8080\r\n"), "192.0.2.1:12345"},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::1 ::1 12345 8080\r\n"), "[2001:db8::1]:12345"},
+		{"v2", v2, "192.0.2.1:12345"},
+		{"none", nil, ""},
+	}
+	for _, c := range cases {
+		local, remote := net.Pipe()
+		go func() {
+			remote.Write(append(c.header, HVPacketType, 1, 2))
+			remote.Close()
+		}()
+		conn, err := readProxyHeader(local, false, time.Second)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if c.remote != "" && conn.RemoteAddr().String() != c.remote {
+			t.Fatalf("%s: remote %v, want %v", c.name, conn.RemoteAddr(), c.remote)
+		}
+		rest := make([]byte, 3)
+		if _, err := io.ReadFull(conn, rest); err != nil || rest[0] != HVPacketType {
+			t.Fatalf("%s: stream after header %v %v", c.name, rest, err)
+		}
+	}
+
+	local, remote := net.Pipe()
+	go remote.Write([]byte{HVPacketType, 1, 2})
+	if _, err := readProxyHeader(local, true, time.Second); err != ErrInvalidProxyHeader {
+		t.Fatalf("missing required header accepted: %v", err)
+	}
+	remote.Close()
+}
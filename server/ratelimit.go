@@ -0,0 +1,187 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// RateLimit is a token bucket refilled with Rate tokens per second, holding at most Burst.
+// a zero Rate means unlimited.
+type RateLimit struct {
+	Rate  float64
+	Burst float64
+}
+
+func (l RateLimit) Unlimited() bool {
+	return l.Rate <= 0
+}
+
+type TokenBucket struct {
+	mu     sync.Mutex
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+}
+
+func NewTokenBucket(l RateLimit) *TokenBucket {
+	if l.Burst < 1 {
+		l.Burst = l.Rate
+		if l.Burst < 1 {
+			l.Burst = 1
+		}
+	}
+	return &TokenBucket{
+		limit:  l,
+		tokens: l.Burst,
+		last:   time.Now(),
+	}
+}
+
+func (b *TokenBucket) Allow() bool {
+	return b.AllowN(time.Now(), 1)
+}
+
+// AllowN takes n tokens if they are available at now.
+func (b *TokenBucket) AllowN(now time.Time, n float64) bool {
+	if b.limit.Unlimited() {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// Take consumes n tokens as long as the bucket is not empty, running into debt for a large n.
+// it suits byte limits, where a single message may be bigger than the burst.
+func (b *TokenBucket) Take(now time.Time, n float64) bool {
+	if b.limit.Unlimited() {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	if b.tokens <= 0 {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+func (b *TokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * b.limit.Rate
+		if b.tokens > b.limit.Burst {
+			b.tokens = b.limit.Burst
+		}
+		b.last = now
+	}
+}
+
+// Full reports whether the bucket refilled completely, so forgetting it changes nothing.
+func (b *TokenBucket) Full(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(now)
+	return b.tokens >= b.limit.Burst
+}
+
+type IPLimitOptions struct {
+	// connection attempts per second from one ip
+	ConnRate RateLimit
+	// concurrent connections from one ip, 0 means unlimited
+	MaxConns int
+}
+
+// ipLimiter tracks connection attempts and live connections per remote ip.
+type ipLimiter struct {
+	opts IPLimitOptions
+
+	mu      sync.Mutex
+	buckets map[string]*TokenBucket
+	conns   map[string]int
+	sweepAt time.Time
+}
+
+func newIPLimiter(opts IPLimitOptions) *ipLimiter {
+	return &ipLimiter{
+		opts:    opts,
+		buckets: make(map[string]*TokenBucket),
+		conns:   make(map[string]int),
+	}
+}
+
+// setOptions applies to the next connection attempts, live connections are still counted.
+func (l *ipLimiter) setOptions(opts IPLimitOptions) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.opts = opts
+	l.buckets = make(map[string]*TokenBucket)
+}
+
+func hostOf(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	if tcp, ok := addr.(*net.TCPAddr); ok {
+		return tcp.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// acquire admits a new connection from ip, release must be called when it closes.
+func (l *ipLimiter) acquire(ip string) bool {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+
+	if !l.opts.ConnRate.Unlimited() {
+		b, has := l.buckets[ip]
+		if !has {
+			b = NewTokenBucket(l.opts.ConnRate)
+			l.buckets[ip] = b
+		}
+		if !b.AllowN(now, 1) {
+			return false
+		}
+	}
+	if l.opts.MaxConns > 0 && l.conns[ip] >= l.opts.MaxConns {
+		return false
+	}
+	l.conns[ip]++
+	return true
+}
+
+func (l *ipLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conns[ip] <= 1 {
+		delete(l.conns, ip)
+	} else {
+		l.conns[ip]--
+	}
+}
+
+// sweep forgets buckets that are full again, at most once a minute.
+func (l *ipLimiter) sweep(now time.Time) {
+	if now.Before(l.sweepAt) {
+		return
+	}
+	l.sweepAt = now.Add(time.Minute)
+	for ip, b := range l.buckets {
+		if b.Full(now) {
+			delete(l.buckets, ip)
+		}
+	}
+}
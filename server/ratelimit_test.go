@@ -0,0 +1,52 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := NewTokenBucket(RateLimit{Rate: 10, Burst: 5})
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		if !b.AllowN(now, 1) {
+			t.Fatalf("burst token %d refused", i)
+		}
+	}
+	if b.AllowN(now, 1) {
+		t.Fatalf("empty bucket allowed")
+	}
+	if !b.AllowN(now.Add(100*time.Millisecond), 1) {
+		t.Fatalf("bucket not refilled")
+	}
+
+	bytes := NewTokenBucket(RateLimit{Rate: 100, Burst: 100})
+	if !bytes.Take(now, 1000) || bytes.Take(now, 1) {
+		t.Fatalf("take should allow one large message, then run into debt")
+	}
+
+	if !NewTokenBucket(RateLimit{}).AllowN(now, 1e9) {
+		t.Fatalf("zero rate should be unlimited")
+	}
+}
+
+func TestIPLimiter(t *testing.T) {
+	l := newIPLimiter(IPLimitOptions{
+		ConnRate: RateLimit{Rate: 1, Burst: 3},
+		MaxConns: 2,
+	})
+	if !l.acquire("10.0.0.1") || !l.acquire("10.0.0.1") {
+		t.Fatalf("connections under the limit refused")
+	}
+	if l.acquire("10.0.0.1") {
+		t.Fatalf("concurrent limit not applied")
+	}
+	if !l.acquire("10.0.0.2") {
+		t.Fatalf("limit leaked to another ip")
+	}
+	l.release("10.0.0.1")
+	// the slot is free again, but the attempt budget is spent
+	if l.acquire("10.0.0.1") {
+		t.Fatalf("connection rate not applied")
+	}
+}
@@ -0,0 +1,106 @@
+package server
+
+import "encoding/binary"
+
+// Priority selects the send lane of a packet.
+type Priority uint8
+
+const (
+	PriorityNormal Priority = iota
+	PriorityHigh
+	PriorityBulk
+	// heartbeats, kicks and handshake traffic
+	PriorityControl
+
+	priorityCount
+)
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityNormal:
+		return "normal"
+	case PriorityHigh:
+		return "high"
+	case PriorityBulk:
+		return "bulk"
+	case PriorityControl:
+		return "control"
+	}
+	return "unknown"
+}
+
+// a route packet flagged RouteFlagExtended carries an extension block in front of its body:
+// 2 bytes length, then entries of 1 byte id, 1 byte length and the value.
+// unknown entries are skipped, so new ones can be added without a version bump.
+const (
+	routeExtPriority byte = 1
+	// w3c trace context: version, trace id, span id and flags
+	routeExtTrace byte = 2
+)
+
+const maxRouteExtLen = 1024
+
+func (m *RoutePacket) GetPriority() Priority {
+	return m.priority
+}
+
+// SetPriority sets the lane the packet is queued in, it travels in the extended head when the peer supports it.
+func (m *RoutePacket) SetPriority(p Priority) {
+	m.priority = p
+}
+
+// GetTrace returns the trace context the packet carries, the zero value when it has none.
+func (m *RoutePacket) GetTrace() TraceContext {
+	return m.trace
+}
+
+// SetTrace attaches a trace context, it travels in the extended head when the peer supports it.
+func (m *RoutePacket) SetTrace(t TraceContext) {
+	m.trace = t
+}
+
+func (m *RoutePacket) hasExt() bool {
+	return m.priority != PriorityNormal || m.trace.IsValid()
+}
+
+func (m *RoutePacket) appendExt(b []byte) []byte {
+	start := len(b)
+	b = append(b, 0, 0)
+	if m.priority != PriorityNormal {
+		b = append(b, routeExtPriority, 1, byte(m.priority))
+	}
+	if m.trace.IsValid() {
+		b = m.trace.appendBinary(append(b, routeExtTrace, traceContextLen))
+	}
+	binary.LittleEndian.PutUint16(b[start:], uint16(len(b)-start-2))
+	return b
+}
+
+// parseExt decodes the extension block at the front of b and returns its length.
+func (m *RoutePacket) parseExt(b []byte) (int, error) {
+	if len(b) < 2 {
+		return 0, ErrInvalidPacket
+	}
+	extLen := int(binary.LittleEndian.Uint16(b))
+	if extLen > maxRouteExtLen || 2+extLen > len(b) {
+		return 0, ErrInvalidPacket
+	}
+	ext := b[2 : 2+extLen]
+	for len(ext) > 0 {
+		if len(ext) < 2 || 2+int(ext[1]) > len(ext) {
+			return 0, ErrInvalidPacket
+		}
+		id, val := ext[0], ext[2:2+int(ext[1])]
+		switch id {
+		case routeExtPriority:
+			// the control lane is not open to peers
+			if len(val) == 1 && Priority(val[0]) < PriorityControl {
+				m.priority = Priority(val[0])
+			}
+		case routeExtTrace:
+			m.trace.unmarshalBinary(val)
+		}
+		ext = ext[2+len(val):]
+	}
+	return 2 + extLen, nil
+}
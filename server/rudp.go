@@ -0,0 +1,710 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// rudp is a small selective repeat ARQ over udp, in the spirit of KCP. it turns datagrams
+// into a reliable ordered stream, so udp sessions run the same handshake and packet code
+// as tcp ones, while a lost datagram only delays the bytes behind it for one rto instead of
+// a tcp backoff.
+//
+// a datagram holds one or more segments:
+//
+//	conv u32 | cmd u8 | sn u32 | una u32 | wnd u16 | len u16 | data
+//
+// conv tells connections from the same address apart, una acknowledges everything below it
+// and every push is also acknowledged on its own, which drives fast retransmits.
+const (
+	rudpHeadLen = 17
+	rudpMTU     = 1400
+	rudpMaxData = rudpMTU - rudpHeadLen
+
+	rudpCmdPush byte = 1
+	rudpCmdAck  byte = 2
+	// sequenced like a push, ends the stream once everything before it was delivered
+	rudpCmdFin byte = 3
+
+	// segments in flight, and received out of order
+	rudpWnd      = 256
+	rudpInterval = 10 * time.Millisecond
+	rudpMinRTO   = 30 * time.Millisecond
+	rudpMaxRTO   = 3 * time.Second
+	// a segment timing out this many times means the peer is gone
+	rudpDeadLink = 20
+	// resend without waiting for the rto once this many later segments were acked
+	rudpFastResend = 2
+	// how long Close keeps sending what is queued
+	rudpLinger = 2 * time.Second
+)
+
+var errRUDPDeadLink = errors.New("rudp: peer stopped acknowledging")
+
+type rudpSegment struct {
+	cmd      byte
+	sn       uint32
+	data     []byte
+	sentAt   time.Time
+	resendAt time.Time
+	rto      time.Duration
+	xmit     int
+	timeouts int
+	fastack  int
+	// fast resent since the last timeout
+	fastDone bool
+}
+
+// seqBefore compares sequence numbers across the wrap around.
+func seqBefore(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+type rudpConn struct {
+	conv   uint32
+	pc     net.PacketConn
+	remote net.Addr
+	// called once the connection is torn down
+	onClose func()
+
+	mu sync.Mutex
+
+	sndNxt   uint32
+	sndUna   uint32
+	sndQueue []*rudpSegment
+	sndBuf   []*rudpSegment
+	rmtWnd   uint16
+
+	srtt   time.Duration
+	rttvar time.Duration
+	rto    time.Duration
+
+	rcvNxt   uint32
+	rcvBuf   map[uint32]*rudpSegment
+	rcvQueue []byte
+	acks     []uint32
+	eof      bool
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	closing  bool
+	lingerAt time.Time
+	err      error
+
+	chReadable chan struct{}
+	chWritable chan struct{}
+	die        chan struct{}
+	dieOnce    sync.Once
+
+	out []byte
+}
+
+// newRUDPConn sends nothing until the caller starts updateWork.
+func newRUDPConn(conv uint32, pc net.PacketConn, remote net.Addr, onClose func()) *rudpConn {
+	c := &rudpConn{
+		conv:       conv,
+		pc:         pc,
+		remote:     remote,
+		onClose:    onClose,
+		rmtWnd:     rudpWnd,
+		rto:        200 * time.Millisecond,
+		rcvBuf:     make(map[uint32]*rudpSegment),
+		chReadable: make(chan struct{}, 1),
+		chWritable: make(chan struct{}, 1),
+		die:        make(chan struct{}),
+		out:        make([]byte, 0, rudpMTU),
+	}
+	return c
+}
+
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func (c *rudpConn) wait(ch chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-ch:
+		return nil
+	case <-c.die:
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	}
+}
+
+func (c *rudpConn) Read(b []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		if len(c.rcvQueue) > 0 {
+			n := copy(b, c.rcvQueue)
+			c.rcvQueue = c.rcvQueue[n:]
+			c.mu.Unlock()
+			return n, nil
+		}
+		if c.eof {
+			c.mu.Unlock()
+			return 0, io.EOF
+		}
+		if c.closing || c.err != nil {
+			err := c.err
+			c.mu.Unlock()
+			if err == nil {
+				err = net.ErrClosed
+			}
+			return 0, err
+		}
+		deadline := c.readDeadline
+		c.mu.Unlock()
+
+		if err := c.wait(c.chReadable, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (c *rudpConn) Write(b []byte) (int, error) {
+	n := 0
+	for n < len(b) {
+		c.mu.Lock()
+		if c.closing || c.err != nil {
+			err := c.err
+			c.mu.Unlock()
+			if err == nil {
+				err = net.ErrClosed
+			}
+			return n, err
+		}
+		if len(c.sndQueue)+len(c.sndBuf) >= 2*rudpWnd {
+			deadline := c.writeDeadline
+			c.mu.Unlock()
+			if err := c.wait(c.chWritable, deadline); err != nil {
+				return n, err
+			}
+			continue
+		}
+		for n < len(b) && len(c.sndQueue)+len(c.sndBuf) < 2*rudpWnd {
+			size := len(b) - n
+			if size > rudpMaxData {
+				size = rudpMaxData
+			}
+			data := make([]byte, size)
+			copy(data, b[n:])
+			c.sndQueue = append(c.sndQueue, &rudpSegment{cmd: rudpCmdPush, data: data})
+			n += size
+		}
+		c.flush(time.Now())
+		c.mu.Unlock()
+	}
+	return n, nil
+}
+
+// Close sends a fin behind the queued data and keeps retransmitting for a while.
+func (c *rudpConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closing {
+		return nil
+	}
+	c.closing = true
+	c.lingerAt = time.Now().Add(rudpLinger)
+	if c.err == nil && !c.eof {
+		c.sndQueue = append(c.sndQueue, &rudpSegment{cmd: rudpCmdFin})
+		c.flush(time.Now())
+	}
+	notify(c.chReadable)
+	notify(c.chWritable)
+	return nil
+}
+
+func (c *rudpConn) teardown(err error) {
+	if c.err == nil {
+		c.err = err
+	}
+	c.dieOnce.Do(func() {
+		close(c.die)
+		if c.onClose != nil {
+			go c.onClose()
+		}
+	})
+}
+
+func (c *rudpConn) LocalAddr() net.Addr {
+	return c.pc.LocalAddr()
+}
+
+func (c *rudpConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *rudpConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *rudpConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	notify(c.chReadable)
+	return nil
+}
+
+func (c *rudpConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.writeDeadline = t
+	c.mu.Unlock()
+	notify(c.chWritable)
+	return nil
+}
+
+func (c *rudpConn) updateWork() {
+	tk := time.NewTicker(rudpInterval)
+	defer tk.Stop()
+	for {
+		select {
+		case <-c.die:
+			return
+		case now := <-tk.C:
+			c.mu.Lock()
+			c.flush(now)
+			if c.closing && (len(c.sndQueue)+len(c.sndBuf) == 0 || now.After(c.lingerAt)) {
+				c.teardown(net.ErrClosed)
+			}
+			c.mu.Unlock()
+		}
+	}
+}
+
+// rcvWnd counts what the application did not read yet too, so a slow reader stops the sender.
+func (c *rudpConn) rcvWnd() uint16 {
+	if n := c.rcvLimit() - len(c.rcvBuf); n > 0 {
+		return uint16(n)
+	}
+	return 0
+}
+
+// rcvLimit is how many segments past rcvNxt are buffered, the window less what was not read yet.
+func (c *rudpConn) rcvLimit() int {
+	if n := rudpWnd - len(c.rcvQueue)/rudpMaxData; n > 0 {
+		return n
+	}
+	return 0
+}
+
+func (c *rudpConn) appendSegment(cmd byte, sn uint32, data []byte) {
+	if len(c.out)+rudpHeadLen+len(data) > rudpMTU {
+		c.output()
+	}
+	var head [rudpHeadLen]byte
+	binary.LittleEndian.PutUint32(head[0:], c.conv)
+	head[4] = cmd
+	binary.LittleEndian.PutUint32(head[5:], sn)
+	binary.LittleEndian.PutUint32(head[9:], c.rcvNxt)
+	binary.LittleEndian.PutUint16(head[13:], c.rcvWnd())
+	binary.LittleEndian.PutUint16(head[15:], uint16(len(data)))
+	c.out = append(c.out, head[:]...)
+	c.out = append(c.out, data...)
+}
+
+func (c *rudpConn) output() {
+	if len(c.out) == 0 {
+		return
+	}
+	c.pc.WriteTo(c.out, c.remote)
+	c.out = c.out[:0]
+}
+
+// flush sends pending acks, new segments the window allows and the ones due for a resend.
+func (c *rudpConn) flush(now time.Time) {
+	if c.err != nil {
+		return
+	}
+
+	for _, sn := range c.acks {
+		c.appendSegment(rudpCmdAck, sn, nil)
+	}
+	c.acks = c.acks[:0]
+
+	wnd := int(c.rmtWnd)
+	if wnd > rudpWnd {
+		wnd = rudpWnd
+	}
+	if wnd == 0 {
+		// keep probing a full peer with one segment
+		wnd = 1
+	}
+	for len(c.sndQueue) > 0 && int(c.sndNxt-c.sndUna) < wnd {
+		seg := c.sndQueue[0]
+		c.sndQueue[0] = nil
+		c.sndQueue = c.sndQueue[1:]
+		seg.sn = c.sndNxt
+		c.sndNxt++
+		c.sndBuf = append(c.sndBuf, seg)
+	}
+
+	for _, seg := range c.sndBuf {
+		switch {
+		case seg.xmit == 0:
+			seg.rto = c.rto
+		case !now.Before(seg.resendAt):
+			seg.timeouts++
+			seg.fastDone = false
+			seg.rto += seg.rto / 2
+			if seg.rto > rudpMaxRTO {
+				seg.rto = rudpMaxRTO
+			}
+		case seg.fastack >= rudpFastResend && !seg.fastDone:
+			seg.fastDone = true
+		default:
+			continue
+		}
+		seg.xmit++
+		seg.fastack = 0
+		seg.sentAt = now
+		seg.resendAt = now.Add(seg.rto)
+		if seg.timeouts >= rudpDeadLink {
+			c.output()
+			c.teardown(errRUDPDeadLink)
+			notify(c.chReadable)
+			notify(c.chWritable)
+			return
+		}
+		c.appendSegment(seg.cmd, seg.sn, seg.data)
+	}
+	c.output()
+}
+
+func (c *rudpConn) updateRTT(rtt time.Duration) {
+	if c.srtt == 0 {
+		c.srtt = rtt
+		c.rttvar = rtt / 2
+	} else {
+		delta := rtt - c.srtt
+		if delta < 0 {
+			delta = -delta
+		}
+		c.rttvar = (3*c.rttvar + delta) / 4
+		c.srtt = (7*c.srtt + rtt) / 8
+	}
+	rto := c.srtt + 4*c.rttvar
+	if rto < c.srtt+rudpInterval {
+		rto = c.srtt + rudpInterval
+	}
+	if rto < rudpMinRTO {
+		rto = rudpMinRTO
+	}
+	if rto > rudpMaxRTO {
+		rto = rudpMaxRTO
+	}
+	c.rto = rto
+}
+
+// input handles a datagram from the peer.
+func (c *rudpConn) input(b []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+
+	now := time.Now()
+	delivered := false
+	acked := false
+	for len(b) >= rudpHeadLen {
+		conv := binary.LittleEndian.Uint32(b[0:])
+		cmd := b[4]
+		sn := binary.LittleEndian.Uint32(b[5:])
+		una := binary.LittleEndian.Uint32(b[9:])
+		wnd := binary.LittleEndian.Uint16(b[13:])
+		size := int(binary.LittleEndian.Uint16(b[15:]))
+		if conv != c.conv || rudpHeadLen+size > len(b) {
+			return
+		}
+		data := b[rudpHeadLen : rudpHeadLen+size]
+		b = b[rudpHeadLen+size:]
+
+		c.rmtWnd = wnd
+		if c.ackUna(una) {
+			acked = true
+		}
+
+		switch cmd {
+		case rudpCmdAck:
+			if c.ackSn(sn, now) {
+				acked = true
+			}
+		case rudpCmdPush, rudpCmdFin:
+			if seqBefore(sn, c.rcvNxt) {
+				// delivered already, its ack was lost
+				c.acks = append(c.acks, sn)
+				continue
+			}
+			if !seqBefore(sn, c.rcvNxt+uint32(c.rcvLimit())) {
+				// a peer ignoring the window resends it once the application read
+				continue
+			}
+			c.acks = append(c.acks, sn)
+			if _, has := c.rcvBuf[sn]; !has {
+				c.rcvBuf[sn] = &rudpSegment{cmd: cmd, sn: sn, data: append([]byte(nil), data...)}
+			}
+			for {
+				seg, has := c.rcvBuf[c.rcvNxt]
+				if !has {
+					break
+				}
+				delete(c.rcvBuf, c.rcvNxt)
+				c.rcvNxt++
+				if seg.cmd == rudpCmdFin {
+					c.eof = true
+				}
+				c.rcvQueue = append(c.rcvQueue, seg.data...)
+				delivered = true
+			}
+		default:
+			return
+		}
+	}
+
+	if delivered {
+		notify(c.chReadable)
+	}
+	if acked {
+		notify(c.chWritable)
+	}
+	if len(c.acks) > 0 || acked {
+		c.flush(now)
+	}
+}
+
+// ackUna drops every segment before una.
+func (c *rudpConn) ackUna(una uint32) bool {
+	if !seqBefore(c.sndUna, una) || seqBefore(c.sndNxt, una) {
+		return false
+	}
+	i := 0
+	for i < len(c.sndBuf) && seqBefore(c.sndBuf[i].sn, una) {
+		i++
+	}
+	c.sndBuf = c.sndBuf[i:]
+	c.sndUna = una
+	return true
+}
+
+func (c *rudpConn) ackSn(sn uint32, now time.Time) bool {
+	for i, seg := range c.sndBuf {
+		if seg.sn == sn {
+			if seg.xmit == 1 {
+				c.updateRTT(now.Sub(seg.sentAt))
+			}
+			c.sndBuf = append(c.sndBuf[:i], c.sndBuf[i+1:]...)
+			if len(c.sndBuf) == 0 {
+				c.sndUna = c.sndNxt
+			} else {
+				c.sndUna = c.sndBuf[0].sn
+			}
+			return true
+		}
+		if seqBefore(sn, seg.sn) {
+			return false
+		}
+		seg.fastack++
+	}
+	return false
+}
+
+// rudpListener demultiplexes one udp socket into connections by peer address and conv.
+type rudpListener struct {
+	pc       net.PacketConn
+	mu       sync.Mutex
+	conns    map[string]*rudpConn
+	chAccept chan *rudpConn
+	die      chan struct{}
+	dieOnce  sync.Once
+}
+
+func newRUDPListener(pc net.PacketConn) *rudpListener {
+	ret := &rudpListener{
+		pc:       pc,
+		conns:    make(map[string]*rudpConn),
+		chAccept: make(chan *rudpConn, 128),
+		die:      make(chan struct{}),
+	}
+	go ret.readWork()
+	return ret
+}
+
+// rudpOpening tells a datagram able to open a connection: well formed segments of one conv,
+// the first a push of sn 0 carrying data and acknowledging nothing.
+func rudpOpening(b []byte) bool {
+	if len(b) < rudpHeadLen || b[4] != rudpCmdPush || binary.LittleEndian.Uint32(b[5:]) != 0 ||
+		binary.LittleEndian.Uint32(b[9:]) != 0 || binary.LittleEndian.Uint16(b[15:]) == 0 {
+		return false
+	}
+	conv := binary.LittleEndian.Uint32(b)
+	for len(b) > 0 {
+		if len(b) < rudpHeadLen || binary.LittleEndian.Uint32(b) != conv {
+			return false
+		}
+		if cmd := b[4]; cmd != rudpCmdPush && cmd != rudpCmdAck && cmd != rudpCmdFin {
+			return false
+		}
+		size := int(binary.LittleEndian.Uint16(b[15:]))
+		if size > rudpMaxData || rudpHeadLen+size > len(b) {
+			return false
+		}
+		b = b[rudpHeadLen+size:]
+	}
+	return true
+}
+
+func rudpKey(addr net.Addr, conv uint32) string {
+	return addr.String() + "/" + string(binary.LittleEndian.AppendUint32(nil, conv))
+}
+
+func (l *rudpListener) readWork() {
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := l.pc.ReadFrom(buf)
+		if err != nil {
+			l.Close()
+			return
+		}
+		if n < rudpHeadLen {
+			continue
+		}
+		conv := binary.LittleEndian.Uint32(buf)
+		key := rudpKey(addr, conv)
+
+		l.mu.Lock()
+		conn, has := l.conns[key]
+		if !has {
+			// only the first segment of a stream opens a connection, nothing is kept for anything else
+			if !rudpOpening(buf[:n]) {
+				l.mu.Unlock()
+				continue
+			}
+			var newConn *rudpConn
+			newConn = newRUDPConn(conv, l.pc, addr, func() { l.remove(key, newConn) })
+			conn = newConn
+			select {
+			case l.chAccept <- conn:
+				l.conns[key] = conn
+				go conn.updateWork()
+			default:
+				// backlog full, the peer retransmits
+				conn.teardown(net.ErrClosed)
+				l.mu.Unlock()
+				continue
+			}
+		}
+		l.mu.Unlock()
+		conn.input(buf[:n])
+	}
+}
+
+func (l *rudpListener) remove(key string, conn *rudpConn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conns[key] == conn {
+		delete(l.conns, key)
+	}
+}
+
+func (l *rudpListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.chAccept:
+		return conn, nil
+	case <-l.die:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *rudpListener) Close() error {
+	l.dieOnce.Do(func() {
+		close(l.die)
+		l.pc.Close()
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		for _, conn := range l.conns {
+			conn.mu.Lock()
+			conn.teardown(net.ErrClosed)
+			conn.mu.Unlock()
+			notify(conn.chReadable)
+			notify(conn.chWritable)
+		}
+	})
+	return nil
+}
+
+func (l *rudpListener) Addr() net.Addr {
+	return l.pc.LocalAddr()
+}
+
+func listenRUDP(address string) (net.Listener, error) {
+	pc, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	return newRUDPListener(pc), nil
+}
+
+func dialRUDP(address string) (net.Conn, error) {
+	remote, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	pc, err := net.ListenPacket("udp", "")
+	if err != nil {
+		return nil, err
+	}
+	return newRUDPClientConn(pc, remote)
+}
+
+// newRUDPClientConn owns pc, it is closed with the connection.
+func newRUDPClientConn(pc net.PacketConn, remote net.Addr) (*rudpConn, error) {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		pc.Close()
+		return nil, err
+	}
+	conn := newRUDPConn(binary.LittleEndian.Uint32(b[:]), pc, remote, func() { pc.Close() })
+	go conn.updateWork()
+	go func() {
+		buf := make([]byte, 64*1024)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				conn.mu.Lock()
+				conn.teardown(err)
+				conn.mu.Unlock()
+				notify(conn.chReadable)
+				notify(conn.chWritable)
+				return
+			}
+			if addr.String() == remote.String() {
+				conn.input(buf[:n])
+			}
+		}
+	}()
+	return conn, nil
+}
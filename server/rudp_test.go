@@ -0,0 +1,178 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lossyPacketConn drops a share of outgoing datagrams.
+type lossyPacketConn struct {
+	net.PacketConn
+	mu   sync.Mutex
+	rnd  *rand.Rand
+	loss float64
+}
+
+func (c *lossyPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	drop := c.rnd.Float64() < c.loss
+	c.mu.Unlock()
+	if drop {
+		return len(b), nil
+	}
+	return c.PacketConn.WriteTo(b, addr)
+}
+
+func newLossyPacketConn(t *testing.T, loss float64, seed int64) *lossyPacketConn {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &lossyPacketConn{PacketConn: pc, rnd: rand.New(rand.NewSource(seed)), loss: loss}
+}
+
+func TestRUDPLossy(t *testing.T) {
+	ln := newRUDPListener(newLossyPacketConn(t, 0.2, 1))
+	defer ln.Close()
+
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+
+	conn, err := newRUDPClientConn(newLossyPacketConn(t, 0.2, 2), ln.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(20 * time.Second))
+
+	rnd := rand.New(rand.NewSource(3))
+	var sent []*RoutePacket
+	for i := 0; i < 200; i++ {
+		p := NewRoutePacket()
+		p.SetUid(uint32(i))
+		p.Body = make([]byte, rnd.Intn(8*1024))
+		rnd.Read(p.Body)
+		sent = append(sent, p)
+	}
+
+	go func() {
+		for _, p := range sent {
+			if _, err := WritePacket(conn, p); err != nil {
+				return
+			}
+		}
+	}()
+
+	for i, want := range sent {
+		got, err := ReadPacketT[*RoutePacket](conn)
+		if err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+		if got.GetUid() != want.GetUid() || !bytes.Equal(got.Body, want.Body) {
+			t.Fatalf("packet %d corrupted", i)
+		}
+	}
+}
+
+func rudpTestSegment(conv uint32, cmd byte, sn uint32, data []byte) []byte {
+	b := make([]byte, rudpHeadLen, rudpHeadLen+len(data))
+	binary.LittleEndian.PutUint32(b[0:], conv)
+	b[4] = cmd
+	binary.LittleEndian.PutUint32(b[5:], sn)
+	binary.LittleEndian.PutUint16(b[13:], rudpWnd)
+	binary.LittleEndian.PutUint16(b[15:], uint16(len(data)))
+	return append(b, data...)
+}
+
+func TestRUDPReceiveWindow(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	c := newRUDPConn(1, pc, pc.LocalAddr(), nil)
+	data := make([]byte, rudpMaxData)
+
+	// a peer pushing twice the window to an application not reading
+	for sn := uint32(0); sn < 2*rudpWnd; sn++ {
+		c.input(rudpTestSegment(1, rudpCmdPush, sn, data))
+	}
+	if c.rcvNxt != rudpWnd || len(c.rcvQueue) != rudpWnd*rudpMaxData || len(c.rcvBuf) != 0 {
+		t.Fatalf("kept %d segments, %d bytes and %d out of order", c.rcvNxt, len(c.rcvQueue), len(c.rcvBuf))
+	}
+	// out of order segments count against the window too
+	c.input(rudpTestSegment(1, rudpCmdPush, rudpWnd+1, data))
+	if len(c.rcvBuf) != 0 {
+		t.Fatal("segment beyond a full window kept")
+	}
+
+	buf := make([]byte, 2*rudpMaxData)
+	if n, err := io.ReadFull(c, buf); err != nil || n != len(buf) {
+		t.Fatal(n, err)
+	}
+	for sn := uint32(rudpWnd); sn < 2*rudpWnd; sn++ {
+		c.input(rudpTestSegment(1, rudpCmdPush, sn, data))
+	}
+	if c.rcvNxt != rudpWnd+2 {
+		t.Fatalf("%d segments received after reading two", c.rcvNxt)
+	}
+}
+
+func TestRUDPOpening(t *testing.T) {
+	data := []byte("hello")
+	open := rudpTestSegment(7, rudpCmdPush, 0, data)
+	if !rudpOpening(open) || !rudpOpening(append(append([]byte(nil), open...), rudpTestSegment(7, rudpCmdPush, 1, data)...)) {
+		t.Fatal("first segment of a stream refused")
+	}
+	for name, b := range map[string][]byte{
+		"later push":  rudpTestSegment(7, rudpCmdPush, 1, data),
+		"ack":         rudpTestSegment(7, rudpCmdAck, 0, nil),
+		"empty push":  rudpTestSegment(7, rudpCmdPush, 0, nil),
+		"short":       open[:len(open)-1],
+		"trailing":    append(append([]byte(nil), open...), 0),
+		"other conv":  append(append([]byte(nil), open...), rudpTestSegment(8, rudpCmdPush, 1, data)...),
+		"unknown cmd": append(append([]byte(nil), open...), rudpTestSegment(7, 9, 1, data)...),
+	} {
+		if rudpOpening(b) {
+			t.Errorf("%s opens a connection", name)
+		}
+	}
+
+	ln := newRUDPListener(newLossyPacketConn(t, 0, 1))
+	defer ln.Close()
+	peer, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	peer.WriteTo(rudpTestSegment(7, rudpCmdPush, 1, data), ln.Addr())
+	peer.WriteTo(open, ln.Addr())
+	conn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ln.mu.Lock()
+	n := len(ln.conns)
+	ln.mu.Unlock()
+	if n != 1 {
+		t.Fatalf("%d connections for one peer", n)
+	}
+	buf := make([]byte, len(data))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil || !bytes.Equal(buf, data) {
+		t.Fatal(string(buf), err)
+	}
+}
@@ -0,0 +1,218 @@
+package server
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+const DefaultSendQueueSize = 100
+
+var ErrSendQueueFull = errors.New("send queue full")
+var ErrSendTimeout = errors.New("send timeout")
+
+// OverflowPolicy decides what Send does when the session's queue is full.
+type OverflowPolicy int
+
+const (
+	// wait for room, up to BlockTimeout
+	OverflowBlock OverflowPolicy = iota
+	// drop the packet being sent
+	OverflowDropNewest
+	// drop the oldest queued packet to make room
+	OverflowDropOldest
+	// close the session
+	OverflowDisconnect
+)
+
+func (p OverflowPolicy) String() string {
+	switch p {
+	case OverflowBlock:
+		return "block"
+	case OverflowDropNewest:
+		return "drop-newest"
+	case OverflowDropOldest:
+		return "drop-oldest"
+	case OverflowDisconnect:
+		return "disconnect"
+	}
+	return "unknown"
+}
+
+type SendQueueOptions struct {
+	// queued packets, 0 means DefaultSendQueueSize
+	Size     int
+	Overflow OverflowPolicy
+	// how long OverflowBlock waits, 0 waits until the session closes
+	BlockTimeout time.Duration
+}
+
+func (o SendQueueOptions) withDefaults() SendQueueOptions {
+	if o.Size <= 0 {
+		o.Size = DefaultSendQueueSize
+	}
+	return o
+}
+
+// every pass of the writer takes up to this many packets from a lane before moving to the next one,
+// so lower lanes keep moving while higher ones are busy. control is served first, always.
+var laneWeights = [priorityCount]int{
+	PriorityHigh:   8,
+	PriorityNormal: 4,
+	PriorityBulk:   1,
+}
+
+var weightedLanes = []Priority{PriorityHigh, PriorityNormal, PriorityBulk}
+
+func (s *tcpSocket) initLanes(size int) {
+	for i := range s.lanes {
+		s.lanes[i] = make(chan Packet, size)
+	}
+	s.chWrite = s.lanes[PriorityNormal]
+	s.laneCursor = 0
+	s.laneCredit = laneWeights[weightedLanes[0]]
+}
+
+func packetPriority(p Packet) Priority {
+	switch p := p.(type) {
+	case *HVPacket:
+		return PriorityControl
+	case *RoutePacket:
+		return p.GetPriority()
+	}
+	return PriorityNormal
+}
+
+// pollPacket takes the next queued packet without blocking.
+func (s *tcpSocket) pollPacket() (Packet, bool) {
+	select {
+	case p, ok := <-s.lanes[PriorityControl]:
+		return p, ok
+	default:
+	}
+	for i := 0; i <= len(weightedLanes); i++ {
+		if s.laneCredit > 0 {
+			select {
+			case p, ok := <-s.lanes[weightedLanes[s.laneCursor]]:
+				s.laneCredit--
+				return p, ok
+			default:
+			}
+		}
+		s.laneCursor = (s.laneCursor + 1) % len(weightedLanes)
+		s.laneCredit = laneWeights[weightedLanes[s.laneCursor]]
+	}
+	return nil, true
+}
+
+// waitPacket blocks until a packet is queued, the socket closes or timeout fires.
+// it returns nil when there is nothing to write any more.
+func (s *tcpSocket) waitPacket(timeout <-chan time.Time) (Packet, bool) {
+	if p, ok := s.pollPacket(); p != nil || !ok {
+		return p, ok
+	}
+	select {
+	case <-s.chClosed:
+		return nil, false
+	case <-timeout:
+		return nil, true
+	case p, ok := <-s.lanes[PriorityControl]:
+		return p, ok
+	case p, ok := <-s.lanes[PriorityHigh]:
+		return p, ok
+	case p, ok := <-s.lanes[PriorityNormal]:
+		return p, ok
+	case p, ok := <-s.lanes[PriorityBulk]:
+		return p, ok
+	}
+}
+
+// Dropped returns how many packets were dropped because the send queue was full.
+func (s *tcpSocket) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// QueueLen returns the number of packets waiting to be written.
+func (s *tcpSocket) QueueLen() int {
+	n := 0
+	for _, lane := range s.lanes {
+		n += len(lane)
+	}
+	return n
+}
+
+// SendWithPriority queues p in the lane of prio, regardless of the priority carried by the packet.
+func (s *tcpSocket) SendWithPriority(p Packet, prio Priority) error {
+	if prio >= priorityCount {
+		prio = PriorityNormal
+	}
+	if !s.IsValid() {
+		return ErrDisconn
+	}
+	if err := s.checkSize(p); err != nil {
+		return err
+	}
+	metricQueueDepth.Observe(float64(s.QueueLen()))
+	retainPacket(p)
+	if err := s.enqueue(s.lanes[prio], p); err != nil {
+		releasePacket(p)
+		return err
+	}
+	return nil
+}
+
+func (s *tcpSocket) enqueue(ch chan Packet, p Packet) error {
+	select {
+	case <-s.chClosed:
+		return ErrDisconn
+	case ch <- p:
+		return nil
+	default:
+	}
+
+	switch s.queue.Overflow {
+	case OverflowDropNewest:
+		atomic.AddUint64(&s.dropped, 1)
+		metricDrops.With(s.queue.Overflow.String()).Inc()
+		return ErrSendQueueFull
+	case OverflowDropOldest:
+		for {
+			select {
+			case <-s.chClosed:
+				return ErrDisconn
+			case ch <- p:
+				return nil
+			default:
+			}
+			select {
+			case old := <-ch:
+				releasePacket(old)
+				atomic.AddUint64(&s.dropped, 1)
+				metricDrops.With(s.queue.Overflow.String()).Inc()
+			default:
+			}
+		}
+	case OverflowDisconnect:
+		atomic.AddUint64(&s.dropped, 1)
+		metricDrops.With(s.queue.Overflow.String()).Inc()
+		s.Close()
+		return ErrSendQueueFull
+	}
+
+	var timeout <-chan time.Time
+	if s.queue.BlockTimeout > 0 {
+		timer := time.NewTimer(s.queue.BlockTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-s.chClosed:
+		return ErrDisconn
+	case ch <- p:
+		return nil
+	case <-timeout:
+		atomic.AddUint64(&s.dropped, 1)
+		metricDrops.With(s.queue.Overflow.String()).Inc()
+		return ErrSendTimeout
+	}
+}
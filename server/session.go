@@ -2,6 +2,7 @@ package server
 
 import (
 	"fmt"
+	"log/slog"
 	"net"
 	"sync"
 	"sync/atomic"
@@ -30,8 +31,21 @@ type Session interface {
 	RemoteAddr() net.Addr
 }
 
+// SessionLogger returns l with the id, user, kind and remote address of s attached.
+func SessionLogger(l *slog.Logger, s Session) *slog.Logger {
+	return l.With("sid", s.SessionID(), "uid", s.UserID(), "kind", s.SessionType(), "remote", addrString(s.RemoteAddr()))
+}
+
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
 type FuncOnSessionPacket func(Session, Packet)
 type FuncOnSessionStatus func(s Session, enable bool)
+type FuncOnSessionError func(s Session, err error)
 type FuncOnAccpect func(net.Conn) bool
 
 var sid int64 = 0
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"time"
+)
+
+// pongs older than this are taken for garbage rather than a round trip
+const maxPingRTT = time.Minute
+
+// SessionStats is a snapshot of the counters of a session.
+type SessionStats struct {
+	ConnectedAt time.Time
+	BytesIn     int64
+	BytesOut    int64
+	PacketsIn   int64
+	PacketsOut  int64
+	// packets waiting in the send queue, and dropped by its overflow policy
+	QueueLen int
+	Dropped  uint64
+	// smoothed round trip time, 0 until the peer answered a ping
+	RTT time.Duration
+}
+
+func (s *tcpSocket) Stats() SessionStats {
+	ret := SessionStats{
+		ConnectedAt: s.connectedAt,
+		BytesOut:    atomic.LoadInt64(&s.writeSize),
+		PacketsIn:   atomic.LoadInt64(&s.packetsIn),
+		PacketsOut:  atomic.LoadInt64(&s.packetsOut),
+		QueueLen:    s.QueueLen(),
+		Dropped:     s.Dropped(),
+		RTT:         s.RTT(),
+	}
+	if s.reader != nil {
+		ret.BytesIn = atomic.LoadInt64(&s.reader.n)
+	}
+	return ret
+}
+
+func (s *tcpSocket) RTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.rtt))
+}
+
+// sendPing asks the peer for a pong, when it negotiated CapPing.
+func (s *tcpSocket) sendPing() {
+	if !s.caps.Has(CapPing) {
+		return
+	}
+	body := make([]byte, 8)
+	binary.LittleEndian.PutUint64(body, uint64(time.Now().UnixNano()))
+	p := NewHVPacket()
+	p.SetFlag(HVPacketFlagPing)
+	p.SetBody(body)
+	s.Send(p)
+}
+
+// handlePing answers pings and measures the round trip from pongs,
+// it tells whether p was one of them.
+func (s *tcpSocket) handlePing(p *HVPacket) bool {
+	switch p.GetFlag() {
+	case HVPacketFlagPing:
+		pong := NewHVPacket()
+		pong.SetFlag(HVPacketFlagPong)
+		pong.SetBody(p.GetBody())
+		s.Send(pong)
+		return true
+	case HVPacketFlagPong:
+		body := p.GetBody()
+		if len(body) != 8 {
+			return true
+		}
+		sent := time.Unix(0, int64(binary.LittleEndian.Uint64(body)))
+		rtt := time.Since(sent)
+		if rtt < 0 || rtt > maxPingRTT {
+			return true
+		}
+		metricRTT.Observe(rtt.Seconds())
+		// the same smoothing as tcp, 1/8 of every new sample
+		old := atomic.LoadInt64(&s.rtt)
+		if old == 0 {
+			atomic.StoreInt64(&s.rtt, int64(rtt))
+		} else {
+			atomic.StoreInt64(&s.rtt, old+(int64(rtt)-old)/8)
+		}
+		return true
+	}
+	return false
+}
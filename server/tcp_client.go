@@ -1,8 +1,10 @@
 package server
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"log/slog"
 	"net"
 	"sync"
 	"sync/atomic"
@@ -12,11 +14,43 @@ import (
 type TcpClientOption func(*TcpClientOptions)
 
 type TcpClientOptions struct {
+	// host:port, or tcp://, tls://, ws://, grpc://, unix:// and other addresses, see splitAddr
 	RemoteAddress        string
 	Token                string
 	Timeout              time.Duration
 	ReconnectDelaySecond int32
 
+	// used by tls://, wss://, https:// and grpcs:// addresses
+	TLSConfig *tls.Config
+
+	// servers older than MinProtocolVersion are refused, 0 means MinProtocolVersion
+	MinProtocolVersion uint8
+	// capabilities never offered to the server
+	DisabledCapabilities Capability
+
+	// allowed compressions, 0 means all of SupportedCompressions
+	Compressions CompressAlgo
+	// bodies shorter than CompressThreshold are sent raw, 0 means DefaultCompressThreshold
+	CompressThreshold int
+
+	// route bodies larger than FragmentSize are split when the peer supports it, 0 means DefaultFragmentSize
+	FragmentSize int
+	// memory a session may hold for partially received messages, 0 means DefaultMaxReassemblyBytes
+	MaxReassemblyBytes int
+
+	// packets with a longer body are refused before being read, 0 means MaxPacketBodyLen
+	MaxBodyLen uint32
+
+	// coalescing of queued packets into fewer writes
+	WriteBatch WriteBatchOptions
+
+	SendQueue SendQueueOptions
+
+	// diagnostics of the connection, nil means slog.Default()
+	Logger *slog.Logger
+	// records the packets of the connection, for debugging
+	Capture *Capture
+
 	OnSessionPacket FuncOnSessionPacket
 	OnSessionStatus FuncOnSessionStatus
 }
@@ -28,6 +62,27 @@ func NewTcpClient(opts TcpClientOptions) *tcpClient {
 	if opts.ReconnectDelaySecond == 0 {
 		opts.ReconnectDelaySecond = 5
 	}
+	if opts.MinProtocolVersion == 0 {
+		opts.MinProtocolVersion = MinProtocolVersion
+	}
+	if opts.Compressions == 0 {
+		opts.Compressions = allCompressions()
+	}
+	if opts.CompressThreshold == 0 {
+		opts.CompressThreshold = DefaultCompressThreshold
+	}
+	if opts.FragmentSize <= 0 || opts.FragmentSize > MaxPacketBodyLen-fragmentHeadLen-maxRouteExtLen {
+		opts.FragmentSize = DefaultFragmentSize
+	}
+	if opts.MaxReassemblyBytes == 0 {
+		opts.MaxReassemblyBytes = DefaultMaxReassemblyBytes
+	}
+	if opts.MaxBodyLen == 0 || opts.MaxBodyLen > MaxPacketBodyLen {
+		opts.MaxBodyLen = MaxPacketBodyLen
+	}
+	if opts.Logger == nil {
+		opts.Logger = slog.Default()
+	}
 	ret := &tcpClient{
 		Opt: opts,
 	}
@@ -39,6 +94,12 @@ type tcpClient struct {
 
 	Opt   TcpClientOptions
 	mutex sync.Mutex
+	// set by Close and failed handshakes, Opt is never written once the client runs
+	noReconnect atomic.Bool
+}
+
+func (c *tcpClient) shouldReconnect() bool {
+	return c.Opt.ReconnectDelaySecond > 0 && !c.noReconnect.Load()
 }
 
 func doAckAction(c net.Conn, body []byte) error {
@@ -58,21 +119,30 @@ func (c *tcpClient) doConnect() error {
 		return nil
 	}
 
-	conn, err := net.DialTimeout("tcp", c.Opt.RemoteAddress, c.Opt.Timeout)
+	conn, err := dial(c.Opt.RemoteAddress, c.Opt.TLSConfig, c.Opt.Timeout)
 	if err != nil {
+		metricClientConnects.With("dial_error").Inc()
 		atomic.SwapInt32(&c.tcpSocket.status, Disconnected)
 		return err
 	}
+	c.tcpSocket.kind, _ = splitAddr(c.Opt.RemoteAddress)
 
 	err = c.doHandShake(conn)
 	if err != nil {
+		metricClientConnects.With("handshake_error").Inc()
 		conn.Close()
 		// if hand shake fail, dont reconnect any more
 		atomic.SwapInt32(&c.tcpSocket.status, Disconnected)
-		c.Opt.ReconnectDelaySecond = -1
+		c.noReconnect.Store(true)
 		return err
 	}
 
+	metricClientConnects.With("success").Inc()
+	c.tcpSocket.connectedAt = time.Now()
+	atomic.StoreInt32(&c.tcpSocket.status, Connected)
+	logger := SessionLogger(c.Opt.Logger, c)
+	logger.Info("session opened", "version", c.tcpSocket.version, "caps", c.tcpSocket.caps.String())
+
 	go func() {
 
 		wg := &sync.WaitGroup{}
@@ -85,14 +155,12 @@ func (c *tcpClient) doConnect() error {
 			wg.Wait()
 
 			c.tcpSocket.Close()
+			logger.Info("session closed", "err", errors.Join(readErr, writeErr))
 			if c.Opt.OnSessionStatus != nil {
-
-				fmt.Printf("socket closeat %v", errors.Join(readErr, writeErr))
-
 				c.Opt.OnSessionStatus(c, false)
 			}
 
-			if c.Opt.ReconnectDelaySecond > 0 {
+			if c.shouldReconnect() {
 				c.reconnect()
 			}
 		}()
@@ -121,8 +189,6 @@ func (c *tcpClient) doConnect() error {
 			readErr = socket.readWork()
 		}()
 
-		atomic.StoreInt32(&c.tcpSocket.status, Connected)
-
 		if c.Opt.OnSessionStatus != nil {
 			c.Opt.OnSessionStatus(c, true)
 		}
@@ -144,6 +210,7 @@ func (c *tcpClient) doConnect() error {
 				if nowUnix-lastSendAt >= checkPos {
 					socket.Send(heartbeatPakcet)
 				}
+				socket.sendPing()
 			case p, ok := <-socket.chRead:
 				if !ok {
 					return
@@ -156,6 +223,8 @@ func (c *tcpClient) doConnect() error {
 					switch packet.GetFlag() {
 					case HVPacketFlagHeartbeat:
 						dealed = true
+					default:
+						dealed = socket.handlePing(packet)
 					}
 				}
 
@@ -170,16 +239,18 @@ func (c *tcpClient) doConnect() error {
 
 func (c *tcpClient) reconnect() {
 	time.AfterFunc(time.Duration(c.Opt.ReconnectDelaySecond)*time.Second, func() {
-		fmt.Println("start to reconnect")
-		if c.IsValid() {
-			fmt.Println("already connected")
+		c.Opt.Logger.Debug("reconnecting", "remote", c.Opt.RemoteAddress)
+		metricClientReconnects.Inc()
+		if c.IsValid() || c.noReconnect.Load() {
 			return
 		}
 		err := c.doConnect()
 		if err != nil {
-			fmt.Println("connect error:", err)
+			c.Opt.Logger.Warn("reconnect failed", "remote", c.Opt.RemoteAddress, "err", err)
 			// go on reconnect
-			c.reconnect()
+			if c.shouldReconnect() {
+				c.reconnect()
+			}
 		}
 	})
 }
@@ -189,8 +260,17 @@ func (c *tcpClient) doHandShake(conn net.Conn) error {
 	conn.SetReadDeadline(deadline)
 	conn.SetWriteDeadline(deadline)
 
+	hello := &handshakeHello{
+		Version: ProtocolVersion,
+		Caps:    SupportedCapabilities &^ c.Opt.DisabledCapabilities,
+	}
+	if hello.Caps.Has(CapCompression) {
+		hello.Compress = c.Opt.Compressions
+	}
+
 	p := NewHVPacket()
 	p.SetFlag(hvPacketFlagHandShake)
+	p.SetBody(hello.Marshal())
 	if _, err := WritePacket(conn, p); err != nil {
 		return err
 	}
@@ -200,11 +280,13 @@ func (c *tcpClient) doHandShake(conn net.Conn) error {
 	}
 
 	socketid := ""
+	ack := &handshakeHello{}
+	reader := newPacketReader(conn, c.Opt.MaxBodyLen, false)
 
 	var err error
 	for {
 		var pp *HVPacket
-		pp, err = ReadPacketT[*HVPacket](conn)
+		pp, err = ReadPacketT[*HVPacket](reader)
 		if err != nil {
 			break
 		}
@@ -219,13 +301,31 @@ func (c *tcpClient) doHandShake(conn net.Conn) error {
 				}
 			}
 		} else if pp.GetFlag() == hvPacketFlagAckResult {
-			body := string(pp.GetBody())
-			if len(body) == 0 {
+			var n int
+			if !isLegacyAck(pp.GetBody()) {
+				if n, err = ack.Unmarshal(pp.GetBody()); err != nil {
+					break
+				}
+				// the server picks among what was offered, never above it
+				if ack.Version > hello.Version {
+					err = fmt.Errorf("server answered version %d to version %d", ack.Version, hello.Version)
+					break
+				}
+			}
+			body := string(pp.GetBody()[n:])
+			if len(body) == 0 || (n == 0 && body == legacyAckFail) {
 				err = fmt.Errorf("ack result failed")
 				break
 			}
+			if ack.Version < c.Opt.MinProtocolVersion {
+				err = fmt.Errorf("%w: server version %d, require %d or newer", ErrVersionTooOld, ack.Version, c.Opt.MinProtocolVersion)
+				break
+			}
 			socketid = body
 			break
+		} else if pp.GetFlag() == hvPacketFlagReject {
+			err = fmt.Errorf("%w: %s", ErrHandshakeRejected, string(pp.GetBody()))
+			break
 		} else {
 			err = fmt.Errorf("invalid packet type: %d", pp.GetFlag())
 			break
@@ -240,12 +340,29 @@ func (c *tcpClient) doHandShake(conn net.Conn) error {
 	socket.id = socketid
 	socket.conn = conn
 	socket.timeOut = c.Opt.Timeout
-	socket.chWrite = make(chan Packet, 100)
+	socket.queue = c.Opt.SendQueue.withDefaults()
+	socket.initLanes(socket.queue.Size)
 	socket.chRead = make(chan Packet, 100)
 	socket.chClosed = make(chan struct{})
 	socket.lastSendAt = time.Now().Unix()
 	socket.lastRecvAt = time.Now().Unix()
 	socket.userData = userData{}
+	// capabilities the client did not offer stay off, whatever the server says
+	caps := ack.Caps & hello.Caps
+	socket.version = ack.Version
+	socket.caps = caps
+	socket.compress = CompressNone
+	if caps.Has(CapCompression) && c.Opt.Compressions&ack.Compress != 0 {
+		socket.compress = ack.Compress
+	}
+	socket.compressThreshold = c.Opt.CompressThreshold
+	socket.fragmentSize = c.Opt.FragmentSize
+	socket.reassembler = newReassembler(c.Opt.MaxReassemblyBytes)
+	reader.routeFlags = caps.routeFlags()
+	socket.reader = reader
+	newBatchWriter(socket, c.Opt.WriteBatch)
+	socket.maxBodyLen = c.Opt.MaxBodyLen
+	socket.capture = c.Opt.Capture
 	return nil
 }
 
@@ -254,7 +371,7 @@ func (c *tcpClient) Connect() error {
 		return fmt.Errorf("remote address is empty")
 	}
 	err := c.doConnect()
-	if err != nil && c.Opt.ReconnectDelaySecond > 0 {
+	if err != nil && c.shouldReconnect() {
 		c.reconnect()
 	}
 	return err
@@ -264,6 +381,6 @@ func (c *tcpClient) Close() error {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
-	c.Opt.ReconnectDelaySecond = -1
+	c.noReconnect.Store(true)
 	return c.tcpSocket.Close()
 }
@@ -1,20 +1,91 @@
 package server
 
 import (
+	"crypto/tls"
 	"fmt"
+	"log/slog"
 	"net"
+	"net/http"
 	"sync"
 	"time"
+
+	"route/audit"
+	"route/msg"
 )
 
 type TcpServerOptions struct {
+	// host:port, or tcp://, tls://, ws://, grpc://, unix:// and other addresses, see splitAddr
 	ListenAddr       string
 	HeatbeatInterval time.Duration
 
+	// required by tls://, wss://, https:// and grpcs:// listeners
+	TLSConfig *tls.Config
+	Unix      UnixSocketOptions
+	// serves plain requests to ws://, wss://, http:// and https:// listeners, such as an api
+	HTTPHandler http.Handler
+	// serves the calls other than Stream on grpc:// and grpcs:// listeners
+	GrpcService msg.RouteServer
+
+	// peers older than MinProtocolVersion are rejected, 0 means MinProtocolVersion
+	MinProtocolVersion uint8
+	// capabilities never offered to peers
+	DisabledCapabilities Capability
+
+	// allowed compressions, 0 means all of SupportedCompressions
+	Compressions CompressAlgo
+	// bodies shorter than CompressThreshold are sent raw, 0 means DefaultCompressThreshold
+	CompressThreshold int
+
+	// route bodies larger than FragmentSize are split when the peer supports it, 0 means DefaultFragmentSize
+	FragmentSize int
+	// memory a session may hold for partially received messages, 0 means DefaultMaxReassemblyBytes
+	MaxReassemblyBytes int
+
+	// packets with a longer body are refused before being read, 0 means MaxPacketBodyLen
+	MaxBodyLen uint32
+
+	// coalescing of queued packets into fewer writes
+	WriteBatch WriteBatchOptions
+
+	// send queue of every session, SendQueueFunc may override it per authenticated user
+	SendQueue     SendQueueOptions
+	SendQueueFunc func(*UserInfo) SendQueueOptions
+
+	// connection attempts and concurrent connections allowed per remote ip
+	IPLimit IPLimitOptions
+	// global limits and ip filters applied on accept
+	Admission AdmissionOptions
+	// PROXY protocol headers sent by load balancers in front of the server
+	ProxyProtocol ProxyProtocolOptions
+	// time a new connection has to complete the handshake, 0 means HeatbeatInterval
+	HandshakeTimeout time.Duration
+	// stricter body limit applied before the peer is authenticated, 0 means DefaultMaxHandshakeBodyLen
+	MaxHandshakeBodyLen uint32
+	// open http polling sessions of ws:// and http:// listeners, 0 means DefaultMaxPollSessions
+	// and a negative value unlimited
+	MaxPollSessions int
+
+	// read route bodies into pooled buffers, recycled once every holder released the packet.
+	// OnSessionPacket must Retain packets it keeps after returning.
+	PoolBuffers bool
+
+	// diagnostics of the listener and its sessions, nil means slog.Default()
+	Logger *slog.Logger
+	// spans of handshakes, nil means NopTracer
+	Tracer Tracer
+	// records the packets of every session, for debugging
+	Capture *Capture
+	// receives every handshake attempt, nil means audit.Discard. refused ones are passed on through
+	// an audit.Queue, under a flood of them only their number is recorded
+	Audit audit.Sink
+
 	AuthFunc        func([]byte) (*UserInfo, error)
 	OnSessionPacket FuncOnSessionPacket
 	OnSessionStatus FuncOnSessionStatus
-	OnAccpect       FuncOnAccpect
+	// called from the reading goroutine for a packet dropped for breaking the protocol, such as a
+	// msgtype out of range, while the session stays open. nil closes the session instead
+	OnSessionError FuncOnSessionError
+	OnAccpect      FuncOnAccpect
 }
 
 type TcpServerOption func(*TcpServerOptions)
@@ -25,15 +96,67 @@ func NewTcpServer(opts TcpServerOptions) (*tcpServer, error) {
 		sockets: make(map[string]*tcpSocket),
 		die:     make(chan bool),
 	}
+	if ret.opts.Logger == nil {
+		ret.opts.Logger = slog.Default()
+	}
+	if ret.opts.Tracer == nil {
+		ret.opts.Tracer = NopTracer{}
+	}
+	if ret.opts.Audit == nil {
+		ret.opts.Audit = audit.Discard
+	}
+	ret.ipLimiter = newIPLimiter(ret.opts.IPLimit)
+	admission, err := newAdmission(ret.opts.Admission)
+	if err != nil {
+		return nil, err
+	}
+	admission.logger = ret.opts.Logger
+	ret.admission = admission
+	if ret.proxyTrusted, err = ParseIPNetList(ret.opts.ProxyProtocol.TrustedSources); err != nil {
+		return nil, err
+	}
 	if ret.opts.HeatbeatInterval < time.Duration(DefaultMinTimeoutSec)*time.Second {
 		ret.opts.HeatbeatInterval = time.Duration(DefaultTimeoutSec) * time.Second
 	}
+	if ret.opts.HandshakeTimeout <= 0 {
+		ret.opts.HandshakeTimeout = ret.opts.HeatbeatInterval
+	}
+	if ret.opts.MinProtocolVersion == 0 {
+		ret.opts.MinProtocolVersion = MinProtocolVersion
+	}
+	if ret.opts.Compressions == 0 {
+		ret.opts.Compressions = allCompressions()
+	}
+	if ret.opts.CompressThreshold == 0 {
+		ret.opts.CompressThreshold = DefaultCompressThreshold
+	}
+	if ret.opts.FragmentSize <= 0 || ret.opts.FragmentSize > MaxPacketBodyLen-fragmentHeadLen-maxRouteExtLen {
+		ret.opts.FragmentSize = DefaultFragmentSize
+	}
+	if ret.opts.MaxReassemblyBytes == 0 {
+		ret.opts.MaxReassemblyBytes = DefaultMaxReassemblyBytes
+	}
+	if ret.opts.MaxBodyLen == 0 || ret.opts.MaxBodyLen > MaxPacketBodyLen {
+		ret.opts.MaxBodyLen = MaxPacketBodyLen
+	}
+	if ret.opts.MaxHandshakeBodyLen == 0 {
+		ret.opts.MaxHandshakeBodyLen = DefaultMaxHandshakeBodyLen
+	}
+	if ret.opts.MaxPollSessions == 0 {
+		ret.opts.MaxPollSessions = DefaultMaxPollSessions
+	}
 
-	listener, err := net.Listen("tcp", opts.ListenAddr)
+	listener, kind, err := listen(opts.ListenAddr, &ret.opts)
 	if err != nil {
 		return nil, err
 	}
 	ret.listener = listener
+	ret.kind = kind
+	if len(ret.proxyTrusted) > 0 && !proxyProtocolScheme(kind) {
+		listener.Close()
+		return nil, fmt.Errorf("proxy protocol is not supported on %s listeners", kind)
+	}
+	ret.refused = audit.NewQueue(ret.opts.Audit, refusedAuditQueue)
 	return ret, nil
 }
 
@@ -44,6 +167,14 @@ type tcpServer struct {
 	die      chan bool
 	wgConns  sync.WaitGroup
 	listener net.Listener
+	// scheme of ListenAddr, reported as the SessionType of its sessions
+	kind string
+
+	ipLimiter    *ipLimiter
+	admission    *admission
+	proxyTrusted IPNetList
+	// refused connections are audited from here, a flood of them does not wait for the sink
+	refused *audit.Queue
 }
 
 func (s *tcpServer) Stop() error {
@@ -55,6 +186,7 @@ func (s *tcpServer) Stop() error {
 	}
 	s.listener.Close()
 	s.wgConns.Wait()
+	s.refused.Close()
 	return nil
 }
 
@@ -80,10 +212,21 @@ func (s *tcpServer) Start() error {
 						time.Sleep(tempDelay)
 						continue
 					}
-					fmt.Println(err)
+					select {
+					case <-s.die:
+					default:
+						s.opts.Logger.Error("accept failed", "listen", s.opts.ListenAddr, "err", err)
+					}
 					return
 				}
 				tempDelay = 0
+				if reason := s.admission.admitConn(); reason != "" {
+					s.admission.reject(reason, conn.RemoteAddr())
+					s.auditRefused(conn, reason, nil)
+					conn.Close()
+					continue
+				}
+				s.wgConns.Add(1)
 				go s.onAccept(conn)
 			}
 		}
@@ -92,22 +235,86 @@ func (s *tcpServer) Start() error {
 }
 
 func (s *tcpServer) onAccept(conn net.Conn) {
+	defer s.wgConns.Done()
+	defer s.admission.connDone()
 	defer conn.Close()
 
+	if len(s.proxyTrusted) > 0 && s.proxyTrusted.Contains(ipOf(conn.RemoteAddr())) {
+		proxied, err := readProxyHeader(conn, s.opts.ProxyProtocol.Required, s.opts.HandshakeTimeout)
+		if err != nil {
+			s.admission.reject(RejectProxyHeader, conn.RemoteAddr())
+			s.auditRefused(conn, RejectProxyHeader, nil)
+			return
+		}
+		conn = proxied
+	}
+	if s.kind == "tls" {
+		conn = tls.Server(conn, s.opts.TLSConfig)
+	}
+
+	if !s.admission.allowed(conn.RemoteAddr()) {
+		s.admission.reject(RejectDenied, conn.RemoteAddr())
+		s.auditRefused(conn, RejectDenied, nil)
+		return
+	}
+
 	if s.opts.OnAccpect != nil {
 		if !s.opts.OnAccpect(conn) {
 			return
 		}
 	}
 
+	// local peers all share an empty address, they are not limited per ip
+	if !isUnixConn(conn) {
+		ip := hostOf(conn.RemoteAddr())
+		if !s.ipLimiter.acquire(ip) {
+			s.admission.reject(RejectIPLimit, conn.RemoteAddr())
+			s.auditRefused(conn, RejectIPLimit, nil)
+			return
+		}
+		defer s.ipLimiter.release(ip)
+	}
+
+	if !s.admission.enterHandshake() {
+		s.admission.reject(RejectMaxHandshakes, conn.RemoteAddr())
+		s.auditRefused(conn, RejectMaxHandshakes, nil)
+		return
+	}
+	span := s.opts.Tracer.StartSpan("route.handshake", TraceContext{})
+	span.SetAttributes("remote", addrString(conn.RemoteAddr()), "kind", s.kind)
 	socket, err := s.handshake(conn)
+	s.admission.leaveHandshake()
+	if err == nil {
+		span.SetAttributes("sid", socket.id, "uid", socket.UserID())
+	}
+	span.End(err)
 	if err != nil {
+		metricHandshakes.With("failure", handshakeFailReason(err)).Inc()
+		s.opts.Logger.Debug("handshake failed", "remote", addrString(conn.RemoteAddr()), "kind", s.kind, "err", err)
+		s.admission.reject(RejectHandshake, conn.RemoteAddr())
+		s.auditRefused(conn, handshakeFailReason(err), err)
 		return
 	}
+	metricHandshakes.With("success", "").Inc()
+	s.opts.Audit.Record(audit.Event{
+		Time:      time.Now(),
+		Action:    audit.ActionHandshake,
+		Result:    audit.ResultSuccess,
+		SessionID: socket.id,
+		UId:       socket.UId,
+		Subject:   socket.UName,
+		Role:      socket.URole,
+		Remote:    addrString(conn.RemoteAddr()),
+		Kind:      socket.SessionType(),
+	})
 
 	socket.status = Connected
-	s.wgConns.Add(1)
-	defer s.wgConns.Done()
+	socket.connectedAt = time.Now()
+	logger := SessionLogger(s.opts.Logger, socket)
+	logger.Info("session opened", "version", socket.version, "caps", socket.caps.String())
+	defer func() {
+		logger.Info("session closed", "duration", time.Since(socket.connectedAt).Round(time.Millisecond))
+	}()
 
 	// the connection is established here
 	go func() {
@@ -123,11 +330,20 @@ func (s *tcpServer) onAccept(conn net.Conn) {
 	s.storeSocket(socket)
 	defer s.removeSocket(socket)
 
+	metricConnsTotal.With(socket.kind).Inc()
+	active := metricConnsActive.With(socket.kind)
+	active.Inc()
+	defer active.Dec()
+
 	if s.opts.OnSessionStatus != nil {
 		s.opts.OnSessionStatus(socket, true)
 		defer s.opts.OnSessionStatus(socket, false)
 	}
 
+	pingTk := time.NewTicker(s.opts.HeatbeatInterval / 3)
+	defer pingTk.Stop()
+	socket.sendPing()
+
 	for {
 		select {
 		case <-socket.chClosed:
@@ -135,6 +351,8 @@ func (s *tcpServer) onAccept(conn net.Conn) {
 		case <-s.die:
 			socket.Close()
 			return
+		case <-pingTk.C:
+			socket.sendPing()
 		case packet, ok := <-socket.chRead:
 			if !ok {
 				return
@@ -151,66 +369,158 @@ func (s *tcpServer) onAccept(conn net.Conn) {
 				case HVPacketFlagHeartbeat:
 					socket.Send(packet)
 					did = true
+				default:
+					did = socket.handlePing(packet)
 				}
 			}
 
 			if !did && s.opts.OnSessionPacket != nil {
 				s.opts.OnSessionPacket(socket, packet)
 			}
+			releasePacket(packet)
 		}
 	}
 }
 
+// refused connections waiting to be audited, beyond it they are only counted
+const refusedAuditQueue = 1024
+
+// auditRefused records a connection turned away in onAccept, reason is a Reject constant or a handshake failure reason.
+func (s *tcpServer) auditRefused(conn net.Conn, reason string, err error) {
+	e := audit.Event{
+		Time:   time.Now(),
+		Action: audit.ActionHandshake,
+		Result: audit.ResultFailure,
+		Reason: reason,
+		Remote: addrString(conn.RemoteAddr()),
+		Kind:   s.kind,
+	}
+	if err != nil {
+		e.Reason += ": " + err.Error()
+	}
+	s.refused.Record(e)
+}
+
 func (s *tcpServer) handshake(conn net.Conn) (*tcpSocket, error) {
-	deadline := time.Now().Add(s.opts.HeatbeatInterval)
+	deadline := time.Now().Add(s.opts.HandshakeTimeout)
 	conn.SetReadDeadline(deadline)
 	conn.SetWriteDeadline(deadline)
 
-	p, err := ReadPacketT[*HVPacket](conn)
+	reader := LimitReader(conn, s.opts.MaxHandshakeBodyLen)
+	p, err := ReadPacketT[*HVPacket](reader)
 	if err != nil {
 		return nil, err
 	}
 
-	if p.GetFlag() != hvPacketFlagHandShake && len(p.GetBody()) != 0 {
+	if p.GetFlag() != hvPacketFlagHandShake {
 		return nil, ErrInvalidPacket
 	}
 
+	hello := &handshakeHello{}
+	if _, err = hello.Unmarshal(p.GetBody()); err != nil {
+		return nil, err
+	}
+
+	if hello.Version < s.opts.MinProtocolVersion {
+		reason := fmt.Sprintf("protocol version %d too old, require %d or newer", hello.Version, s.opts.MinProtocolVersion)
+		WritePacket(conn, refusePacket(hello.Version, reason))
+		return nil, fmt.Errorf("%w: %s", ErrVersionTooOld, reason)
+	}
+
+	version := negotiateVersion(ProtocolVersion, hello.Version)
+	caps := hello.Caps & SupportedCapabilities &^ s.opts.DisabledCapabilities
+	if version < 2 {
+		// no compression byte in version 1 hellos
+		caps &^= CapCompression
+	}
+
+	compress := CompressNone
+	if caps.Has(CapCompression) {
+		compress = chooseCompression(s.opts.Compressions, hello.Compress)
+		if compress == CompressNone {
+			caps &^= CapCompression
+		}
+	}
+
 	var userinfo *UserInfo
 
+	if s.opts.Unix.PeerCredAuth != nil && isUnixConn(conn) {
+		cred, err := peerCred(conn)
+		if err == nil {
+			userinfo, err = s.opts.Unix.PeerCredAuth(cred)
+		}
+		if err != nil {
+			WritePacket(conn, refusePacket(version, "auth failed"))
+			return nil, fmt.Errorf("%w: %w", errAuthFailed, err)
+		}
+	}
+
 	// auth token
-	if s.opts.AuthFunc != nil {
+	if s.opts.AuthFunc != nil && userinfo == nil {
 		p.SetFlag(hvPacketFlagActionRequire)
 		p.SetBody([]byte("auth"))
 		if _, err = WritePacket(conn, p); err != nil {
 			return nil, err
 		}
 
-		if p, err = ReadPacketT[*HVPacket](conn); err != nil || p.GetFlag() != hvPacketFlagDoAction {
+		if p, err = ReadPacketT[*HVPacket](reader); err != nil {
 			return nil, err
 		}
+		if p.GetFlag() != hvPacketFlagDoAction {
+			return nil, ErrInvalidPacket
+		}
 
 		if userinfo, err = s.opts.AuthFunc(p.GetBody()); err != nil {
-			p.SetFlag(hvPacketFlagAckResult)
-			p.SetBody([]byte("fail"))
-			WritePacket(conn, p)
-			return nil, err
+			WritePacket(conn, refusePacket(version, "auth failed"))
+			return nil, fmt.Errorf("%w: %w", errAuthFailed, err)
 		}
 	}
 
 	socketid := NewSessionID()
 
+	queue := s.opts.SendQueue
+	if s.opts.SendQueueFunc != nil && userinfo != nil {
+		queue = s.opts.SendQueueFunc(userinfo)
+	}
+	queue = queue.withDefaults()
+
 	socket := &tcpSocket{
 		id:       socketid,
+		kind:     s.sessionKind(conn),
 		conn:     conn,
 		timeOut:  s.opts.HeatbeatInterval,
-		chWrite:  make(chan Packet, 100),
 		chRead:   make(chan Packet, 100),
 		chClosed: make(chan struct{}),
 		status:   Disconnected,
+		version:  version,
+		caps:     caps,
+
+		compress:          compress,
+		compressThreshold: s.opts.CompressThreshold,
+		fragmentSize:      s.opts.FragmentSize,
+		reassembler:       newReassembler(s.opts.MaxReassemblyBytes),
+
+		reader:     newPacketReader(conn, s.opts.MaxBodyLen, s.opts.PoolBuffers),
+		maxBodyLen: s.opts.MaxBodyLen,
+
+		queue:   queue,
+		capture: s.opts.Capture,
 	}
+	socket.reader.routeFlags = caps.routeFlags()
+	if s.opts.OnSessionError != nil {
+		socket.onError = func(err error) { s.opts.OnSessionError(socket, err) }
+	}
+	socket.initLanes(queue.Size)
+	newBatchWriter(socket, s.opts.WriteBatch)
 
 	p.SetFlag(hvPacketFlagAckResult)
-	p.SetBody([]byte(socketid))
+	if version == 0 {
+		// version 0 clients read the bare session id
+		p.SetBody([]byte(socketid))
+	} else {
+		ack := &handshakeHello{Version: version, Caps: caps, Compress: compress}
+		p.SetBody(append(ack.Marshal(), socketid...))
+	}
 	if _, err := WritePacket(conn, p); err != nil {
 		return nil, err
 	}
@@ -222,6 +532,33 @@ func (s *tcpServer) handshake(conn net.Conn) (*tcpSocket, error) {
 	return socket, nil
 }
 
+// sessionKind is the listener scheme, http listeners tell websockets from polling sessions.
+func (s *tcpServer) sessionKind(conn net.Conn) string {
+	k, ok := conn.(interface{ sessionKind() string })
+	if !ok {
+		return s.kind
+	}
+	if isTLSScheme(s.kind) {
+		return k.sessionKind() + "s"
+	}
+	return k.sessionKind()
+}
+
+// SetAdmission replaces the admission limits and ip filters of the listener, it keeps opts when they are invalid.
+// connections already admitted stay.
+func (s *tcpServer) SetAdmission(opts AdmissionOptions) error {
+	return s.admission.setOptions(opts)
+}
+
+// SetIPLimit replaces the per ip limits of the listener, connection rates start over.
+func (s *tcpServer) SetIPLimit(opts IPLimitOptions) {
+	s.ipLimiter.setOptions(opts)
+}
+
+func (s *tcpServer) AdmissionStats() AdmissionStats {
+	return s.admission.stats()
+}
+
 func (s *tcpServer) Address() net.Addr {
 	return s.listener.Addr()
 }
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"route/audit"
+)
+
+type recordTrail struct {
+	mu     sync.Mutex
+	events []audit.Event
+}
+
+func (r *recordTrail) Record(e audit.Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, e)
+}
+
+func (r *recordTrail) reasons() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var ret []string
+	for _, e := range r.events {
+		ret = append(ret, e.Reason)
+	}
+	return ret
+}
+
+func TestAuditAcceptRefused(t *testing.T) {
+	trail := &recordTrail{}
+	svr, err := NewTcpServer(TcpServerOptions{
+		ListenAddr: "127.0.0.1:0",
+		Admission:  AdmissionOptions{MaxConns: 1},
+		Audit:      trail,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	svr.Start()
+	defer svr.Stop()
+
+	// the first connection holds the only slot while it handshakes
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", svr.Address().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if reasons := trail.reasons(); len(reasons) == 1 && reasons[0] == RejectMaxConns {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("refused connection not audited: %v", trail.reasons())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
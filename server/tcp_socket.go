@@ -1,6 +1,7 @@
 package server
 
 import (
+	"bufio"
 	"errors"
 	"io"
 	"net"
@@ -15,19 +16,27 @@ var DefaultTimeoutSec = 30
 var DefaultMinTimeoutSec = 10
 
 type UserInfo struct {
-	UId uint32
+	UId   uint32
+	URole string
+	// name the user authenticated as, for logs and audit
+	UName string
 }
 
 func (u *UserInfo) UserID() uint32 {
 	return u.UId
 }
 
+func (u *UserInfo) UserRole() string {
+	return u.URole
+}
+
 type tcpSocket struct {
 	UserInfo
 	userData
 
 	conn net.Conn
 	id   string
+	kind string
 
 	chWrite  chan Packet
 	chRead   chan Packet
@@ -40,7 +49,41 @@ type tcpSocket struct {
 
 	status SessionStatus
 
-	writeSize int64
+	connectedAt time.Time
+	writeSize   int64
+	packetsIn   int64
+	packetsOut  int64
+	// smoothed round trip time in nanoseconds, measured by pings
+	rtt int64
+
+	// negotiated in handshake
+	version uint8
+	caps    Capability
+
+	compress          CompressAlgo
+	compressThreshold int
+
+	fragmentSize int
+	fragmentID   uint32
+	reassembler  *reassembler
+
+	reader     *packetReader
+	writer     *packetWriter
+	bw         *bufio.Writer
+	batch      WriteBatchOptions
+	maxBodyLen uint32
+
+	queue   SendQueueOptions
+	dropped uint64
+
+	capture *Capture
+	// told of packets dropped for breaking the protocol, nil closes the session on them
+	onError func(error)
+
+	// send lanes by priority, chWrite is the normal one
+	lanes      [priorityCount]chan Packet
+	laneCursor int
+	laneCredit int
 }
 
 func (s *tcpSocket) SessionID() string {
@@ -48,19 +91,26 @@ func (s *tcpSocket) SessionID() string {
 }
 
 func (s *tcpSocket) SessionType() string {
-	return "tcp"
+	if s.kind == "" {
+		return "tcp"
+	}
+	return s.kind
+}
+
+func (s *tcpSocket) ProtocolVersion() uint8 {
+	return s.version
+}
+
+func (s *tcpSocket) Capabilities() Capability {
+	return s.caps
+}
+
+func (s *tcpSocket) Compression() CompressAlgo {
+	return s.compress
 }
 
 func (s *tcpSocket) Send(p Packet) error {
-	if !s.IsValid() {
-		return ErrDisconn
-	}
-	select {
-	case <-s.chClosed:
-		return ErrDisconn
-	case s.chWrite <- p:
-		return nil
-	}
+	return s.SendWithPriority(p, packetPriority(p))
 }
 
 func (s *tcpSocket) Close() error {
@@ -105,20 +155,17 @@ func (s *tcpSocket) Status() SessionStatus {
 
 func (s *tcpSocket) writeWork() error {
 	for {
-		select {
-		case <-s.chClosed:
+		p, ok := s.waitPacket(nil)
+		if !ok {
 			return nil
-		case p, ok := <-s.chWrite:
-			if !ok {
-				return nil
-			}
-			s.conn.SetWriteDeadline(time.Now().Add(s.timeOut))
-			n, err := WritePacket(s.conn, p)
-			if err != nil {
+		}
+		if err := s.writePacket(p); err != nil {
+			return err
+		}
+		if s.bw != nil {
+			if err := s.drainBatch(); err != nil {
 				return err
 			}
-			s.writeSize += n
-			s.lastSendAt = time.Now().Unix()
 		}
 	}
 
@@ -134,15 +181,109 @@ func (s *tcpSocket) writeWork() error {
 	// return nil
 }
 
-func (s *tcpSocket) readWork() error {
+func (s *tcpSocket) checkSize(p Packet) error {
+	switch p := p.(type) {
+	case *HVPacket:
+		if len(p.GetBody()) > MaxPacketBodyLen {
+			return ErrBodyTooLarge
+		}
+	case *RoutePacket:
+		if len(p.Body) > MaxPacketBodyLen && !s.caps.Has(CapFragment) {
+			return ErrBodyTooLarge
+		}
+	}
+	return nil
+}
+
+func (s *tcpSocket) writePacket(p Packet) error {
+	defer releasePacket(p)
+	s.capture.Record(s.id, CaptureOut, p)
+
+	if rp, ok := p.(*RoutePacket); ok {
+		rp = compressPacket(s.compress, s.compressThreshold, rp)
+		if s.caps.Has(CapFragment) && len(rp.Body) > s.fragmentSize {
+			for _, frag := range splitPacket(rp, atomic.AddUint32(&s.fragmentID, 1), s.fragmentSize) {
+				if err := s.writeOne(frag); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		return s.writeOne(rp)
+	}
+	return s.writeOne(p)
+}
+
+func (s *tcpSocket) writeOne(p Packet) error {
+	s.conn.SetWriteDeadline(time.Now().Add(s.timeOut))
+	n, err := s.writer.WritePacket(p)
+	if err == ErrBodyTooLarge {
+		// refused before anything was written, the stream is still in sync
+		atomic.AddUint64(&s.dropped, 1)
+		metricDrops.With("too_large").Inc()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	countPacket(dirOut, p, n)
+	atomic.AddInt64(&s.writeSize, n)
+	atomic.AddInt64(&s.packetsOut, 1)
+	atomic.StoreInt64(&s.lastSendAt, time.Now().Unix())
+	return nil
+}
+
+// readPacket reads the next whole packet, reassembling fragments and decompressing bodies.
+func (s *tcpSocket) readPacket() (Packet, error) {
 	for {
 		s.conn.SetReadDeadline(time.Now().Add(s.timeOut))
+		before := atomic.LoadInt64(&s.reader.n)
+		p, err := ReadPacket(s.reader)
+		if err != nil {
+			return nil, err
+		}
+		countPacket(dirIn, p, atomic.LoadInt64(&s.reader.n)-before)
+		atomic.StoreInt64(&s.lastRecvAt, time.Now().Unix())
+		atomic.AddInt64(&s.packetsIn, 1)
+
+		rp, ok := p.(*RoutePacket)
+		if !ok {
+			return p, nil
+		}
+		limit := int(s.maxBodyLen)
+		if rp.HasFlag(RouteFlagFragment) {
+			if s.reassembler == nil {
+				return nil, ErrInvalidPacket
+			}
+			frag := rp
+			rp, err = s.reassembler.add(frag)
+			frag.Release()
+			if err != nil {
+				return nil, err
+			}
+			if rp == nil {
+				continue
+			}
+			limit = s.reassembler.limit
+		}
+		if err := decompressPacket(s.compress, rp, int64(limit)); err != nil {
+			return nil, err
+		}
+		return rp, nil
+	}
+}
 
-		p, err := ReadPacket(s.conn)
+func (s *tcpSocket) readWork() error {
+	for {
+		p, err := s.readPacket()
+		if errors.Is(err, ErrInvalidMsgtype) && s.onError != nil {
+			s.onError(err)
+			continue
+		}
 		if err != nil {
 			return err
 		}
-		s.lastRecvAt = time.Now().Unix()
+		s.capture.Record(s.id, CaptureIn, p)
 		select {
 		case <-s.chClosed:
 			return nil
@@ -153,8 +294,13 @@ func (s *tcpSocket) readWork() error {
 
 func ReadPacket(conn io.Reader) (Packet, error) {
 	var err error
-	pktype := make([]byte, 1)
-	_, err = conn.Read(pktype)
+	var pktype []byte
+	if pr, ok := conn.(*packetReader); ok {
+		pktype = pr.typ[:]
+	} else {
+		pktype = make([]byte, 1)
+	}
+	_, err = io.ReadFull(conn, pktype)
 	if err != nil {
 		return nil, err
 	}
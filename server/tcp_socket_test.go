@@ -2,7 +2,10 @@ package server
 
 import (
 	"fmt"
+	"io"
 	"math/rand"
+	"net"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -54,3 +57,170 @@ func TestTcpSocketClose(t *testing.T) {
 		}
 	}
 }
+
+// BenchmarkSocketThroughput fans small packets out through one socket over loopback tcp.
+func BenchmarkSocketThroughput(b *testing.B) {
+	cases := []struct {
+		name  string
+		batch WriteBatchOptions
+	}{
+		{"unbatched", WriteBatchOptions{Size: -1}},
+		{"batched", WriteBatchOptions{}},
+		{"linger", WriteBatchOptions{Linger: 100 * time.Microsecond}},
+	}
+	for _, c := range cases {
+		b.Run(c.name, func(b *testing.B) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer ln.Close()
+
+			go func() {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				io.Copy(io.Discard, conn)
+			}()
+
+			conn, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer conn.Close()
+
+			s := &tcpSocket{
+				conn:     conn,
+				timeOut:  time.Minute,
+				chClosed: make(chan struct{}),
+				status:   Connected,
+			}
+			s.initLanes(1024)
+			newBatchWriter(s, c.batch)
+			done := make(chan error, 1)
+			go func() { done <- s.writeWork() }()
+
+			p := NewRoutePacket()
+			p.Body = make([]byte, 64)
+			frameLen := int64(1 + RoutePacketHeadLen + len(p.Body))
+
+			b.SetBytes(frameLen)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := s.Send(p); err != nil {
+					b.Fatal(err)
+				}
+			}
+			for atomic.LoadInt64(&s.writeSize) < frameLen*int64(b.N) {
+				time.Sleep(50 * time.Microsecond)
+			}
+			b.StopTimer()
+			s.Close()
+			<-done
+		})
+	}
+}
+
+func TestSendQueueOverflow(t *testing.T) {
+	newSocket := func(q SendQueueOptions) *tcpSocket {
+		q.Size = 2
+		s := &tcpSocket{
+			chClosed: make(chan struct{}),
+			status:   Connected,
+			queue:    q,
+		}
+		s.initLanes(q.Size)
+		return s
+	}
+	packet := func(uid uint32) Packet {
+		p := NewRoutePacket()
+		p.SetUid(uid)
+		return p
+	}
+
+	s := newSocket(SendQueueOptions{Overflow: OverflowDropNewest})
+	for i := 1; i <= 3; i++ {
+		s.Send(packet(uint32(i)))
+	}
+	if s.Dropped() != 1 || (<-s.chWrite).(*RoutePacket).GetUid() != 1 {
+		t.Fatalf("drop newest kept the wrong packets")
+	}
+
+	s = newSocket(SendQueueOptions{Overflow: OverflowDropOldest})
+	for i := 1; i <= 3; i++ {
+		if err := s.Send(packet(uint32(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s.Dropped() != 1 || (<-s.chWrite).(*RoutePacket).GetUid() != 2 {
+		t.Fatalf("drop oldest kept the wrong packets")
+	}
+
+	s = newSocket(SendQueueOptions{Overflow: OverflowBlock, BlockTimeout: 10 * time.Millisecond})
+	s.Send(packet(1))
+	s.Send(packet(2))
+	drops := metricDrops.With(OverflowBlock.String()).Value()
+	if err := s.Send(packet(3)); err != ErrSendTimeout || s.Dropped() != 1 {
+		t.Fatalf("err %v, want ErrSendTimeout", err)
+	}
+	if metricDrops.With(OverflowBlock.String()).Value() != drops+1 {
+		t.Fatal("timed out packet not counted in route_send_drops_total")
+	}
+
+	s = newSocket(SendQueueOptions{Overflow: OverflowDisconnect})
+	s.Send(packet(1))
+	s.Send(packet(2))
+	if err := s.Send(packet(3)); err != ErrSendQueueFull || s.IsValid() {
+		t.Fatalf("session should be closed on overflow")
+	}
+}
+
+func TestSendLanes(t *testing.T) {
+	s := &tcpSocket{
+		chClosed: make(chan struct{}),
+		status:   Connected,
+	}
+	s.initLanes(64)
+
+	send := func(prio Priority, n int) {
+		for i := 0; i < n; i++ {
+			p := NewRoutePacket()
+			p.SetPriority(prio)
+			if err := s.Send(p); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	send(PriorityBulk, 10)
+	send(PriorityNormal, 20)
+	send(PriorityHigh, 40)
+	hb := NewHVPacket()
+	hb.SetFlag(HVPacketFlagHeartbeat)
+	s.Send(hb)
+
+	got := []Priority{}
+	for {
+		p, _ := s.pollPacket()
+		if p == nil {
+			break
+		}
+		got = append(got, packetPriority(p))
+	}
+	if len(got) != 71 || got[0] != PriorityControl {
+		t.Fatalf("control packet should be written first, got %v", got[:1])
+	}
+
+	// high is preferred, but lower lanes are not starved while it is busy
+	firstBulk := -1
+	for i, p := range got {
+		if p == PriorityBulk {
+			firstBulk = i
+			break
+		}
+	}
+	if got[1] != PriorityHigh || firstBulk < 0 || firstBulk > 14 {
+		t.Fatalf("unexpected lane order %v", got)
+	}
+}
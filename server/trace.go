@@ -0,0 +1,112 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+)
+
+// TraceContext is a w3c trace context, the zero value means the packet is not traced.
+type TraceContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Flags   byte
+}
+
+// TraceFlagSampled is the only trace flag defined by w3c.
+const TraceFlagSampled byte = 0x01
+
+// version, trace id, span id and flags, as in the binary form of traceparent
+const traceContextLen = 1 + 16 + 8 + 1
+
+func (t TraceContext) IsValid() bool {
+	return t.TraceID != [16]byte{} && t.SpanID != [8]byte{}
+}
+
+// String formats t as a traceparent header value.
+func (t TraceContext) String() string {
+	return fmt.Sprintf("00-%x-%x-%02x", t.TraceID, t.SpanID, t.Flags)
+}
+
+// ParseTraceparent parses a traceparent header value, later versions are read as version 00.
+func ParseTraceparent(v string) (TraceContext, error) {
+	var t TraceContext
+	if len(v) < 55 || (len(v) > 55 && v[55] != '-') || v[2] != '-' || v[35] != '-' || v[52] != '-' {
+		return t, fmt.Errorf("invalid traceparent %q", v)
+	}
+	var version [1]byte
+	if _, err := hex.Decode(version[:], []byte(v[0:2])); err != nil || version[0] == 0xff || (version[0] == 0 && len(v) != 55) {
+		return t, fmt.Errorf("invalid traceparent %q", v)
+	}
+	var flags [1]byte
+	_, err1 := hex.Decode(t.TraceID[:], []byte(v[3:35]))
+	_, err2 := hex.Decode(t.SpanID[:], []byte(v[36:52]))
+	_, err3 := hex.Decode(flags[:], []byte(v[53:55]))
+	t.Flags = flags[0]
+	if err1 != nil || err2 != nil || err3 != nil || !t.IsValid() {
+		return TraceContext{}, fmt.Errorf("invalid traceparent %q", v)
+	}
+	return t, nil
+}
+
+func (t TraceContext) appendBinary(b []byte) []byte {
+	b = append(b, 0)
+	b = append(b, t.TraceID[:]...)
+	b = append(b, t.SpanID[:]...)
+	return append(b, t.Flags)
+}
+
+func (t *TraceContext) unmarshalBinary(b []byte) bool {
+	if len(b) < traceContextLen || b[0] == 0xff {
+		return false
+	}
+	var ret TraceContext
+	copy(ret.TraceID[:], b[1:17])
+	copy(ret.SpanID[:], b[17:25])
+	ret.Flags = b[25]
+	if !ret.IsValid() {
+		return false
+	}
+	*t = ret
+	return true
+}
+
+// NewTraceID returns a random trace id, for tracers starting a new trace.
+func NewTraceID() (ret [16]byte) {
+	rand.Read(ret[:])
+	return
+}
+
+// NewSpanID returns a random span id.
+func NewSpanID() (ret [8]byte) {
+	rand.Read(ret[:])
+	return
+}
+
+// Tracer records spans of the work route does for a packet or a connection.
+type Tracer interface {
+	// StartSpan begins a span, the child of parent when it is valid.
+	StartSpan(name string, parent TraceContext) Span
+}
+
+type Span interface {
+	// Context is propagated to the next hop, it may be the parent of the span when nothing is recorded.
+	Context() TraceContext
+	// SetAttributes adds key, value pairs to the span.
+	SetAttributes(kv ...any)
+	// End finishes the span, err tells it failed.
+	End(err error)
+}
+
+// NopTracer records nothing, its spans pass the parent context through.
+type NopTracer struct{}
+
+func (NopTracer) StartSpan(name string, parent TraceContext) Span {
+	return nopSpan(parent)
+}
+
+type nopSpan TraceContext
+
+func (s nopSpan) Context() TraceContext { return TraceContext(s) }
+func (nopSpan) SetAttributes(kv ...any) {}
+func (nopSpan) End(err error)           {}
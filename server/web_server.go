@@ -1,80 +1,328 @@
 package server
 
 import (
-	"context"
+	"bufio"
+	"encoding/base64"
+	"io"
+	"net"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/gobwas/ws"
 )
 
-func NewServer(opts ServerOptions) *HttpServer {
+// NewServer serves sessions over http on ln, for clients that cannot open raw sockets.
+// under opts.Path it takes websocket upgrades, and for networks blocking those a
+// fallback where the client opens a session, posts its packet stream and receives
+// the server's by long-polling or server-sent events:
+//
+//	POST path/open                   returns the session id
+//	POST path/send?sid=              body is appended to the stream from the client,
+//	                                 413 beyond MaxPacketBodyLen, 429 while the server is behind
+//	GET  path/poll?sid=              bytes to the client, empty after a timeout
+//	GET  path/events?sid=            the same as server-sent events of base64 data
+//	POST path/close?sid=
+//
+// any other request goes to opts.Handler when it is set.
+// either way connections come out of Accept, to be served by tcpServer like any other.
+func NewServer(ln net.Listener, opts ServerOptions) *HttpServer {
+	if opts.Path == "" {
+		opts.Path = "/"
+	}
+	if opts.HeatbeatInterval <= 0 {
+		opts.HeatbeatInterval = time.Duration(DefaultTimeoutSec) * time.Second
+	}
 	ret := &HttpServer{
-		opts: opts,
-		die:  make(chan bool),
-		httpsvr: &http.Server{
-			Addr: opts.Address,
-		},
+		opts:     opts,
+		ln:       ln,
+		conns:    make(map[string]*httpConn),
+		chAccept: make(chan net.Conn),
+		die:      make(chan bool),
+	}
+	prefix := strings.TrimSuffix(opts.Path, "/")
+	mux := http.NewServeMux()
+	if opts.Path != "/" {
+		mux.HandleFunc("/", ret.fallback)
+	}
+	mux.HandleFunc(opts.Path, ret.upgrade)
+	mux.HandleFunc(prefix+"/open", ret.open)
+	mux.HandleFunc(prefix+"/send", ret.send)
+	mux.HandleFunc(prefix+"/poll", ret.poll)
+	mux.HandleFunc(prefix+"/events", ret.events)
+	mux.HandleFunc(prefix+"/close", ret.close)
+	ret.httpsvr = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: opts.HeatbeatInterval,
 	}
-
 	return ret
 }
 
+// DefaultMaxPollSessions bounds the polling sessions a listener of tcpServer keeps open,
+// they are opened before the client authenticates.
+const DefaultMaxPollSessions = 1024
+
 type ServerOptions struct {
-	Address          string
+	Path string
+	// polling sessions idle for this long are closed
 	HeatbeatInterval time.Duration
-	OnSocketMessage  FuncOnSessionPacket
-	OnAccpect        FuncOnAccpect
+	// polling sessions are refused when this many are open, 0 means unlimited.
+	// TcpServerOptions.MaxPollSessions defaults it for listeners of tcpServer
+	MaxPollSessions int
+	// serves the requests that are not for sessions, such as an api sharing the port
+	Handler http.Handler
 }
 
 type HttpServer struct {
 	opts ServerOptions
 
-	die     chan bool
-	httpsvr *http.Server
+	ln       net.Listener
+	httpsvr  *http.Server
+	mu       sync.Mutex
+	conns    map[string]*httpConn
+	chAccept chan net.Conn
+	die      chan bool
+	once     sync.Once
 }
 
 func (s *HttpServer) Start() error {
-	s.httpsvr.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		conn, _, _, err := ws.UpgradeHTTP(r, w)
-		if err != nil {
-			return
+	go s.httpsvr.Serve(s.ln)
+	go s.sweepWork()
+	return nil
+}
+
+func (s *HttpServer) Stop() error {
+	s.once.Do(func() {
+		close(s.die)
+		s.mu.Lock()
+		conns := s.conns
+		s.conns = make(map[string]*httpConn)
+		s.mu.Unlock()
+		for _, conn := range conns {
+			conn.Close()
 		}
+		// every session is gone, nothing is left for a graceful shutdown to wait for
+		s.httpsvr.Close()
+	})
+	return nil
+}
 
-		socket := NewWebSocket(NewSessionID(), conn)
-		defer socket.Close()
+// Accept, Close and Addr let tcpServer take sessions from it as from a listener.
+func (s *HttpServer) Accept() (net.Conn, error) {
+	select {
+	case conn := <-s.chAccept:
+		return conn, nil
+	case <-s.die:
+		return nil, net.ErrClosed
+	}
+}
 
-		// if s.opts.OnConn != nil {
-		// 	s.opts.OnConn(socket, Connected)
-		// 	defer s.opts.OnConn(socket, Disconnected)
-		// }
+func (s *HttpServer) Close() error {
+	return s.Stop()
+}
 
-		go socket.writeWork()
+func (s *HttpServer) Addr() net.Addr {
+	return s.ln.Addr()
+}
 
-		for {
-			// p := &Packet{}
-			// err := socket.readPacket(p)
-			// if err != nil {
-			// 	break
-			// }
+func (s *HttpServer) deliver(conn net.Conn) bool {
+	select {
+	case s.chAccept <- conn:
+		return true
+	case <-s.die:
+		return false
+	}
+}
 
-			// if s.opts.OnMessage != nil {
-			// 	s.opts.OnMessage(socket, p)
-			// }
+func (s *HttpServer) upgrade(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != s.opts.Path || !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		s.fallback(w, r)
+		return
+	}
+	conn, rw, _, err := ws.UpgradeHTTP(r, w)
+	if err != nil {
+		return
+	}
+	var buffered *bufio.Reader
+	if rw != nil {
+		buffered = rw.Reader
+	}
+	if !s.deliver(newWSConn(conn, buffered, ws.StateServerSide)) {
+		conn.Close()
+	}
+}
 
+func (s *HttpServer) fallback(w http.ResponseWriter, r *http.Request) {
+	if s.opts.Handler == nil {
+		http.NotFound(w, r)
+		return
+	}
+	s.opts.Handler.ServeHTTP(w, r)
+}
+
+func (s *HttpServer) open(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	sid, err := newHTTPSessionID()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	remote, err := net.ResolveTCPAddr("tcp", r.RemoteAddr)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	conn := newHTTPConn(sid, s.ln.Addr(), remote)
+	// sessions refused or closed by the server give their slot back at once
+	conn.onClose = func() { s.remove(sid) }
+
+	s.mu.Lock()
+	if s.opts.MaxPollSessions > 0 && len(s.conns) >= s.opts.MaxPollSessions {
+		s.mu.Unlock()
+		http.Error(w, "too many sessions", http.StatusServiceUnavailable)
+		return
+	}
+	s.conns[sid] = conn
+	s.mu.Unlock()
+
+	if !s.deliver(conn) {
+		s.remove(sid)
+		http.Error(w, "server closed", http.StatusServiceUnavailable)
+		return
+	}
+	io.WriteString(w, sid)
+}
+
+func (s *HttpServer) lookup(w http.ResponseWriter, r *http.Request) *httpConn {
+	s.mu.Lock()
+	conn := s.conns[r.URL.Query().Get("sid")]
+	s.mu.Unlock()
+	if conn == nil {
+		http.Error(w, errHTTPSessionGone.Error(), http.StatusGone)
+	}
+	return conn
+}
+
+func (s *HttpServer) remove(sid string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.conns, sid)
+}
+
+func (s *HttpServer) send(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	conn := s.lookup(w, r)
+	if conn == nil {
+		return
+	}
+	// a cut body would leave the stream at the wrong offset, it is refused whole
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MaxPacketBodyLen))
+	if err != nil {
+		code := http.StatusBadRequest
+		if _, ok := err.(*http.MaxBytesError); ok {
+			code = http.StatusRequestEntityTooLarge
 		}
-	})
+		http.Error(w, err.Error(), code)
+		return
+	}
+	if err := conn.push(body); err != nil {
+		code := http.StatusGone
+		if err == errHTTPBacklog {
+			code = http.StatusTooManyRequests
+		}
+		http.Error(w, err.Error(), code)
+	}
+}
 
-	err := s.httpsvr.ListenAndServe()
-	return err
+func (s *HttpServer) poll(w http.ResponseWriter, r *http.Request) {
+	conn := s.lookup(w, r)
+	if conn == nil {
+		return
+	}
+	data, err := conn.take(httpPollTimeout, r.Context().Done())
+	if err != nil {
+		s.remove(conn.sid)
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(data)
 }
 
-func (s *HttpServer) Stop() error {
-	select {
-	case <-s.die:
-	default:
-		close(s.die)
-		s.httpsvr.Shutdown(context.Background())
+func (s *HttpServer) events(w http.ResponseWriter, r *http.Request) {
+	conn := s.lookup(w, r)
+	if conn == nil {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	flusher.Flush()
+
+	for {
+		data, err := conn.take(httpPollTimeout, r.Context().Done())
+		if err != nil {
+			s.remove(conn.sid)
+			io.WriteString(w, "event: close\ndata:\n\n")
+			flusher.Flush()
+			return
+		}
+		if len(data) == 0 {
+			if r.Context().Err() != nil {
+				return
+			}
+			// keeps proxies from timing the stream out
+			io.WriteString(w, ": ping\n\n")
+		} else {
+			io.WriteString(w, "data: "+base64.StdEncoding.EncodeToString(data)+"\n\n")
+		}
+		flusher.Flush()
+	}
+}
+
+func (s *HttpServer) close(w http.ResponseWriter, r *http.Request) {
+	conn := s.lookup(w, r)
+	if conn == nil {
+		return
+	}
+	conn.Close()
+	s.remove(conn.sid)
+}
+
+// sweepWork closes polling sessions whose client went away without closing them.
+func (s *HttpServer) sweepWork() {
+	tk := time.NewTicker(s.opts.HeatbeatInterval / 2)
+	defer tk.Stop()
+	for {
+		select {
+		case <-s.die:
+			return
+		case now := <-tk.C:
+			var idle []*httpConn
+			s.mu.Lock()
+			for sid, conn := range s.conns {
+				if now.Sub(conn.idleSince()) > s.opts.HeatbeatInterval+httpPollTimeout {
+					idle = append(idle, conn)
+					delete(s.conns, sid)
+				}
+			}
+			s.mu.Unlock()
+			// Close removes the session again, it must not run under s.mu
+			for _, conn := range idle {
+				conn.Close()
+			}
+		}
 	}
-	return nil
 }
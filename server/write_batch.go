@@ -0,0 +1,87 @@
+package server
+
+import (
+	"bufio"
+	"time"
+)
+
+const DefaultWriteBatchSize = 32 * 1024
+
+// WriteBatchOptions controls how queued packets are coalesced into fewer writes.
+type WriteBatchOptions struct {
+	// buffer size, a full buffer is flushed at once. 0 means DefaultWriteBatchSize, negative disables batching
+	Size int
+	// how long to wait for more packets once the queue is empty, and the longest a buffered packet may wait.
+	// 0 flushes as soon as the queue is empty
+	Linger time.Duration
+}
+
+func newBatchWriter(s *tcpSocket, opts WriteBatchOptions) {
+	if opts.Size == 0 {
+		opts.Size = DefaultWriteBatchSize
+	}
+	s.batch = opts
+	if opts.Size < 0 {
+		s.bw = nil
+		s.writer = newPacketWriter(s.conn)
+		s.writer.ext = s.caps.Has(CapExtendedRouteHead)
+		return
+	}
+	s.bw = bufio.NewWriterSize(s.conn, opts.Size)
+	s.writer = newPacketWriter(s.bw)
+	s.writer.ext = s.caps.Has(CapExtendedRouteHead)
+}
+
+func (s *tcpSocket) flush() error {
+	if s.bw == nil || s.bw.Buffered() == 0 {
+		return nil
+	}
+	s.conn.SetWriteDeadline(time.Now().Add(s.timeOut))
+	return s.bw.Flush()
+}
+
+// drainBatch keeps moving queued packets into the buffer, and flushes it when the queue runs dry
+// or the oldest buffered packet has waited for Linger. a full buffer flushes itself.
+func (s *tcpSocket) drainBatch() error {
+	startAt := time.Now()
+	var timer *time.Timer
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	for s.bw.Buffered() > 0 {
+		p, ok := s.pollPacket()
+		if !ok {
+			return s.flush()
+		}
+		if p != nil {
+			if err := s.writePacket(p); err != nil {
+				return err
+			}
+			if s.batch.Linger > 0 && time.Since(startAt) >= s.batch.Linger {
+				return s.flush()
+			}
+			continue
+		}
+
+		wait := s.batch.Linger - time.Since(startAt)
+		if wait <= 0 {
+			return s.flush()
+		}
+		if timer == nil {
+			timer = time.NewTimer(wait)
+		} else {
+			timer.Reset(wait)
+		}
+		p, ok = s.waitPacket(timer.C)
+		if p == nil || !ok {
+			return s.flush()
+		}
+		if err := s.writePacket(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+)
+
+// wsConn carries the packet stream in binary websocket messages, so a websocket
+// is served by the same socket code as a plain tcp connection.
+type wsConn struct {
+	net.Conn
+	state ws.State
+	r     *wsutil.Reader
+	ctl   wsutil.ControlHandler
+	wmu   sync.Mutex
+}
+
+func newWSConn(conn net.Conn, buffered *bufio.Reader, state ws.State) *wsConn {
+	var src io.Reader = conn
+	if buffered != nil && buffered.Buffered() > 0 {
+		src = io.MultiReader(buffered, conn)
+	}
+	c := &wsConn{Conn: conn, state: state}
+	c.r = &wsutil.Reader{Source: src, State: state}
+	c.ctl = wsutil.ControlHandler{Src: c.r, Dst: wsFrameWriter{c}, State: state}
+	return c
+}
+
+func (c *wsConn) Read(b []byte) (int, error) {
+	for {
+		n, err := c.r.Read(b)
+		if err == io.EOF {
+			// end of a message, the stream goes on with the next one
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		if err != wsutil.ErrNoFrameAdvance {
+			return n, err
+		}
+		hdr, err := c.r.NextFrame()
+		if err != nil {
+			return 0, err
+		}
+		if hdr.OpCode.IsControl() {
+			if err := c.ctl.Handle(hdr); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if hdr.OpCode != ws.OpBinary && hdr.OpCode != ws.OpContinuation {
+			return 0, ErrInvalidPacket
+		}
+	}
+}
+
+func (c *wsConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	var err error
+	if c.state.ClientSide() {
+		err = wsutil.WriteClientBinary(c.Conn, b)
+	} else {
+		err = wsutil.WriteServerBinary(c.Conn, b)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *wsConn) sessionKind() string {
+	return "ws"
+}
+
+// wsFrameWriter writes control replies, which must not interleave with data frames.
+type wsFrameWriter struct {
+	c *wsConn
+}
+
+func (w wsFrameWriter) Write(b []byte) (int, error) {
+	w.c.wmu.Lock()
+	defer w.c.wmu.Unlock()
+	return w.c.Conn.Write(b)
+}
+
+func dialWS(addr string, tlsConfig *tls.Config, timeout time.Duration) (net.Conn, error) {
+	dialer := ws.Dialer{Timeout: timeout, TLSConfig: tlsConfig}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	conn, br, _, err := dialer.Dial(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+	return newWSConn(conn, br, ws.StateClientSide), nil
+}